@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ответы участника на приглашение, как PARTSTAT в RFC 5545
+const (
+	rsvpNeedsAction = "needs-action"
+	rsvpAccepted    = "accepted"
+	rsvpDeclined    = "declined"
+	rsvpTentative   = "tentative"
+)
+
+// maxAttendees - максимальное количество участников события
+const maxAttendees = 100
+
+// validRSVP - допустимые ответы на приглашение
+var validRSVP = map[string]bool{
+	rsvpNeedsAction: true,
+	rsvpAccepted:    true,
+	rsvpDeclined:    true,
+	rsvpTentative:   true,
+}
+
+// Attendee - участник события. Status меняет только сам участник ответом на приглашение,
+// владелец события задает лишь список участников.
+type Attendee struct {
+	UserId int    `json:"user_id"`
+	Status string `json:"status"`
+}
+
+// attendee - участник события с id пользователя userId или nil
+func (e *Event) attendee(userId int) *Attendee {
+	for i := range e.Attendees {
+		if e.Attendees[i].UserId == userId {
+			return &e.Attendees[i]
+		}
+	}
+	return nil
+}
+
+// involves - видит ли пользователь событие в своем календаре: он владелец или участник
+func (e *Event) involves(userId int) bool {
+	return e.UserId == userId || e.attendee(userId) != nil
+}
+
+// inviteAttendees - выставляет статусы участников сохраняемого события: участники, которые были
+// в предыдущей версии previous, сохраняют свой ответ, новые получают needs-action. Владелец из списка
+// участников убирается, он и так видит событие.
+func (e *Event) inviteAttendees(previous *Event) {
+	attendees := e.Attendees[:0]
+	for _, a := range e.Attendees {
+		if a.UserId == e.UserId {
+			continue
+		}
+		a.Status = rsvpNeedsAction
+		if previous != nil {
+			if old := previous.attendee(a.UserId); old != nil {
+				a.Status = old.Status
+			}
+		}
+		attendees = append(attendees, a)
+	}
+	if len(attendees) == 0 {
+		attendees = nil
+	}
+	e.Attendees = attendees
+}
+
+// validateAttendees - участники без повторов, статус если передан должен быть допустимым
+func validateAttendees(event *Event, v *validator) {
+	v.check(len(event.Attendees) <= maxAttendees, "attendees", fmt.Sprintf("at most %d attendees allowed", maxAttendees))
+
+	seen := map[int]bool{}
+	for _, a := range event.Attendees {
+		v.check(a.UserId >= 0, "attendees", "wrong attendee user_id")
+		v.check(!seen[a.UserId], "attendees", "duplicate attendee "+strconv.Itoa(a.UserId))
+		v.check(a.Status == "" || validRSVP[a.Status], "attendees", "wrong attendee status "+strconv.Quote(a.Status))
+		seen[a.UserId] = true
+	}
+}
+
+// attendeesFromForm - участники из поля attendees формы: id пользователей несколькими полями или через запятую
+func attendeesFromForm(values []string, v *validator) (attendees []Attendee) {
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			userId, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil {
+				v.add("attendees", "wrong attendees")
+				continue
+			}
+			attendees = append(attendees, Attendee{UserId: userId})
+		}
+	}
+	return attendees
+}
+
+// ListInvitationsHandler - события, в которые приглашен пользователь из пути, без разворачивания повторений.
+// Необязательный status оставляет только приглашения с этим ответом.
+func (s *eventServer) ListInvitationsHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := pathUser(r)
+	if err != nil {
+		restErrorResponse(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+	status := query.Get("status")
+	v := &validator{}
+	v.check(status == "" || validRSVP[status], "status", "status must be one of needs-action, accepted, declined, tentative")
+	page := parsePage(query, defaultPageLimit, v)
+	if err = v.err(); err != nil {
+		restErrorResponse(w, err)
+		return
+	}
+
+	var events []*Event
+	for _, event := range s.storage.Invitations(userId) {
+		if status == "" || event.attendee(userId).Status == status {
+			events = append(events, event)
+		}
+	}
+
+	pageResponse(w, events, page)
+}
+
+// RespondInvitationHandler - ответ пользователя из пути на приглашение в событие: {"status": "accepted"}
+func (s *eventServer) RespondInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := pathUser(r)
+	if err != nil {
+		restErrorResponse(w, err)
+		return
+	}
+	id, err := pathInt(r, "id")
+	if err != nil {
+		restErrorResponse(w, err)
+		return
+	}
+
+	data := &struct {
+		Status string `json:"status"`
+	}{}
+	form, err := decodeBody(r, data)
+	if err != nil {
+		restErrorResponse(w, err)
+		return
+	}
+	if form != nil {
+		data.Status = form.Get("status")
+	}
+	if !validRSVP[data.Status] {
+		restErrorResponse(w, invalid("status", "status must be one of needs-action, accepted, declined, tentative"))
+		return
+	}
+
+	event, err := s.storage.Respond(id, userId, data.Status)
+	if err != nil {
+		restErrorResponse(w, err)
+		return
+	}
+
+	resourceResponse(w, http.StatusOK, event)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// defaultRetention - сколько по умолчанию можно восстановить удаленное событие
+const defaultRetention = 30 * 24 * time.Hour
+
+// AuditEntry - запись истории события: кто (Actor), когда и какой операцией изменил событие.
+// Before и After - состояние события до и после изменения, nil - события не было или оно удалено.
+type AuditEntry struct {
+	Seq     int       `json:"seq"`
+	At      time.Time `json:"at"`
+	Actor   int       `json:"actor"`
+	Op      string    `json:"op"`
+	EventId int       `json:"event_id"`
+	Before  *Event    `json:"before,omitempty"`
+	After   *Event    `json:"after,omitempty"`
+}
+
+// deletedEvent - удаленное событие, которое можно восстановить до DeletedAt + срок хранения
+type deletedEvent struct {
+	Event     *Event    `json:"event"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// actorOf - автор изменения: переданный пользователь или, если он не известен, владелец события
+func actorOf(actor *int, owner int) int {
+	if actor != nil {
+		return *actor
+	}
+	return owner
+}
+
+// audit - дописывает изменение события id в его историю
+func (s *EventLocalStorage) audit(rec record, id int, before, after *Event) {
+	s.auditSeq++
+	s.addHistory(AuditEntry{
+		Seq:     s.auditSeq,
+		At:      rec.At,
+		Actor:   rec.Actor,
+		Op:      rec.Op,
+		EventId: id,
+		Before:  before,
+		After:   after,
+	})
+}
+
+// addHistory - добавляет запись в историю события, используется и при загрузке снимка.
+// Записи хранятся столько же, сколько удаленные события, и вычищаются в purge.
+func (s *EventLocalStorage) addHistory(entry AuditEntry) {
+	s.history[entry.EventId] = append(s.history[entry.EventId], entry)
+	if entry.Seq > s.auditSeq {
+		s.auditSeq = entry.Seq
+	}
+}
+
+// restorable - удаленное событие id, срок хранения которого на момент now не истек, или nil.
+// С нулевым сроком хранения удаленное событие восстановить нельзя.
+func (s *EventLocalStorage) restorable(id int, now time.Time) *deletedEvent {
+	d, ok := s.deleted[id]
+	if !ok || now.Sub(d.DeletedAt) >= s.retention {
+		return nil
+	}
+	return d
+}
+
+// purge - окончательно забывает удаленные события и записи истории с истекшим сроком хранения.
+// Снимок файлового хранилища пишется после purge, поэтому в него они тоже не попадают.
+func (s *EventLocalStorage) purge(now time.Time) {
+	for id, d := range s.deleted {
+		if now.Sub(d.DeletedAt) >= s.retention {
+			delete(s.deleted, id)
+		}
+	}
+	for id, entries := range s.history {
+		if entries = s.retained(entries, now); len(entries) == 0 {
+			delete(s.history, id)
+		} else {
+			s.history[id] = entries
+		}
+	}
+}
+
+// retained - записи истории, срок хранения которых на момент now не истек. Записи идут по времени,
+// поэтому отрезается начало
+func (s *EventLocalStorage) retained(entries []AuditEntry, now time.Time) []AuditEntry {
+	i := 0
+	for i < len(entries) && now.Sub(entries[i].At) >= s.retention {
+		i++
+	}
+	return entries[i:]
+}
+
+// Deleted - удаленное событие, которое еще можно восстановить
+func (s *EventLocalStorage) Deleted(id int) (*Event, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	d := s.restorable(id, s.now())
+	if d == nil {
+		return nil, ErrNotFound
+	}
+	return d.Event, nil
+}
+
+// History - история изменений события от старых к новым за срок хранения, в том числе удаленного события
+func (s *EventLocalStorage) History(id int) ([]AuditEntry, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	entries := s.retained(s.history[id], s.now())
+	if len(entries) == 0 {
+		return nil, ErrNotFound
+	}
+	return append([]AuditEntry(nil), entries...), nil
+}
+
+// visibleHistory - записи истории, которые может видеть пользователь запроса: те, где он владел событием
+// до или после изменения. Событие могло сменить владельца, и прежний владелец видит только свои записи,
+// а новый - только свои. Если таких записей нет, возвращается ErrForbidden.
+func visibleHistory(r *http.Request, entries []AuditEntry) ([]AuditEntry, error) {
+	var visible []AuditEntry
+	for _, entry := range entries {
+		owned := (entry.Before != nil && authorize(r, entry.Before.UserId) == nil) ||
+			(entry.After != nil && authorize(r, entry.After.UserId) == nil)
+		if owned {
+			visible = append(visible, entry)
+		}
+	}
+	if len(visible) == 0 {
+		return nil, ErrForbidden
+	}
+	return visible, nil
+}
+
+// restoreEvent - восстанавливает удаленное событие, доступ проверяется по его владельцу
+func (s *eventServer) restoreEvent(r *http.Request, id int) (*Event, error) {
+	deleted, err := s.storage.Deleted(id)
+	if err != nil {
+		return nil, err
+	}
+	if err = authorize(r, deleted.UserId); err != nil {
+		return nil, err
+	}
+	return s.mutate(r, Operation{Op: opRestore, Id: id})
+}
+
+// RestoreEventHandler - восстанавливает удаленное событие по id, пока не истек срок хранения удаленных событий
+func (s *eventServer) RestoreEventHandler(w http.ResponseWriter, r *http.Request) {
+	id, _, err := parseId(r)
+	var event *Event
+	if err == nil {
+		event, err = s.restoreEvent(r, id)
+	}
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+
+	resultResponse(w, event)
+}
+
+// EventHistoryHandler - история изменений события за срок хранения, в том числе удаленного.
+// Каждая запись доступна тому, кто владел событием до или после изменения. Ошибки - как у остальных
+// методов старого API, включая восстановление удаленного события.
+func (s *eventServer) EventHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathInt(r, "id")
+	var entries []AuditEntry
+	if err == nil {
+		entries, err = s.storage.History(id)
+	}
+	if err == nil {
+		entries, err = visibleHistory(r, entries)
+	}
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+
+	jsonResponse(w, entries)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// роли пользователей
+const (
+	roleUser  = "user"
+	roleAdmin = "admin"
+)
+
+// apiKeyHeader - заголовок с API ключом, альтернатива "Authorization: ApiKey <ключ>"
+const apiKeyHeader = "X-API-Key"
+
+// publicPaths - пути, доступные без аутентификации. Метрики содержат только агрегированные значения
+// без данных пользователей, их собирает Prometheus, у которого нет токена. Описание API нужно клиентам до входа.
+var publicPaths = map[string]bool{
+	"/healthz":      true,
+	"/readyz":       true,
+	"/metrics":      true,
+	"/openapi.json": true,
+}
+
+// AuthConfig - настройки аутентификации. Secret - ключ HMAC для bearer токенов,
+// APIKeys - статические ключи для сервисных клиентов
+type AuthConfig struct {
+	Enabled bool           `json:"enabled" yaml:"enabled"`
+	Secret  string         `json:"secret" yaml:"secret"`
+	APIKeys []APIKeyConfig `json:"api_keys" yaml:"api_keys"`
+}
+
+// APIKeyConfig - API ключ и пользователь, от имени которого он действует
+type APIKeyConfig struct {
+	Key    string `json:"key" yaml:"key"`
+	UserId int    `json:"user_id" yaml:"user_id"`
+	Role   string `json:"role" yaml:"role"`
+}
+
+// Principal - аутентифицированный пользователь, от имени которого выполняется запрос
+type Principal struct {
+	UserId int
+	Role   string
+}
+
+// IsAdmin - администратор может работать с событиями любых пользователей
+func (p Principal) IsAdmin() bool {
+	return p.Role == roleAdmin
+}
+
+// principalFrom - пользователь из контекста запроса, ok = false если аутентификация выключена
+func principalFrom(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey).(Principal)
+	return p, ok
+}
+
+// tokenClaims - содержимое токена: sub - id пользователя, exp - время истечения в unix секундах
+type tokenClaims struct {
+	Subject   string `json:"sub"`
+	Role      string `json:"role,omitempty"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// signToken - выпускает токен в формате JWT с подписью HS256
+func signToken(secret []byte, p Principal, ttl time.Duration, now time.Time) (string, error) {
+	claims, err := json.Marshal(tokenClaims{
+		Subject:   strconv.Itoa(p.UserId),
+		Role:      p.Role,
+		ExpiresAt: now.Add(ttl).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	payload := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(claims)
+	return payload + "." + sign(secret, payload), nil
+}
+
+func sign(secret []byte, payload string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyToken - проверяет подпись и срок действия токена. Принимается только HS256,
+// чтобы нельзя было подсунуть токен с "alg": "none".
+func verifyToken(secret []byte, token string, now time.Time) (Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Principal{}, errors.New("malformed token")
+	}
+
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return Principal{}, errors.New("malformed token header")
+	}
+	alg := struct {
+		Alg string `json:"alg"`
+	}{}
+	if err = json.Unmarshal(header, &alg); err != nil || alg.Alg != "HS256" {
+		return Principal{}, errors.New("unsupported token algorithm")
+	}
+
+	expected := sign(secret, parts[0]+"."+parts[1])
+	if !hmac.Equal([]byte(expected), []byte(parts[2])) {
+		return Principal{}, errors.New("invalid token signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return Principal{}, errors.New("malformed token payload")
+	}
+	claims := tokenClaims{}
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		return Principal{}, errors.New("malformed token payload")
+	}
+	if claims.ExpiresAt == 0 || now.Unix() >= claims.ExpiresAt {
+		return Principal{}, errors.New("token expired")
+	}
+
+	userId, err := strconv.Atoi(claims.Subject)
+	if err != nil || userId < 0 {
+		return Principal{}, errors.New("wrong token subject")
+	}
+
+	role := claims.Role
+	if role == "" {
+		role = roleUser
+	}
+	return Principal{UserId: userId, Role: role}, nil
+}
+
+// authenticator - проверяет bearer токены и API ключи
+type authenticator struct {
+	enabled bool
+	secret  []byte
+	keys    map[string]Principal // sha256 ключа -> пользователь
+}
+
+func newAuthenticator(cfg AuthConfig) *authenticator {
+	a := &authenticator{
+		enabled: cfg.Enabled,
+		secret:  []byte(cfg.Secret),
+		keys:    map[string]Principal{},
+	}
+	for _, key := range cfg.APIKeys {
+		role := key.Role
+		if role == "" {
+			role = roleUser
+		}
+		a.keys[hashKey(key.Key)] = Principal{UserId: key.UserId, Role: role}
+	}
+	return a
+}
+
+// hashKey - ключи храним и сравниваем по хешу, чтобы время поиска не зависело от содержимого ключа
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// authenticate - определяет пользователя по заголовкам запроса
+func (a *authenticator) authenticate(r *http.Request) (Principal, error) {
+	key := r.Header.Get(apiKeyHeader)
+	scheme, credentials, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+
+	switch {
+	case key != "":
+	case strings.EqualFold(scheme, "ApiKey"):
+		key = strings.TrimSpace(credentials)
+	case strings.EqualFold(scheme, "Bearer"):
+		if len(a.secret) == 0 {
+			return Principal{}, errors.New("bearer tokens are not accepted")
+		}
+		return verifyToken(a.secret, strings.TrimSpace(credentials), time.Now())
+	default:
+		return Principal{}, errors.New("credentials required")
+	}
+
+	hash := hashKey(key)
+	for known, p := range a.keys {
+		if subtle.ConstantTimeCompare([]byte(known), []byte(hash)) == 1 {
+			return p, nil
+		}
+	}
+	return Principal{}, errors.New("invalid api key")
+}
+
+// identify - пользователь запроса, если аутентификация включена и учетные данные верны
+func (a *authenticator) identify(r *http.Request) (Principal, bool) {
+	if !a.enabled {
+		return Principal{}, false
+	}
+	p, err := a.authenticate(r)
+	return p, err == nil
+}
+
+// Middleware - пропускает только аутентифицированные запросы и кладет пользователя в контекст
+func (a *authenticator) Middleware(next http.Handler) http.Handler {
+	if !a.enabled {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if publicPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		p, err := a.authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="calendar"`)
+			errorResponse(w, &authError{reason: err.Error()})
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey, p)))
+	})
+}
+
+// authError - ошибка аутентификации с причиной
+type authError struct {
+	reason string
+}
+
+func (e *authError) Error() string {
+	return "unauthorized: " + e.reason
+}
+
+func (e *authError) Unwrap() error {
+	return ErrUnauthorized
+}
+
+// authorize - проверяет, что пользователь запроса может работать с событиями userId:
+// свои события доступны всем, чужие - только администратору. Без аутентификации доступно все.
+func authorize(r *http.Request, userId int) error {
+	p, ok := principalFrom(r.Context())
+	if !ok || p.IsAdmin() || p.UserId == userId {
+		return nil
+	}
+	return ErrForbidden
+}
+
+// actingUser - подставляет пользователя из токена, если user_id не передан (given - false).
+// Переданный user_id, в том числе 0, остается как есть и проверяется authorize
+func actingUser(r *http.Request, userId int, given bool) int {
+	if p, ok := principalFrom(r.Context()); ok && !given {
+		return p.UserId
+	}
+	return userId
+}
+
+// printToken - выпускает токен по строке вида "user_id[:role]" и печатает его
+func printToken(cfg AuthConfig, subject string, ttl time.Duration) error {
+	if cfg.Secret == "" {
+		return errors.New("auth.secret is not configured")
+	}
+
+	id, role, _ := strings.Cut(subject, ":")
+	userId, err := strconv.Atoi(id)
+	if err != nil {
+		return err
+	}
+	if role == "" {
+		role = roleUser
+	}
+
+	token, err := signToken([]byte(cfg.Secret), Principal{UserId: userId, Role: role}, ttl, time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Println(token)
+	return nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// maxBatchOps - максимальное количество операций в одном пакете
+const maxBatchOps = 1000
+
+// статусы операций пакета
+const (
+	batchApplied = "applied"
+	batchFailed  = "failed"
+	batchSkipped = "skipped" // не применена, потому что не прошла другая операция пакета
+)
+
+// batchOperation - операция в теле запроса /batch
+type batchOperation struct {
+	Op             string          `json:"op"`
+	Event          json.RawMessage `json:"event"`
+	Id             int             `json:"id"`
+	Version        int             `json:"version"`
+	RejectOverlaps bool            `json:"reject_overlaps"`
+}
+
+// batchResult - результат операции пакета
+type batchResult struct {
+	Index  int               `json:"index"`
+	Op     string            `json:"op"`
+	Status string            `json:"status"`
+	Event  *Event            `json:"event,omitempty"`
+	Id     int               `json:"id,omitempty"`
+	Error  string            `json:"error,omitempty"`
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// parseBatch - разбирает и проверяет операции пакета. Ошибки возвращаются по каждой операции,
+// события без пояса tz получают пояс loc.
+func parseBatch(r *http.Request, loc *time.Location) ([]Operation, []batchResult, error) {
+	body := struct {
+		Operations []batchOperation `json:"operations"`
+	}{}
+	form, err := decodeBody(r, &body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if form != nil {
+		return nil, nil, invalid("Content-Type", "batch must be a JSON document")
+	}
+	if len(body.Operations) == 0 {
+		return nil, nil, invalid("operations", "operations are required")
+	}
+	if len(body.Operations) > maxBatchOps {
+		return nil, nil, invalid("operations", fmt.Sprintf("at most %d operations allowed", maxBatchOps))
+	}
+
+	ops := make([]Operation, len(body.Operations))
+	results := make([]batchResult, len(body.Operations))
+	failed := 0
+	for i, raw := range body.Operations {
+		results[i] = batchResult{Index: i, Op: raw.Op, Status: batchSkipped}
+		ops[i] = Operation{Op: raw.Op, Id: raw.Id, Version: raw.Version, RejectOverlaps: raw.RejectOverlaps}
+
+		v := &validator{}
+		switch raw.Op {
+		case opCreate, opUpdate:
+			event := &Event{TimeZone: loc.String()}
+			if len(raw.Event) == 0 {
+				v.add("event", "event is required")
+			} else if err = json.Unmarshal(raw.Event, event); err != nil {
+				v.addError("event", err)
+			} else {
+				validateEvent(event, v)
+			}
+			if raw.Op == opUpdate {
+				v.check(event.Id > 0, "id", "id is required")
+			}
+			ops[i].Event = event
+		case opDelete:
+			v.check(raw.Id > 0, "id", "id is required")
+			v.check(raw.Version >= 0, "version", "wrong version")
+		case opRestore:
+			v.check(raw.Id > 0, "id", "id is required")
+		default:
+			v.add("op", "op must be one of create, update, delete, restore")
+		}
+
+		if err = v.err(); err != nil {
+			results[i].Status = batchFailed
+			results[i].Error = err.Error()
+			results[i].Fields = err.(*ValidationError).Fields
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return nil, results, invalid("operations", fmt.Sprintf("%d of %d operations are invalid", failed, len(ops)))
+	}
+	return ops, results, nil
+}
+
+// authorizeBatch - проверяет доступ к каждой операции так же, как одиночные методы
+func (s *eventServer) authorizeBatch(r *http.Request, ops []Operation) error {
+	for i := range ops {
+		op := &ops[i]
+
+		var err error
+		switch op.Op {
+		case opCreate:
+			op.Event.UserId = actingUser(r, op.Event.UserId, op.Event.hasUserId)
+			err = authorize(r, op.Event.UserId)
+		case opUpdate:
+			op.Event.UserId = actingUser(r, op.Event.UserId, op.Event.hasUserId)
+			op.Event.Version, err = s.authorizeEvent(r, op.Event.Id, op.Event.Version)
+			if err == nil {
+				err = authorize(r, op.Event.UserId)
+			}
+		case opDelete:
+			op.Version, err = s.authorizeEvent(r, op.Id, op.Version)
+		case opRestore:
+			var deleted *Event
+			if deleted, err = s.storage.Deleted(op.Id); err == nil {
+				err = authorize(r, deleted.UserId)
+			}
+		}
+		if err != nil {
+			return &BatchError{Index: i, Err: err}
+		}
+	}
+	return nil
+}
+
+// BatchHandler - атомарно выполняет пакет операций {"operations": [{"op": "create", "event": {...}},
+// {"op": "update", "event": {...}, "reject_overlaps": true}, {"op": "delete", "id": 1, "version": 2},
+// {"op": "restore", "id": 3}]}.
+// Если хотя бы одна операция не прошла, не применяется ни одна: в ответе ошибка, index неудачной операции
+// и статусы всех операций.
+func (s *eventServer) BatchHandler(w http.ResponseWriter, r *http.Request) {
+	ops, results, err := parseBatch(r, s.location)
+	if err == nil {
+		err = s.authorizeBatch(r, ops)
+	}
+	if err == nil {
+		withActor(r, ops)
+		err = s.storage.Apply(ops)
+	}
+	if err != nil {
+		batchErrorResponse(w, err, results)
+		return
+	}
+
+	for i, op := range ops {
+		results[i].Status = batchApplied
+		if op.Op == opDelete {
+			results[i].Id = op.Id
+		} else {
+			results[i].Event = op.Event
+		}
+	}
+	jsonResponse(w, results)
+}
+
+// batchErrorResponse - ошибка пакета со статусами операций
+func batchErrorResponse(w http.ResponseWriter, err error, results []batchResult) {
+	status, code := classifyError(err)
+	data := errorBody(status, code, err)
+
+	var batchErr *BatchError
+	if errors.As(err, &batchErr) {
+		data["index"] = batchErr.Index
+		results[batchErr.Index].Status = batchFailed
+		results[batchErr.Index].Error = data["error"].(string)
+	}
+	if results != nil {
+		data["results"] = results
+	}
+
+	writeJSON(w, status, data)
+}
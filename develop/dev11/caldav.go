@@ -0,0 +1,570 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Минимальное подмножество CalDAV (RFC 4791) поверх хранилища: у каждого пользователя один календарь
+// /caldav/users/{user_id}/calendar/ с событиями-ресурсами {id}.ics. Поддерживаются PROPFIND, REPORT
+// calendar-query, GET, PUT и DELETE ресурсов с ETag, совпадающими с ETag API v2.
+
+// методы WebDAV, которых нет в net/http
+const (
+	methodPropfind = "PROPFIND"
+	methodReport   = "REPORT"
+)
+
+// пространства имен свойств
+const (
+	nsDAV    = "DAV:"
+	nsCalDAV = "urn:ietf:params:xml:ns:caldav"
+	nsCS     = "http://calendarserver.org/ns/"
+)
+
+const (
+	davCapabilities = "1, 3, calendar-access"
+	davContentType  = "application/xml; charset=utf-8"
+	davEventType    = "text/calendar; charset=utf-8; component=VEVENT"
+
+	// davOpenRange - насколько вперед ищутся повторения серии, если у time-range нет конца
+	davOpenRange = 10 * 366 * 24 * time.Hour
+)
+
+// davEndOfTime - конец интервала без конца для событий без повторений
+var davEndOfTime = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+
+// davHome - адрес пользователя, он же principal и calendar-home-set
+func davHome(userId int) string {
+	return fmt.Sprintf("/caldav/users/%d/", userId)
+}
+
+// davCalendar - адрес календаря пользователя
+func davCalendar(userId int) string {
+	return davHome(userId) + "calendar/"
+}
+
+// davHref - адрес ресурса события
+func davHref(event *Event) string {
+	if event.DAVName != "" {
+		return davCalendar(event.UserId) + event.DAVName
+	}
+	return davCalendar(event.UserId) + strconv.Itoa(event.Id) + ".ics"
+}
+
+// davName - имя элемента из запроса, по нему выбираются свойства
+type davName struct {
+	XMLName xml.Name
+}
+
+// davProp - запрошенные свойства
+type davProp struct {
+	Names []davName `xml:",any"`
+}
+
+// davPropfind - тело PROPFIND, пустое тело означает allprop
+type davPropfind struct {
+	XMLName xml.Name  `xml:"DAV: propfind"`
+	AllProp *struct{} `xml:"DAV: allprop"`
+	Prop    *davProp  `xml:"DAV: prop"`
+}
+
+// davTimeRange - интервал из фильтра, даты в UTC вида 20220510T000000Z
+type davTimeRange struct {
+	Start string `xml:"start,attr"`
+	End   string `xml:"end,attr"`
+}
+
+// davCompFilter - фильтр по компоненту, вложенные фильтры уточняют вложенные компоненты
+type davCompFilter struct {
+	Name      string          `xml:"name,attr"`
+	TimeRange *davTimeRange   `xml:"urn:ietf:params:xml:ns:caldav time-range"`
+	Comps     []davCompFilter `xml:"urn:ietf:params:xml:ns:caldav comp-filter"`
+}
+
+// davCalendarQuery - тело REPORT calendar-query. Корневой элемент не ограничен,
+// чтобы отличить неподдерживаемый отчет от некорректного тела.
+type davCalendarQuery struct {
+	XMLName xml.Name
+	AllProp *struct{}      `xml:"DAV: allprop"`
+	Prop    *davProp       `xml:"DAV: prop"`
+	Filter  *davCompFilter `xml:"urn:ietf:params:xml:ns:caldav filter>comp-filter"`
+}
+
+// davValue - значение свойства в ответе: текст или вложенные элементы
+type davValue struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr `xml:",any,attr"`
+	Text     string     `xml:",chardata"`
+	Children []davValue `xml:",any"`
+}
+
+type davPropstat struct {
+	Prop   davProps `xml:"prop"`
+	Status string   `xml:"status"`
+}
+
+type davProps struct {
+	Values []davValue `xml:",any"`
+}
+
+type davResponse struct {
+	Href      string        `xml:"href"`
+	Propstats []davPropstat `xml:"propstat"`
+}
+
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"DAV: multistatus"`
+	Responses []davResponse `xml:"response"`
+}
+
+// davResource - ресурс и все его свойства. Свойства из hidden отдаются только по имени, не в allprop.
+type davResource struct {
+	href   string
+	props  []davValue
+	hidden map[xml.Name]bool
+}
+
+func davElement(space, local string, children ...davValue) davValue {
+	return davValue{XMLName: xml.Name{Space: space, Local: local}, Children: children}
+}
+
+func davText(space, local, text string) davValue {
+	return davValue{XMLName: xml.Name{Space: space, Local: local}, Text: text}
+}
+
+func davHrefValue(space, local, href string) davValue {
+	return davElement(space, local, davText(nsDAV, "href", href))
+}
+
+// response - ответ со свойствами names: найденные со статусом 200, остальные 404. Без names - allprop.
+func (res davResource) response(names []davName) davResponse {
+	found := davPropstat{Status: "HTTP/1.1 200 OK"}
+	missing := davPropstat{Status: "HTTP/1.1 404 Not Found"}
+
+	if names == nil {
+		for _, prop := range res.props {
+			if !res.hidden[prop.XMLName] {
+				found.Prop.Values = append(found.Prop.Values, prop)
+			}
+		}
+	}
+	for _, name := range names {
+		ok := false
+		for _, prop := range res.props {
+			if prop.XMLName == name.XMLName {
+				found.Prop.Values = append(found.Prop.Values, prop)
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			missing.Prop.Values = append(missing.Prop.Values, davValue{XMLName: name.XMLName})
+		}
+	}
+
+	out := davResponse{Href: res.href}
+	for _, propstat := range []davPropstat{found, missing} {
+		if len(propstat.Prop.Values) > 0 {
+			out.Propstats = append(out.Propstats, propstat)
+		}
+	}
+	return out
+}
+
+// homeResource - адрес пользователя: по нему клиенты находят календарь
+func homeResource(userId int) davResource {
+	return davResource{href: davHome(userId), props: []davValue{
+		davElement(nsDAV, "resourcetype", davElement(nsDAV, "collection"), davElement(nsDAV, "principal")),
+		davText(nsDAV, "displayname", "user "+strconv.Itoa(userId)),
+		davHrefValue(nsDAV, "current-user-principal", davHome(userId)),
+		davHrefValue(nsDAV, "principal-URL", davHome(userId)),
+		davHrefValue(nsCalDAV, "calendar-home-set", davHome(userId)),
+	}}
+}
+
+// calendarResource - календарь пользователя, getctag меняется при любом изменении его событий
+func calendarResource(userId int, events []*Event) davResource {
+	comp := davElement(nsCalDAV, "comp")
+	comp.Attrs = []xml.Attr{{Name: xml.Name{Local: "name"}, Value: "VEVENT"}}
+
+	return davResource{href: davCalendar(userId), props: []davValue{
+		davElement(nsDAV, "resourcetype", davElement(nsDAV, "collection"), davElement(nsCalDAV, "calendar")),
+		davText(nsDAV, "displayname", "Calendar"),
+		davHrefValue(nsDAV, "current-user-principal", davHome(userId)),
+		davElement(nsCalDAV, "supported-calendar-component-set", comp),
+		davText(nsCS, "getctag", davCTag(events)),
+	}}
+}
+
+// eventResource - событие, calendar-data отдается только по имени
+func eventResource(event *Event, now time.Time) (davResource, error) {
+	data := &strings.Builder{}
+	if err := encodeICS(data, []*Event{event}, now); err != nil {
+		return davResource{}, err
+	}
+
+	calendarData := xml.Name{Space: nsCalDAV, Local: "calendar-data"}
+	return davResource{href: davHref(event), hidden: map[xml.Name]bool{calendarData: true}, props: []davValue{
+		davElement(nsDAV, "resourcetype"),
+		davText(nsDAV, "getetag", etag(event)),
+		davText(nsDAV, "getcontenttype", davEventType),
+		{XMLName: calendarData, Text: data.String()},
+	}}, nil
+}
+
+// davCTag - тег состояния календаря по id и версиям событий
+func davCTag(events []*Event) string {
+	h := fnv.New64a()
+	for _, event := range events {
+		fmt.Fprintf(h, "%d:%d;", event.Id, event.Version)
+	}
+	return fmt.Sprintf(`"%x"`, h.Sum64())
+}
+
+// davDepth - глубина PROPFIND: 0 - только сам ресурс, иначе и вложенные ресурсы
+func davDepth(r *http.Request) int {
+	if r.Header.Get("Depth") == "0" {
+		return 0
+	}
+	return 1
+}
+
+// decodeDAV - разбирает XML тело запроса, пустое тело оставляет v без изменений
+func decodeDAV(r *http.Request, v interface{}) error {
+	err := xml.NewDecoder(r.Body).Decode(v)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return invalidInput("body", err)
+	}
+	return nil
+}
+
+// propNames - запрошенные свойства, nil - все
+func propNames(prop *davProp) []davName {
+	if prop == nil {
+		return nil
+	}
+	if prop.Names == nil {
+		return []davName{}
+	}
+	return prop.Names
+}
+
+// multistatusResponse - ответ 207 со свойствами ресурсов
+func multistatusResponse(w http.ResponseWriter, responses []davResponse) {
+	w.Header().Set("DAV", davCapabilities)
+	w.Header().Set("Content-Type", davContentType)
+	w.WriteHeader(http.StatusMultiStatus)
+	_, _ = io.WriteString(w, xml.Header)
+	_ = xml.NewEncoder(w).Encode(davMultistatus{Responses: responses})
+}
+
+// davEvents - события календаря пользователя: только его собственные, приглашения в календарь не попадают
+func (s *eventServer) davEvents(userId int) []*Event {
+	return s.storage.GetAll(userId)
+}
+
+// davEvent - событие ресурса name календаря пользователя или nil. Ресурс - имя, под которым клиент
+// создал событие, или {id}.ics для событий, созданных без CalDAV.
+func (s *eventServer) davEvent(userId int, name string) *Event {
+	if event, err := s.storage.GetByDAVName(userId, name); err == nil {
+		return event
+	}
+
+	id, err := strconv.Atoi(strings.TrimSuffix(name, ".ics"))
+	if err != nil || !strings.HasSuffix(name, ".ics") {
+		return nil
+	}
+	event, err := s.storage.Get(id)
+	if err != nil || event.UserId != userId || event.DAVName != "" {
+		return nil
+	}
+	return event
+}
+
+// DAVOptionsHandler - возможности сервера для клиентов CalDAV
+func (s *eventServer) DAVOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("DAV", davCapabilities)
+	w.Header().Set("Allow", "OPTIONS, GET, PUT, DELETE, PROPFIND, REPORT")
+	w.WriteHeader(http.StatusOK)
+}
+
+// DAVHomePropfindHandler - свойства адреса пользователя, с Depth: 1 - и его календаря
+func (s *eventServer) DAVHomePropfindHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := pathUser(r)
+	if err != nil {
+		restErrorResponse(w, err)
+		return
+	}
+	body := davPropfind{}
+	if err = decodeDAV(r, &body); err != nil {
+		restErrorResponse(w, err)
+		return
+	}
+
+	names := propNames(body.Prop)
+	responses := []davResponse{homeResource(userId).response(names)}
+	if davDepth(r) > 0 {
+		responses = append(responses, calendarResource(userId, s.davEvents(userId)).response(names))
+	}
+	multistatusResponse(w, responses)
+}
+
+// DAVCalendarPropfindHandler - свойства календаря, с Depth: 1 - и всех его событий
+func (s *eventServer) DAVCalendarPropfindHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := pathUser(r)
+	if err != nil {
+		restErrorResponse(w, err)
+		return
+	}
+	body := davPropfind{}
+	if err = decodeDAV(r, &body); err != nil {
+		restErrorResponse(w, err)
+		return
+	}
+
+	names := propNames(body.Prop)
+	events := s.davEvents(userId)
+	responses := []davResponse{calendarResource(userId, events).response(names)}
+	if davDepth(r) > 0 {
+		now := time.Now()
+		for _, event := range events {
+			res, err := eventResource(event, now)
+			if err != nil {
+				restErrorResponse(w, err)
+				return
+			}
+			responses = append(responses, res.response(names))
+		}
+	}
+	multistatusResponse(w, responses)
+}
+
+// parseTimeRange - интервал фильтра, незаданные границы остаются нулевыми
+func parseTimeRange(tr *davTimeRange) (from, to time.Time, err error) {
+	v := &validator{}
+	if tr.Start != "" {
+		from, err = time.Parse(icsUTCLayout, tr.Start)
+		v.check(err == nil, "time-range", "wrong time-range start")
+	}
+	if tr.End != "" {
+		to, err = time.Parse(icsUTCLayout, tr.End)
+		v.check(err == nil, "time-range", "wrong time-range end")
+	}
+	return from, to, v.err()
+}
+
+// matchTimeRange - пересекается ли событие (для серии - хотя бы одно повторение) с интервалом фильтра
+func matchTimeRange(event *Event, from, to time.Time) bool {
+	if event.RRule == nil {
+		if to.IsZero() {
+			to = davEndOfTime
+		}
+		return event.overlaps(from, to)
+	}
+
+	if to.IsZero() {
+		base := time.Time(event.Start)
+		if from.After(base) {
+			base = from
+		}
+		to = base.Add(davOpenRange)
+	}
+	return len(event.occurrences(from, to)) > 0
+}
+
+// queryEvents - события календаря, подходящие под фильтр calendar-query
+func queryEvents(events []*Event, filter *davCompFilter) ([]*Event, error) {
+	if filter == nil {
+		return events, nil
+	}
+	if !strings.EqualFold(filter.Name, "VCALENDAR") {
+		return nil, nil
+	}
+	if len(filter.Comps) == 0 {
+		return events, nil
+	}
+
+	var matched []*Event
+	for _, comp := range filter.Comps {
+		// других компонентов, кроме VEVENT, в календаре нет
+		if !strings.EqualFold(comp.Name, "VEVENT") {
+			continue
+		}
+		if comp.TimeRange == nil {
+			return events, nil
+		}
+		from, to, err := parseTimeRange(comp.TimeRange)
+		if err != nil {
+			return nil, err
+		}
+		for _, event := range events {
+			if matchTimeRange(event, from, to) {
+				matched = append(matched, event)
+			}
+		}
+		return matched, nil
+	}
+	return nil, nil
+}
+
+// DAVReportHandler - REPORT calendar-query: события календаря, подходящие под фильтр по времени.
+// Другие отчеты не поддерживаются и отклоняются с предусловием DAV:supported-report.
+func (s *eventServer) DAVReportHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := pathUser(r)
+	if err != nil {
+		restErrorResponse(w, err)
+		return
+	}
+
+	body := davCalendarQuery{}
+	if err = decodeDAV(r, &body); err == nil && body.XMLName.Local == "" {
+		err = invalid("body", "report is required")
+	}
+	if err != nil {
+		restErrorResponse(w, err)
+		return
+	}
+	if body.XMLName != (xml.Name{Space: nsCalDAV, Local: "calendar-query"}) {
+		w.Header().Set("Content-Type", davContentType)
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = io.WriteString(w, xml.Header+`<error xmlns="DAV:"><supported-report/></error>`)
+		return
+	}
+
+	events, err := queryEvents(s.davEvents(userId), body.Filter)
+	if err != nil {
+		restErrorResponse(w, err)
+		return
+	}
+
+	names := propNames(body.Prop)
+	responses := []davResponse{}
+	now := time.Now()
+	for _, event := range events {
+		res, err := eventResource(event, now)
+		if err != nil {
+			restErrorResponse(w, err)
+			return
+		}
+		responses = append(responses, res.response(names))
+	}
+	multistatusResponse(w, responses)
+}
+
+// DAVGetHandler - событие в формате iCalendar с его ETag
+func (s *eventServer) DAVGetHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := pathUser(r)
+	if err != nil {
+		restErrorResponse(w, err)
+		return
+	}
+	event := s.davEvent(userId, pathParam(r, "name"))
+	if event == nil {
+		restErrorResponse(w, ErrNotFound)
+		return
+	}
+
+	w.Header().Set("ETag", etag(event))
+	w.Header().Set("Content-Type", davEventType)
+	w.WriteHeader(http.StatusOK)
+	_ = encodeICS(w, []*Event{event}, time.Now())
+}
+
+// parseDAVEvent - единственный VEVENT из тела PUT, событие без TZID получает пояс loc
+func parseDAVEvent(r *http.Request, userId int, loc *time.Location) (*Event, error) {
+	imported, err := decodeICS(r.Body, userId, loc)
+	if err != nil {
+		return nil, invalidInput("body", err)
+	}
+	if len(imported) != 1 {
+		return nil, invalid("body", "exactly one VEVENT is required")
+	}
+	if imported[0].Event == nil {
+		return nil, invalid("body", imported[0].Error)
+	}
+
+	event := imported[0].Event
+	v := &validator{}
+	validateEvent(event, v)
+	return event, v.err()
+}
+
+// DAVPutHandler - сохраняет VEVENT. Существующий ресурс заменяется с проверкой If-Match, новый создает
+// событие под выбранным клиентом именем с UID клиента, поэтому следующий PUT по тому же адресу изменяет его.
+func (s *eventServer) DAVPutHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := pathUser(r)
+	if err != nil {
+		restErrorResponse(w, err)
+		return
+	}
+	event, err := parseDAVEvent(r, userId, s.location)
+	if err != nil {
+		restErrorResponse(w, err)
+		return
+	}
+
+	current := s.davEvent(userId, pathParam(r, "name"))
+	if current == nil {
+		if r.Header.Get("If-Match") != "" {
+			restErrorResponse(w, fmt.Errorf("%w: resource does not exist", ErrConflict))
+			return
+		}
+		event.DAVName = pathParam(r, "name")
+		if err = s.saveEvent(r, opCreate, event); err != nil {
+			restErrorResponse(w, err)
+			return
+		}
+		w.Header().Set("Location", davHref(event))
+		w.Header().Set("ETag", etag(event))
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	if r.Header.Get("If-None-Match") == "*" {
+		restErrorResponse(w, fmt.Errorf("%w: resource already exists", ErrConflict))
+		return
+	}
+	// в iCalendar клиента нет участников и напоминаний, они остаются от текущей версии
+	event.Id, event.Attendees, event.Reminders = current.Id, current.Attendees, current.Reminders
+	if event.Version, err = ifMatch(r, current); err == nil {
+		err = s.saveEvent(r, opUpdate, event)
+	}
+	if err != nil {
+		restErrorResponse(w, err)
+		return
+	}
+	w.Header().Set("ETag", etag(event))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DAVDeleteHandler - удаляет событие с проверкой If-Match
+func (s *eventServer) DAVDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := pathUser(r)
+	if err != nil {
+		restErrorResponse(w, err)
+		return
+	}
+	current := s.davEvent(userId, pathParam(r, "name"))
+	if current == nil {
+		restErrorResponse(w, ErrNotFound)
+		return
+	}
+
+	version, err := ifMatch(r, current)
+	if err == nil {
+		_, err = s.mutate(r, Operation{Op: opDelete, Id: current.Id, Version: version})
+	}
+	if err != nil {
+		restErrorResponse(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
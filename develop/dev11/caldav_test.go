@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Запросы клиентов CalDAV лежат в testdata/caldav в виде HTTP сообщений: строка запроса, заголовки,
+// пустая строка и тело. Они воспроизводятся на сервере из контрактных тестов.
+
+// loadFixture - запрос из файла testdata/caldav/name
+func loadFixture(t *testing.T, name string) *http.Request {
+	data, err := os.ReadFile(filepath.Join("testdata", "caldav", name))
+	require.NoError(t, err)
+
+	head, body, _ := strings.Cut(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n\n")
+	lines := strings.Split(head, "\n")
+	requestLine := strings.Fields(lines[0])
+	require.Len(t, requestLine, 3, lines[0])
+
+	req := httptest.NewRequest(requestLine[0], requestLine[1], strings.NewReader(body))
+	for _, line := range lines[1:] {
+		name, value, _ := strings.Cut(line, ":")
+		req.Header.Set(name, strings.TrimSpace(value))
+	}
+	return req
+}
+
+// davResult - свойства ресурса из ответа multistatus: найденные по имени с содержимым и ненайденные
+type davResult struct {
+	found   map[string]string
+	missing []string
+}
+
+func parseMultistatus(t *testing.T, body []byte) map[string]davResult {
+	ms := struct {
+		Responses []struct {
+			Href      string `xml:"href"`
+			Propstats []struct {
+				Prop struct {
+					Values []struct {
+						XMLName xml.Name
+						Inner   string `xml:",innerxml"`
+					} `xml:",any"`
+				} `xml:"prop"`
+				Status string `xml:"status"`
+			} `xml:"propstat"`
+		} `xml:"response"`
+	}{}
+	require.NoError(t, xml.Unmarshal(body, &ms))
+
+	results := map[string]davResult{}
+	for _, response := range ms.Responses {
+		result := davResult{found: map[string]string{}}
+		for _, propstat := range response.Propstats {
+			for _, prop := range propstat.Prop.Values {
+				if strings.Contains(propstat.Status, " 200 ") {
+					result.found[prop.XMLName.Local] = prop.Inner
+				} else {
+					result.missing = append(result.missing, prop.XMLName.Local)
+				}
+			}
+		}
+		results[response.Href] = result
+	}
+	return results
+}
+
+func TestCalDAVFixtures(t *testing.T) {
+	for _, tc := range []struct {
+		fixture string
+		status  int
+		check   func(t *testing.T, s *eventServer, rec *httptest.ResponseRecorder)
+	}{
+		{fixture: "davx5-propfind-principal.http", status: http.StatusMultiStatus,
+			check: func(t *testing.T, s *eventServer, rec *httptest.ResponseRecorder) {
+				home := parseMultistatus(t, rec.Body.Bytes())["/caldav/users/1/"]
+				assert.Contains(t, home.found["current-user-principal"], "/caldav/users/1/")
+				assert.Contains(t, home.found["calendar-home-set"], "/caldav/users/1/")
+				assert.Equal(t, []string{"calendar-user-address-set"}, home.missing)
+			}},
+		{fixture: "davx5-propfind-home.http", status: http.StatusMultiStatus,
+			check: func(t *testing.T, s *eventServer, rec *httptest.ResponseRecorder) {
+				results := parseMultistatus(t, rec.Body.Bytes())
+				assert.Len(t, results, 2)
+				assert.Contains(t, results["/caldav/users/1/calendar/"].found["resourcetype"], "calendar")
+				assert.Contains(t, results["/caldav/users/1/calendar/"].found["supported-calendar-component-set"], "VEVENT")
+			}},
+		{fixture: "thunderbird-propfind-calendar.http", status: http.StatusMultiStatus,
+			check: func(t *testing.T, s *eventServer, rec *httptest.ResponseRecorder) {
+				calendar := parseMultistatus(t, rec.Body.Bytes())["/caldav/users/1/calendar/"]
+				assert.NotEmpty(t, calendar.found["getctag"])
+				assert.ElementsMatch(t, []string{"owner", "supported-report-set"}, calendar.missing)
+				assert.Equal(t, davCapabilities, rec.Header().Get("DAV"))
+			}},
+		{fixture: "thunderbird-propfind-etags.http", status: http.StatusMultiStatus,
+			check: func(t *testing.T, s *eventServer, rec *httptest.ResponseRecorder) {
+				results := parseMultistatus(t, rec.Body.Bytes())
+				// чужое событие 3 в календарь пользователя 1 не попадает
+				assert.Len(t, results, 3)
+				assert.Equal(t, "&#34;1&#34;", results["/caldav/users/1/calendar/1.ics"].found["getetag"])
+				assert.Equal(t, davEventType, results["/caldav/users/1/calendar/2.ics"].found["getcontenttype"])
+			}},
+		{fixture: "davx5-report-query.http", status: http.StatusMultiStatus,
+			check: func(t *testing.T, s *eventServer, rec *httptest.ResponseRecorder) {
+				results := parseMultistatus(t, rec.Body.Bytes())
+				if assert.Len(t, results, 1) {
+					assert.Contains(t, results["/caldav/users/1/calendar/2.ics"].found["calendar-data"], "SUMMARY:lunch")
+				}
+			}},
+		{fixture: "thunderbird-report-multiget.http", status: http.StatusForbidden},
+		{fixture: "apple-put-create.http", status: http.StatusCreated,
+			check: func(t *testing.T, s *eventServer, rec *httptest.ResponseRecorder) {
+				// ресурс остается по адресу клиента и с его UID
+				assert.Equal(t, "/caldav/users/1/calendar/7A1C6F6E-3C2B-4D51-9E0F-5B8D2C1A9F34.ics", rec.Header().Get("Location"))
+				assert.Equal(t, `"1"`, rec.Header().Get("ETag"))
+				event, err := s.storage.Get(4)
+				require.NoError(t, err)
+				assert.Equal(t, "Design review", event.Name)
+				assert.Equal(t, "Europe/Moscow", event.TimeZone)
+				assert.Equal(t, "7A1C6F6E-3C2B-4D51-9E0F-5B8D2C1A9F34", event.UID)
+			}},
+		{fixture: "thunderbird-put-update.http", status: http.StatusNoContent,
+			check: func(t *testing.T, s *eventServer, rec *httptest.ResponseRecorder) {
+				event, err := s.storage.Get(1)
+				require.NoError(t, err)
+				assert.Equal(t, "Planning meeting", event.Name)
+				assert.Equal(t, 2, event.Version)
+				assert.Equal(t, `"2"`, rec.Header().Get("ETag"))
+				// участников в iCalendar клиента нет, они сохраняются
+				assert.Len(t, event.Attendees, 1)
+			}},
+		{fixture: "thunderbird-put-stale.http", status: http.StatusPreconditionFailed},
+		{fixture: "thunderbird-delete.http", status: http.StatusNoContent,
+			check: func(t *testing.T, s *eventServer, rec *httptest.ResponseRecorder) {
+				_, err := s.storage.Get(2)
+				assert.ErrorIs(t, err, ErrNotFound)
+			}},
+	} {
+		t.Run(tc.fixture, func(t *testing.T) {
+			s := contractServer(t)
+			rec := httptest.NewRecorder()
+			s.server.Handler.ServeHTTP(rec, loadFixture(t, tc.fixture))
+
+			require.Equal(t, tc.status, rec.Code, rec.Body.String())
+			if tc.check != nil {
+				tc.check(t, s, rec)
+			}
+		})
+	}
+}
+
+// TestCalDAVCTag - getctag календаря меняется после изменения события через CalDAV
+func TestCalDAVCTag(t *testing.T) {
+	s := contractServer(t)
+	ctag := func() string {
+		rec := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(rec, loadFixture(t, "thunderbird-propfind-calendar.http"))
+		return parseMultistatus(t, rec.Body.Bytes())["/caldav/users/1/calendar/"].found["getctag"]
+	}
+
+	before := ctag()
+	rec := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(rec, loadFixture(t, "thunderbird-delete.http"))
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	assert.NotEqual(t, before, ctag())
+}
+
+// TestCalDAVPutSameHref - повторный PUT клиента по адресу созданного им ресурса изменяет событие, а не создает новое
+func TestCalDAVPutSameHref(t *testing.T) {
+	s := contractServer(t)
+	put := func(summary string) *httptest.ResponseRecorder {
+		req := loadFixture(t, "apple-put-create.http")
+		req.Header.Del("If-None-Match")
+		data, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		req.Body = io.NopCloser(strings.NewReader(strings.Replace(string(data), "SUMMARY:Design review", "SUMMARY:"+summary, 1)))
+		rec := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	require.Equal(t, http.StatusCreated, put("Design review").Code)
+	rec := put("Design review 2")
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, `"2"`, rec.Header().Get("ETag"))
+	assert.Len(t, s.storage.GetAll(1), 3)
+	event, err := s.storage.GetByDAVName(1, "7A1C6F6E-3C2B-4D51-9E0F-5B8D2C1A9F34.ics")
+	require.NoError(t, err)
+	assert.Equal(t, "Design review 2", event.Name)
+
+	get := func(name string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/caldav/users/1/calendar/"+name, nil))
+		return rec
+	}
+	rec = get("7A1C6F6E-3C2B-4D51-9E0F-5B8D2C1A9F34.ics")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `"2"`, rec.Header().Get("ETag"))
+	assert.Contains(t, rec.Body.String(), "UID:7A1C6F6E-3C2B-4D51-9E0F-5B8D2C1A9F34\r\n")
+	assert.Contains(t, rec.Body.String(), "SUMMARY:Design review 2\r\n")
+
+	// у события один ресурс, по {id}.ics его нет
+	assert.Equal(t, http.StatusNotFound, get("4.ics").Code)
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// форматы логов
+const (
+	logFormatPlain    = "plain"
+	logFormatJSON     = "json"
+	logFormatCombined = "combined" // Apache combined log format
+)
+
+// minSecretLength - минимальная длина секрета HMAC и API ключей
+const minSecretLength = 32
+
+// envPrefix - префикс переменных окружения, переопределяющих значения из файла конфигурации
+const envPrefix = "CALENDAR_"
+
+// Duration - длительность, которая в конфигурации задается строкой вида "5s" или "1m30s"
+type Duration time.Duration
+
+func (d *Duration) set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	return d.set(s)
+}
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	return d.set(value.Value)
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Config - конфигурация сервера. ShutdownTimeout - сколько ждать завершения активных запросов
+// при остановке, 0 - без ограничения
+type Config struct {
+	Addr            string          `json:"addr" yaml:"addr"`
+	ReadTimeout     Duration        `json:"read_timeout" yaml:"read_timeout"`
+	WriteTimeout    Duration        `json:"write_timeout" yaml:"write_timeout"`
+	IdleTimeout     Duration        `json:"idle_timeout" yaml:"idle_timeout"`
+	ShutdownTimeout Duration        `json:"shutdown_timeout" yaml:"shutdown_timeout"`
+	Storage         StorageConfig   `json:"storage" yaml:"storage"`
+	TimeZone        string          `json:"timezone" yaml:"timezone"`
+	LogFormat       string          `json:"log_format" yaml:"log_format"`
+	Auth            AuthConfig      `json:"auth" yaml:"auth"`
+	Reminders       RemindersConfig `json:"reminders" yaml:"reminders"`
+	Stream          StreamConfig    `json:"stream" yaml:"stream"`
+	Limits          LimitsConfig    `json:"limits" yaml:"limits"`
+	TLS             TLSConfig       `json:"tls" yaml:"tls"`
+	CORS            CORSConfig      `json:"cors" yaml:"cors"`
+}
+
+// DefaultConfig - конфигурация, которая используется для незаданных параметров
+func DefaultConfig() Config {
+	return Config{
+		Addr:            "localhost:8080",
+		ReadTimeout:     Duration(10 * time.Second),
+		WriteTimeout:    Duration(30 * time.Second),
+		IdleTimeout:     Duration(time.Minute),
+		ShutdownTimeout: Duration(15 * time.Second),
+		Storage: StorageConfig{
+			Type:         storageMemory,
+			Path:         "calendar-data",
+			CompactEvery: 1000,
+			Retention:    Duration(defaultRetention),
+		},
+		TimeZone:  "Europe/Moscow",
+		LogFormat: logFormatPlain,
+		Reminders: RemindersConfig{
+			Enabled:  true,
+			Notifier: notifierLog,
+			MaxDelay: Duration(time.Hour),
+			Webhook: WebhookConfig{
+				Timeout: Duration(5 * time.Second),
+				Retries: 5,
+				Backoff: Duration(time.Second),
+			},
+		},
+		Stream: StreamConfig{
+			LogSize:   1000,
+			Heartbeat: Duration(10 * time.Second),
+		},
+		Limits: LimitsConfig{
+			MaxBodyBytes: 4 << 20,
+			RateLimit: RateLimitConfig{
+				Enabled: true,
+				Rate:    10,
+				Burst:   50,
+			},
+		},
+		CORS: CORSConfig{
+			AllowedMethods: []string{
+				http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete,
+			},
+			AllowedHeaders: []string{
+				"Authorization", "Content-Type", "If-Match", "If-None-Match", "Last-Event-ID", "X-Request-ID", "Depth",
+			},
+			ExposedHeaders: []string{"ETag", "Location", "Retry-After", "X-Request-ID"},
+			MaxAge:         Duration(10 * time.Minute),
+		},
+	}
+}
+
+// LoadConfig - читает конфигурацию из файла path (YAML или JSON, по расширению) поверх значений по умолчанию,
+// затем применяет переменные окружения CALENDAR_* и проверяет результат. Пустой path - только окружение.
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, err
+		}
+
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".json":
+			err = json.Unmarshal(data, &cfg)
+		case ".yaml", ".yml":
+			err = yaml.Unmarshal(data, &cfg)
+		default:
+			err = fmt.Errorf("unsupported config format %q", filepath.Ext(path))
+		}
+		if err != nil {
+			return cfg, fmt.Errorf("read config %s: %w", path, err)
+		}
+	}
+
+	if err := cfg.applyEnv(os.LookupEnv); err != nil {
+		return cfg, err
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// applyEnv - переопределяет параметры значениями из окружения
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	texts := map[string]*string{
+		"ADDR":         &c.Addr,
+		"STORAGE_TYPE": &c.Storage.Type,
+		"STORAGE_PATH": &c.Storage.Path,
+		"TIMEZONE":     &c.TimeZone,
+		"LOG_FORMAT":   &c.LogFormat,
+
+		"REMINDERS_NOTIFIER":    &c.Reminders.Notifier,
+		"REMINDERS_WEBHOOK_URL": &c.Reminders.Webhook.URL,
+
+		"TLS_CERT_FILE": &c.TLS.CertFile,
+		"TLS_KEY_FILE":  &c.TLS.KeyFile,
+	}
+	for name, field := range texts {
+		if value, ok := lookup(envPrefix + name); ok {
+			*field = value
+		}
+	}
+
+	durations := map[string]*Duration{
+		"READ_TIMEOUT":     &c.ReadTimeout,
+		"WRITE_TIMEOUT":    &c.WriteTimeout,
+		"IDLE_TIMEOUT":     &c.IdleTimeout,
+		"SHUTDOWN_TIMEOUT": &c.ShutdownTimeout,
+
+		"STORAGE_RETENTION":   &c.Storage.Retention,
+		"REMINDERS_MAX_DELAY": &c.Reminders.MaxDelay,
+	}
+	for name, field := range durations {
+		if value, ok := lookup(envPrefix + name); ok {
+			if err := field.set(value); err != nil {
+				return fmt.Errorf("%s%s: %w", envPrefix, name, err)
+			}
+		}
+	}
+
+	if value, ok := lookup(envPrefix + "AUTH_SECRET"); ok {
+		c.Auth.Secret = value
+	}
+	if value, ok := lookup(envPrefix + "AUTH_ENABLED"); ok {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%sAUTH_ENABLED: %w", envPrefix, err)
+		}
+		c.Auth.Enabled = enabled
+	}
+
+	if value, ok := lookup(envPrefix + "REMINDERS_ENABLED"); ok {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%sREMINDERS_ENABLED: %w", envPrefix, err)
+		}
+		c.Reminders.Enabled = enabled
+	}
+
+	if value, ok := lookup(envPrefix + "STORAGE_COMPACT_EVERY"); ok {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%sSTORAGE_COMPACT_EVERY: %w", envPrefix, err)
+		}
+		c.Storage.CompactEvery = n
+	}
+
+	if value, ok := lookup(envPrefix + "MAX_BODY_BYTES"); ok {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%sMAX_BODY_BYTES: %w", envPrefix, err)
+		}
+		c.Limits.MaxBodyBytes = n
+	}
+	if value, ok := lookup(envPrefix + "RATE_LIMIT_ENABLED"); ok {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%sRATE_LIMIT_ENABLED: %w", envPrefix, err)
+		}
+		c.Limits.RateLimit.Enabled = enabled
+	}
+
+	if value, ok := lookup(envPrefix + "CORS_ENABLED"); ok {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%sCORS_ENABLED: %w", envPrefix, err)
+		}
+		c.CORS.Enabled = enabled
+	}
+	// источники через запятую
+	if value, ok := lookup(envPrefix + "CORS_ALLOWED_ORIGINS"); ok {
+		c.CORS.AllowedOrigins = nil
+		for _, origin := range strings.Split(value, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				c.CORS.AllowedOrigins = append(c.CORS.AllowedOrigins, origin)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Validate - проверяет конфигурацию и возвращает все найденные ошибки разом
+func (c *Config) Validate() error {
+	var problems []string
+
+	if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+		problems = append(problems, fmt.Sprintf("addr: %v", err))
+	}
+
+	if c.ReadTimeout < 0 {
+		problems = append(problems, "read_timeout: must not be negative")
+	}
+	if c.WriteTimeout < 0 {
+		problems = append(problems, "write_timeout: must not be negative")
+	}
+	if c.IdleTimeout < 0 {
+		problems = append(problems, "idle_timeout: must not be negative")
+	}
+	if c.ShutdownTimeout < 0 {
+		problems = append(problems, "shutdown_timeout: must not be negative")
+	}
+
+	switch c.Storage.Type {
+	case storageMemory:
+	case storageFile:
+		if c.Storage.Path == "" {
+			problems = append(problems, "storage.path: required for file storage")
+		}
+		if c.Storage.CompactEvery < 0 {
+			problems = append(problems, "storage.compact_every: must not be negative")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("storage.type: unknown storage type %q", c.Storage.Type))
+	}
+	if c.Storage.Retention < 0 {
+		problems = append(problems, "storage.retention: must not be negative")
+	}
+
+	if _, err := time.LoadLocation(c.TimeZone); err != nil || c.TimeZone == "" {
+		problems = append(problems, fmt.Sprintf("timezone: unknown time zone %q", c.TimeZone))
+	}
+
+	switch c.LogFormat {
+	case logFormatPlain, logFormatJSON, logFormatCombined:
+	default:
+		problems = append(problems, fmt.Sprintf("log_format: unknown format %q", c.LogFormat))
+	}
+
+	if c.Auth.Enabled && c.Auth.Secret == "" && len(c.Auth.APIKeys) == 0 {
+		problems = append(problems, "auth: secret or api_keys required when auth is enabled")
+	}
+	if c.Auth.Secret != "" && len(c.Auth.Secret) < minSecretLength {
+		problems = append(problems, fmt.Sprintf("auth.secret: must be at least %d bytes", minSecretLength))
+	}
+	for i, key := range c.Auth.APIKeys {
+		if len(key.Key) < minSecretLength {
+			problems = append(problems, fmt.Sprintf("auth.api_keys[%d].key: must be at least %d bytes", i, minSecretLength))
+		}
+		if key.Role != "" && key.Role != roleUser && key.Role != roleAdmin {
+			problems = append(problems, fmt.Sprintf("auth.api_keys[%d].role: unknown role %q", i, key.Role))
+		}
+	}
+
+	problems = append(problems, c.Reminders.validate()...)
+
+	if c.Limits.MaxBodyBytes < 0 {
+		problems = append(problems, "limits.max_body_bytes: must not be negative")
+	}
+	if c.Limits.RateLimit.Enabled {
+		if c.Limits.RateLimit.Rate <= 0 {
+			problems = append(problems, "limits.rate_limit.rate: must be positive")
+		}
+		if c.Limits.RateLimit.Burst < 1 {
+			problems = append(problems, "limits.rate_limit.burst: must be at least 1")
+		}
+		for i, proxy := range c.Limits.RateLimit.TrustedProxies {
+			if _, err := parseProxy(proxy); err != nil {
+				problems = append(problems, fmt.Sprintf("limits.rate_limit.trusted_proxies[%d]: %v", i, err))
+			}
+		}
+	}
+
+	if c.Stream.LogSize < 0 {
+		problems = append(problems, "stream.log_size: must not be negative")
+	}
+	if c.Stream.Heartbeat <= 0 {
+		problems = append(problems, "stream.heartbeat: must be positive")
+	}
+	// поток закрывается до write timeout, и без хотя бы одного пустого сообщения прокси может оборвать его раньше
+	if lifetime := streamLifetime(time.Duration(c.WriteTimeout)); lifetime > 0 && time.Duration(c.Stream.Heartbeat) >= lifetime {
+		problems = append(problems, fmt.Sprintf("stream.heartbeat: must be less than %s (90%% of write_timeout)", lifetime))
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		problems = append(problems, "tls: cert_file and key_file must be set together")
+	}
+
+	problems = append(problems, c.CORS.validate()...)
+
+	if len(problems) > 0 {
+		return errors.New("invalid config: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// validate - проверяет настройки напоминаний
+func (c *RemindersConfig) validate() (problems []string) {
+	if c.MaxDelay < 0 {
+		problems = append(problems, "reminders.max_delay: must not be negative")
+	}
+
+	switch c.Notifier {
+	case notifierLog:
+	case notifierWebhook:
+		if u, err := url.Parse(c.Webhook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("reminders.webhook.url: must be an http(s) URL, got %q", c.Webhook.URL))
+		}
+		if c.Webhook.Timeout < 0 {
+			problems = append(problems, "reminders.webhook.timeout: must not be negative")
+		}
+		if c.Webhook.Retries < 0 {
+			problems = append(problems, "reminders.webhook.retries: must not be negative")
+		}
+		if c.Webhook.Backoff < 0 {
+			problems = append(problems, "reminders.webhook.backoff: must not be negative")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("reminders.notifier: unknown notifier %q", c.Notifier))
+	}
+	return problems
+}
+
+// validate - проверяет настройки CORS
+func (c *CORSConfig) validate() (problems []string) {
+	if c.MaxAge < 0 {
+		problems = append(problems, "cors.max_age: must not be negative")
+	}
+	if !c.Enabled {
+		return problems
+	}
+
+	if len(c.AllowedOrigins) == 0 {
+		problems = append(problems, "cors.allowed_origins: required when cors is enabled")
+	}
+	for i, origin := range c.AllowedOrigins {
+		if origin == "*" {
+			if c.AllowCredentials {
+				problems = append(problems, "cors.allowed_origins: \"*\" cannot be combined with allow_credentials")
+			}
+			continue
+		}
+		// источник - схема и хост без пути, как в заголовке Origin
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+			problems = append(problems, fmt.Sprintf("cors.allowed_origins[%d]: must be an http(s) origin, got %q", i, origin))
+		}
+	}
+	if len(c.AllowedMethods) == 0 {
+		problems = append(problems, "cors.allowed_methods: required when cors is enabled")
+	}
+	return problems
+}
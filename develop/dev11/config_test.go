@@ -0,0 +1,236 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		file  string
+		data  string
+		env   map[string]string
+		check func(t *testing.T, cfg Config)
+		err   string
+	}{
+		{name: "yaml поверх значений по умолчанию", file: "config.yaml",
+			data: "addr: :9090\nwrite_timeout: 1m\nstorage:\n  type: file\n  path: data\ntimezone: Asia/Tokyo\n",
+			check: func(t *testing.T, cfg Config) {
+				assert.Equal(t, ":9090", cfg.Addr)
+				assert.Equal(t, Duration(time.Minute), cfg.WriteTimeout)
+				assert.Equal(t, storageFile, cfg.Storage.Type)
+				assert.Equal(t, "Asia/Tokyo", cfg.TimeZone)
+				// не заданные в файле параметры остаются по умолчанию
+				assert.Equal(t, DefaultConfig().ReadTimeout, cfg.ReadTimeout)
+				assert.Equal(t, DefaultConfig().Stream, cfg.Stream)
+			}},
+		{name: "json", file: "config.json", data: `{"addr": ":9090", "log_format": "json"}`,
+			check: func(t *testing.T, cfg Config) {
+				assert.Equal(t, ":9090", cfg.Addr)
+				assert.Equal(t, logFormatJSON, cfg.LogFormat)
+			}},
+		{name: "окружение важнее файла", file: "config.yaml", data: "addr: :9090\nlog_format: json\n",
+			env: map[string]string{"CALENDAR_ADDR": ":7070", "CALENDAR_CORS_ALLOWED_ORIGINS": " https://a.example, ,https://b.example"},
+			check: func(t *testing.T, cfg Config) {
+				assert.Equal(t, ":7070", cfg.Addr)
+				assert.Equal(t, logFormatJSON, cfg.LogFormat)
+				assert.Equal(t, []string{"https://a.example", "https://b.example"}, cfg.CORS.AllowedOrigins)
+			}},
+		{name: "без файла только окружение", env: map[string]string{"CALENDAR_STORAGE_RETENTION": "0s"},
+			check: func(t *testing.T, cfg Config) {
+				assert.Equal(t, DefaultConfig().Addr, cfg.Addr)
+				assert.Equal(t, Duration(0), cfg.Storage.Retention)
+			}},
+		{name: "неизвестный формат", file: "config.toml", data: "addr = ':9090'", err: `unsupported config format ".toml"`},
+		{name: "некорректный yaml", file: "config.yaml", data: "read_timeout: soon\n", err: "read config"},
+		{name: "некорректное окружение", env: map[string]string{"CALENDAR_AUTH_ENABLED": "maybe"}, err: "CALENDAR_AUTH_ENABLED"},
+		{name: "проверка результата", file: "config.yaml", data: "log_format: xml\n", err: `log_format: unknown format "xml"`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := ""
+			if tc.file != "" {
+				path = filepath.Join(t.TempDir(), tc.file)
+				require.NoError(t, os.WriteFile(path, []byte(tc.data), 0o600))
+			}
+			for name, value := range tc.env {
+				t.Setenv(name, value)
+			}
+
+			cfg, err := LoadConfig(path)
+			if tc.err != "" {
+				assert.ErrorContains(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			tc.check(t, cfg)
+		})
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		env   map[string]string
+		check func(t *testing.T, cfg Config)
+		err   string
+	}{
+		{name: "строки и длительности", env: map[string]string{
+			"CALENDAR_STORAGE_TYPE": "file", "CALENDAR_TIMEZONE": "UTC",
+			"CALENDAR_WRITE_TIMEOUT": "45s", "CALENDAR_REMINDERS_MAX_DELAY": "10m",
+		}, check: func(t *testing.T, cfg Config) {
+			assert.Equal(t, storageFile, cfg.Storage.Type)
+			assert.Equal(t, "UTC", cfg.TimeZone)
+			assert.Equal(t, Duration(45*time.Second), cfg.WriteTimeout)
+			assert.Equal(t, Duration(10*time.Minute), cfg.Reminders.MaxDelay)
+		}},
+		{name: "флаги и числа", env: map[string]string{
+			"CALENDAR_AUTH_ENABLED": "true", "CALENDAR_REMINDERS_ENABLED": "false", "CALENDAR_RATE_LIMIT_ENABLED": "0",
+			"CALENDAR_STORAGE_COMPACT_EVERY": "10", "CALENDAR_MAX_BODY_BYTES": "1024",
+		}, check: func(t *testing.T, cfg Config) {
+			assert.True(t, cfg.Auth.Enabled)
+			assert.False(t, cfg.Reminders.Enabled)
+			assert.False(t, cfg.Limits.RateLimit.Enabled)
+			assert.Equal(t, 10, cfg.Storage.CompactEvery)
+			assert.Equal(t, int64(1024), cfg.Limits.MaxBodyBytes)
+		}},
+		{name: "пустое значение тоже переопределяет", env: map[string]string{"CALENDAR_ADDR": ""},
+			check: func(t *testing.T, cfg Config) {
+				assert.Equal(t, "", cfg.Addr)
+			}},
+		{name: "переменные без префикса не действуют", env: map[string]string{"ADDR": ":1"},
+			check: func(t *testing.T, cfg Config) {
+				assert.Equal(t, DefaultConfig().Addr, cfg.Addr)
+			}},
+		{name: "некорректная длительность", env: map[string]string{"CALENDAR_IDLE_TIMEOUT": "10"}, err: "CALENDAR_IDLE_TIMEOUT"},
+		{name: "некорректное число", env: map[string]string{"CALENDAR_MAX_BODY_BYTES": "4MB"}, err: "CALENDAR_MAX_BODY_BYTES"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			err := cfg.applyEnv(func(name string) (string, bool) {
+				value, ok := tc.env[name]
+				return value, ok
+			})
+			if tc.err != "" {
+				assert.ErrorContains(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			tc.check(t, cfg)
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		change   func(cfg *Config)
+		problems []string
+	}{
+		{name: "значения по умолчанию", change: func(cfg *Config) {}},
+		{name: "все ошибки разом", change: func(cfg *Config) {
+			cfg.Addr = "localhost"
+			cfg.ReadTimeout = Duration(-time.Second)
+			cfg.Storage.Type = "sql"
+			cfg.TimeZone = "Mars/Olympus"
+			cfg.LogFormat = "xml"
+		}, problems: []string{
+			"addr: address localhost: missing port in address",
+			"read_timeout: must not be negative",
+			`storage.type: unknown storage type "sql"`,
+			`timezone: unknown time zone "Mars/Olympus"`,
+			`log_format: unknown format "xml"`,
+		}},
+		{name: "файловое хранилище без пути", change: func(cfg *Config) {
+			cfg.Storage.Type = storageFile
+			cfg.Storage.Path = ""
+			cfg.Storage.CompactEvery = -1
+		}, problems: []string{
+			"storage.path: required for file storage",
+			"storage.compact_every: must not be negative",
+		}},
+		{name: "пустой пояс", change: func(cfg *Config) { cfg.TimeZone = "" },
+			problems: []string{`timezone: unknown time zone ""`}},
+		{name: "аутентификация без ключей", change: func(cfg *Config) {
+			cfg.Auth.Enabled = true
+			cfg.Auth.APIKeys = []APIKeyConfig{{Key: "short", Role: "root"}}
+		}, problems: []string{
+			"auth.api_keys[0].key: must be at least 32 bytes",
+			`auth.api_keys[0].role: unknown role "root"`,
+		}},
+		{name: "короткий секрет", change: func(cfg *Config) {
+			cfg.Auth.Enabled = true
+			cfg.Auth.Secret = "secret"
+		}, problems: []string{"auth.secret: must be at least 32 bytes"}},
+		{name: "частота запросов", change: func(cfg *Config) {
+			cfg.Limits.MaxBodyBytes = -1
+			cfg.Limits.RateLimit.Rate = 0
+			cfg.Limits.RateLimit.TrustedProxies = []string{"10.0.0.0/8", "proxy.local"}
+		}, problems: []string{
+			"limits.max_body_bytes: must not be negative",
+			"limits.rate_limit.rate: must be positive",
+			`limits.rate_limit.trusted_proxies[1]: wrong address "proxy.local"`,
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			tc.change(&cfg)
+			err := cfg.Validate()
+			if len(tc.problems) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+			// ошибки собираются все, в порядке проверки
+			assert.EqualError(t, err, "invalid config: "+strings.Join(tc.problems, "; "))
+		})
+	}
+}
+
+// TestValidateHeartbeat - поток закрывается через 90% write timeout, пустое сообщение должно успеть уйти раньше
+func TestValidateHeartbeat(t *testing.T) {
+	cfg := DefaultConfig()
+	assert.NoError(t, cfg.Validate())
+
+	cfg.Stream.Heartbeat = Duration(27 * time.Second)
+	assert.ErrorContains(t, cfg.Validate(), "stream.heartbeat: must be less than 27s")
+
+	// без write timeout поток не ограничен
+	cfg.WriteTimeout = 0
+	assert.NoError(t, cfg.Validate())
+}
+
+// TestServerTimeZone - серверы с разными поясами в конфигурации не влияют друг на друга
+func TestServerTimeZone(t *testing.T) {
+	for _, tz := range []string{"UTC", "Asia/Tokyo", "America/New_York"} {
+		tz := tz
+		t.Run(tz, func(t *testing.T) {
+			t.Parallel()
+			cfg := DefaultConfig()
+			cfg.TimeZone = tz
+			cfg.Reminders.Enabled = false
+			s, err := NewServer(cfg)
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, "/create_event", strings.NewReader("user_id=1&name=day&date=2022-05-10"))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rec := httptest.NewRecorder()
+			s.server.Handler.ServeHTTP(rec, req)
+			require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+			event, err := s.storage.Get(1)
+			require.NoError(t, err)
+			loc, err := time.LoadLocation(tz)
+			require.NoError(t, err)
+			assert.Equal(t, tz, event.TimeZone)
+			assert.True(t, time.Date(2022, 5, 10, 0, 0, 0, 0, loc).Equal(time.Time(event.Start)))
+		})
+	}
+}
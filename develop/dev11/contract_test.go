@@ -0,0 +1,511 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Контрактные тесты: каждый метод API вызывается через полный обработчик сервера, статус ответа
+// должен быть описан в openapi.json для этого метода, а тело JSON - соответствовать схеме ответа.
+
+// openAPIDoc - разобранный openapi.json с минимальной проверкой значений по схемам:
+// $ref, allOf из объектов, type, required, properties, additionalProperties, items и enum
+type openAPIDoc map[string]interface{}
+
+func loadOpenAPI(t *testing.T) openAPIDoc {
+	doc := openAPIDoc{}
+	require.NoError(t, json.Unmarshal(openAPISpec, &doc))
+	return doc
+}
+
+// lookup - узел документа по ссылке вида #/components/schemas/Event
+func (d openAPIDoc) lookup(ref string) map[string]interface{} {
+	var node interface{} = map[string]interface{}(d)
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		m, _ := node.(map[string]interface{})
+		node = m[strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")]
+	}
+	m, _ := node.(map[string]interface{})
+	return m
+}
+
+// resolve - раскрывает $ref
+func (d openAPIDoc) resolve(node map[string]interface{}) map[string]interface{} {
+	for node != nil {
+		ref, ok := node["$ref"].(string)
+		if !ok {
+			return node
+		}
+		node = d.lookup(ref)
+	}
+	return nil
+}
+
+// operation - описание метода method для шаблона пути pattern
+func (d openAPIDoc) operation(pattern, method string) map[string]interface{} {
+	paths, _ := d["paths"].(map[string]interface{})
+	item, _ := paths[pattern].(map[string]interface{})
+	op, _ := item[strings.ToLower(method)].(map[string]interface{})
+	return op
+}
+
+// mergeAll - объединяет схемы объектов из allOf в одну, чтобы свойства одной части
+// не считались неописанными в другой
+func (d openAPIDoc) mergeAll(all []interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+	var required []interface{}
+	for _, sub := range all {
+		m, _ := sub.(map[string]interface{})
+		m = d.resolve(m)
+		props, _ := m["properties"].(map[string]interface{})
+		for name, property := range props {
+			properties[name] = property
+		}
+		req, _ := m["required"].([]interface{})
+		required = append(required, req...)
+	}
+	return map[string]interface{}{"type": "object", "properties": properties, "required": required}
+}
+
+// validate - ошибки соответствия value схеме schema, path - место value в ответе
+func (d openAPIDoc) validate(value interface{}, schema map[string]interface{}, path string) (errs []string) {
+	schema = d.resolve(schema)
+	if schema == nil {
+		return []string{path + ": unresolved schema"}
+	}
+
+	if all, ok := schema["allOf"].([]interface{}); ok {
+		return d.validate(value, d.mergeAll(all), path)
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			found = found || allowed == value
+		}
+		if !found {
+			errs = append(errs, fmt.Sprintf("%s: %v is not one of %v", path, value, enum))
+		}
+	}
+
+	switch schema["type"] {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return append(errs, fmt.Sprintf("%s: expected object, got %T", path, value))
+		}
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := obj[name.(string)]; !ok {
+				errs = append(errs, fmt.Sprintf("%s: missing required %s", path, name))
+			}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		additional, _ := schema["additionalProperties"].(map[string]interface{})
+		for name, field := range obj {
+			if property, ok := properties[name].(map[string]interface{}); ok {
+				errs = append(errs, d.validate(field, property, path+"."+name)...)
+			} else if additional != nil {
+				errs = append(errs, d.validate(field, additional, path+"."+name)...)
+			} else if properties != nil {
+				errs = append(errs, fmt.Sprintf("%s: undocumented property %s", path, name))
+			}
+		}
+	case "array":
+		arr, ok := value.([]interface{})
+		if !ok {
+			return append(errs, fmt.Sprintf("%s: expected array, got %T", path, value))
+		}
+		items, _ := schema["items"].(map[string]interface{})
+		for i, item := range arr {
+			errs = append(errs, d.validate(item, items, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			errs = append(errs, fmt.Sprintf("%s: expected string, got %T", path, value))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			errs = append(errs, fmt.Sprintf("%s: expected boolean, got %T", path, value))
+		}
+	case "integer":
+		if n, ok := value.(float64); !ok || n != math.Trunc(n) {
+			errs = append(errs, fmt.Sprintf("%s: expected integer, got %v", path, value))
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			errs = append(errs, fmt.Sprintf("%s: expected number, got %T", path, value))
+		}
+	}
+	return errs
+}
+
+// checkResponse - проверяет, что ответ описан в документе и соответствует схеме
+func (d openAPIDoc) checkResponse(t *testing.T, pattern, method string, rec *httptest.ResponseRecorder) {
+	op := d.operation(pattern, method)
+	if !assert.NotNil(t, op, "%s %s is not documented", method, pattern) {
+		return
+	}
+
+	responses, _ := op["responses"].(map[string]interface{})
+	response, _ := responses[strconv.Itoa(rec.Code)].(map[string]interface{})
+	response = d.resolve(response)
+	if !assert.NotNil(t, response, "status %d of %s %s is not documented", rec.Code, method, pattern) {
+		return
+	}
+
+	content, _ := response["content"].(map[string]interface{})
+	if len(content) == 0 || rec.Body.Len() == 0 {
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+	media, ok := content[mediaType].(map[string]interface{})
+	if !assert.True(t, ok, "content type %q of %s %s is not documented", mediaType, method, pattern) || mediaType != "application/json" {
+		return
+	}
+
+	var body interface{}
+	if !assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body), rec.Body.String()) {
+		return
+	}
+	schema, _ := media["schema"].(map[string]interface{})
+	assert.Empty(t, d.validate(body, schema, "body"), rec.Body.String())
+}
+
+// contractServer - сервер с событиями 1 и 2 пользователя 1 и событием 3 пользователя 2.
+// Пользователь 2 приглашен в событие 1.
+func contractServer(t *testing.T) *eventServer {
+	cfg := DefaultConfig()
+	cfg.Reminders.Enabled = false
+	cfg.Limits.RateLimit.Enabled = false
+	s, err := NewServer(cfg)
+	require.NoError(t, err)
+
+	at := func(day, hour int) jsonTime {
+		return jsonTime(time.Date(2022, 5, day, hour, 0, 0, 0, s.location))
+	}
+	for _, event := range []*Event{
+		{UserId: 1, Name: "meeting", Start: at(10, 10), End: at(10, 11), Attendees: []Attendee{{UserId: 2}}},
+		{UserId: 1, Name: "lunch", Start: at(11, 12), End: at(11, 13)},
+		{UserId: 2, Name: "other user", Start: at(10, 10), End: at(10, 11)},
+	} {
+		require.NoError(t, s.storage.Create(event, nil))
+	}
+	return s
+}
+
+// failingJournal - хранилище не может записать изменение, сервер должен ответить 500
+func failingJournal(s *eventServer) {
+	s.storage.(*EventLocalStorage).journal = func(record) error {
+		return errors.New("disk is full")
+	}
+}
+
+// deletedLunch - событие 2 удалено и может быть восстановлено
+func deletedLunch(s *eventServer) {
+	if err := s.storage.Delete(2, 0, nil); err != nil {
+		panic(err)
+	}
+}
+
+const (
+	formType  = "application/x-www-form-urlencoded"
+	patchType = "application/merge-patch+json"
+)
+
+type contractCase struct {
+	name   string
+	method string
+	target string
+	body   string
+	header map[string]string
+	setup  func(s *eventServer)
+	status int
+}
+
+var contractCases = []contractCase{
+	{name: "create", method: http.MethodPost, target: "/create_event", status: 200,
+		body: `{"user_id": 1, "name": "call", "start": "2022-05-12T10:00:00+03:00", "reminders": ["15m"]}`},
+	{name: "create form", method: http.MethodPost, target: "/create_event", status: 200,
+		body: "user_id=1&name=call&start=2022-05-12&attendees=2,3", header: map[string]string{"Content-Type": formType}},
+	{name: "create duplicate attendees", method: http.MethodPost, target: "/create_event", status: 400,
+		body: `{"user_id": 1, "name": "call", "start": "2022-05-12", "attendees": [{"user_id": 2}, {"user_id": 2}]}`},
+	{name: "create without name", method: http.MethodPost, target: "/create_event", status: 400,
+		body: `{"user_id": 1, "start": "2022-05-12"}`},
+	{name: "create overlapping", method: http.MethodPost, target: "/create_event?reject_overlaps=true", status: 503,
+		body: `{"user_id": 1, "name": "call", "start": "2022-05-10T10:30:00+03:00", "end": "2022-05-10T11:30:00+03:00"}`},
+	{name: "create storage failure", method: http.MethodPost, target: "/create_event", status: 500, setup: failingJournal,
+		body: `{"user_id": 1, "name": "call", "start": "2022-05-12"}`},
+
+	{name: "update", method: http.MethodPost, target: "/update_event", status: 200,
+		body: `{"id": 1, "user_id": 1, "name": "renamed", "start": "2022-05-10T10:00:00+03:00", "version": 1}`},
+	{name: "update malformed", method: http.MethodPost, target: "/update_event", status: 400, body: `{"id": 1`},
+	{name: "update missing", method: http.MethodPost, target: "/update_event", status: 503,
+		body: `{"id": 42, "user_id": 1, "name": "renamed", "start": "2022-05-10"}`},
+	{name: "update stale version", method: http.MethodPost, target: "/update_event", status: 503,
+		body: `{"id": 1, "user_id": 1, "name": "renamed", "start": "2022-05-10", "version": 7}`},
+	{name: "update storage failure", method: http.MethodPost, target: "/update_event", status: 500, setup: failingJournal,
+		body: `{"id": 1, "user_id": 1, "name": "renamed", "start": "2022-05-10"}`},
+
+	{name: "delete", method: http.MethodPost, target: "/delete_event", status: 200, body: `{"id": 1}`},
+	{name: "delete wrong id", method: http.MethodPost, target: "/delete_event", status: 400,
+		body: "id=x", header: map[string]string{"Content-Type": formType}},
+	{name: "delete missing", method: http.MethodPost, target: "/delete_event", status: 503, body: `{"id": 42}`},
+	{name: "delete storage failure", method: http.MethodPost, target: "/delete_event", status: 500, setup: failingJournal, body: `{"id": 1}`},
+
+	{name: "restore", method: http.MethodPost, target: "/restore_event", status: 200, setup: deletedLunch, body: `{"id": 2}`},
+	{name: "restore wrong id", method: http.MethodPost, target: "/restore_event", status: 400, body: `{"id": "x"}`},
+	{name: "restore not deleted", method: http.MethodPost, target: "/restore_event", status: 503, body: `{"id": 1}`},
+	{name: "restore storage failure", method: http.MethodPost, target: "/restore_event", status: 500, body: `{"id": 2}`,
+		setup: func(s *eventServer) { deletedLunch(s); failingJournal(s) }},
+
+	{name: "history", method: http.MethodGet, target: "/events/1/history", status: 200},
+	{name: "history of deleted", method: http.MethodGet, target: "/events/2/history", status: 200, setup: deletedLunch},
+	{name: "history wrong id", method: http.MethodGet, target: "/events/x/history", status: 400},
+	{name: "history missing", method: http.MethodGet, target: "/events/42/history", status: 503},
+
+	{name: "day", method: http.MethodGet, target: "/events_for_day?user_id=1&date=2022-05-10", status: 200},
+	{name: "day of attendee", method: http.MethodGet, target: "/events_for_day?user_id=2&date=2022-05-10", status: 200},
+	{name: "day without date", method: http.MethodGet, target: "/events_for_day?user_id=1", status: 400},
+	{name: "week page", method: http.MethodGet, target: "/events_for_week?user_id=1&date=2022-05-09&limit=1", status: 200},
+	{name: "week wrong limit", method: http.MethodGet, target: "/events_for_week?user_id=1&date=2022-05-09&limit=0", status: 400},
+	{name: "month", method: http.MethodGet, target: "/events_for_month?user_id=1&date=2022-05-01&tz=UTC", status: 200},
+	{name: "month wrong tz", method: http.MethodGet, target: "/events_for_month?user_id=1&date=2022-05-01&tz=Mars/Base", status: 400},
+
+	{name: "batch", method: http.MethodPost, target: "/batch", status: 200, body: `{"operations": [
+		{"op": "create", "event": {"user_id": 1, "name": "call", "start": "2022-05-12"}},
+		{"op": "update", "event": {"id": 2, "user_id": 1, "name": "late lunch", "start": "2022-05-11T14:00:00+03:00"}},
+		{"op": "delete", "id": 1}]}`},
+	{name: "batch restore", method: http.MethodPost, target: "/batch", status: 200, setup: deletedLunch,
+		body: `{"operations": [{"op": "delete", "id": 1}, {"op": "restore", "id": 2}]}`},
+	{name: "batch invalid operation", method: http.MethodPost, target: "/batch", status: 400,
+		body: `{"operations": [{"op": "create", "event": {"user_id": 1}}, {"op": "rename"}]}`},
+	{name: "batch missing event", method: http.MethodPost, target: "/batch", status: 503,
+		body: `{"operations": [{"op": "delete", "id": 1}, {"op": "delete", "id": 42}]}`},
+	{name: "batch storage failure", method: http.MethodPost, target: "/batch", status: 500, setup: failingJournal,
+		body: `{"operations": [{"op": "delete", "id": 1}]}`},
+
+	{name: "search", method: http.MethodGet, target: "/search?user_id=1&q=Meeting", status: 200},
+	{name: "search without words", method: http.MethodGet, target: "/search?user_id=1&q=%20", status: 400},
+
+	{name: "freebusy", method: http.MethodGet, target: "/freebusy?user_ids=1,2,3&from=2022-05-10&to=2022-05-12&duration=1h", status: 200},
+	{name: "freebusy without range", method: http.MethodGet, target: "/freebusy?user_ids=1,2", status: 400},
+
+	{name: "stream", method: http.MethodGet, target: "/events/stream?user_id=1&last_event_id=0-0", status: 200,
+		setup: func(s *eventServer) { close(s.quit) }},
+	{name: "stream without user", method: http.MethodGet, target: "/events/stream", status: 400},
+	{name: "stream unsupported", method: http.MethodGet, target: "/events/stream?user_id=1", status: 500,
+		setup: func(s *eventServer) { s.feed = nil }},
+
+	{name: "export", method: http.MethodGet, target: "/export.ics?user_id=1", status: 200},
+	{name: "export without user", method: http.MethodGet, target: "/export.ics?user_id=-1", status: 400},
+	{name: "import", method: http.MethodPost, target: "/import?user_id=1", status: 200, header: map[string]string{"Content-Type": "text/calendar"},
+		body: "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:a@example.com\r\nSUMMARY:imported\r\nDTSTART:20220512T100000Z\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"},
+	{name: "import not a calendar", method: http.MethodPost, target: "/import?user_id=1", status: 400, body: "hello"},
+
+	{name: "healthz", method: http.MethodGet, target: "/healthz", status: 200},
+	{name: "readyz", method: http.MethodGet, target: "/readyz", status: 200},
+	{name: "readyz stopping", method: http.MethodGet, target: "/readyz", status: 503, setup: func(s *eventServer) { s.stopping = 1 }},
+	{name: "metrics", method: http.MethodGet, target: "/metrics", status: 200},
+	{name: "openapi", method: http.MethodGet, target: "/openapi.json", status: 200},
+
+	{name: "v2 list", method: http.MethodGet, target: "/v2/users/1/events?from=2022-05-10&to=2022-05-11", status: 200},
+	{name: "v2 list search", method: http.MethodGet, target: "/v2/users/1/events?q=lunch&limit=10", status: 200},
+	{name: "v2 list wrong user", method: http.MethodGet, target: "/v2/users/x/events", status: 400},
+	{name: "v2 post", method: http.MethodPost, target: "/v2/users/1/events", status: 201,
+		body: `{"name": "call", "start": "2022-05-12T10:00:00+03:00", "end": "2022-05-12T11:00:00+03:00"}`},
+	{name: "v2 post other user", method: http.MethodPost, target: "/v2/users/1/events", status: 400,
+		body: `{"user_id": 2, "name": "call", "start": "2022-05-12"}`},
+	{name: "v2 post overlapping", method: http.MethodPost, target: "/v2/users/1/events?reject_overlaps=1", status: 409,
+		body: `{"name": "call", "start": "2022-05-10T09:00:00+03:00", "end": "2022-05-10T12:00:00+03:00"}`},
+	{name: "v2 post storage failure", method: http.MethodPost, target: "/v2/users/1/events", status: 500, setup: failingJournal,
+		body: `{"name": "call", "start": "2022-05-12"}`},
+	{name: "v2 get", method: http.MethodGet, target: "/v2/users/1/events/1", status: 200},
+	{name: "v2 get not modified", method: http.MethodGet, target: "/v2/users/1/events/1", status: 304,
+		header: map[string]string{"If-None-Match": `"1"`}},
+	{name: "v2 get other user", method: http.MethodGet, target: "/v2/users/1/events/3", status: 404},
+	{name: "v2 get as attendee", method: http.MethodGet, target: "/v2/users/2/events/1", status: 200},
+	{name: "v2 put", method: http.MethodPut, target: "/v2/users/1/events/1", status: 200,
+		body: `{"name": "renamed", "start": "2022-05-10T10:00:00+03:00"}`},
+	{name: "v2 put without start", method: http.MethodPut, target: "/v2/users/1/events/1", status: 400, body: `{"name": "renamed"}`},
+	{name: "v2 put stale", method: http.MethodPut, target: "/v2/users/1/events/1", status: 412, header: map[string]string{"If-Match": `"7"`},
+		body: `{"name": "renamed", "start": "2022-05-10"}`},
+	{name: "v2 put storage failure", method: http.MethodPut, target: "/v2/users/1/events/1", status: 500, setup: failingJournal,
+		body: `{"name": "renamed", "start": "2022-05-10"}`},
+	{name: "v2 patch", method: http.MethodPatch, target: "/v2/users/1/events/1", status: 200, header: map[string]string{"Content-Type": patchType},
+		body: `{"start": "2022-05-10T15:00:00+03:00"}`},
+	{name: "v2 patch not object", method: http.MethodPatch, target: "/v2/users/1/events/1", status: 400,
+		header: map[string]string{"Content-Type": patchType}, body: `[1]`},
+	{name: "v2 patch remove start", method: http.MethodPatch, target: "/v2/users/1/events/1", status: 400,
+		header: map[string]string{"Content-Type": patchType}, body: `{"start": null}`},
+	{name: "v2 patch storage failure", method: http.MethodPatch, target: "/v2/users/1/events/1", status: 500, setup: failingJournal,
+		header: map[string]string{"Content-Type": patchType}, body: `{"name": "renamed"}`},
+	{name: "v2 delete", method: http.MethodDelete, target: "/v2/users/1/events/1", status: 204},
+	{name: "v2 delete stale", method: http.MethodDelete, target: "/v2/users/1/events/1", status: 412, header: map[string]string{"If-Match": `"7"`}},
+	{name: "v2 delete missing", method: http.MethodDelete, target: "/v2/users/1/events/42", status: 404},
+	{name: "invitations", method: http.MethodGet, target: "/v2/users/2/invitations?status=needs-action", status: 200},
+	{name: "invitations wrong status", method: http.MethodGet, target: "/v2/users/2/invitations?status=maybe", status: 400},
+	{name: "respond", method: http.MethodPut, target: "/v2/users/2/invitations/1", status: 200, body: `{"status": "accepted"}`},
+	{name: "respond wrong status", method: http.MethodPut, target: "/v2/users/2/invitations/1", status: 400, body: `{"status": "maybe"}`},
+	{name: "respond not invited", method: http.MethodPut, target: "/v2/users/2/invitations/2", status: 404, body: `{"status": "declined"}`},
+	{name: "respond storage failure", method: http.MethodPut, target: "/v2/users/2/invitations/1", status: 500, setup: failingJournal,
+		body: `{"status": "tentative"}`},
+	{name: "v2 delete storage failure", method: http.MethodDelete, target: "/v2/users/1/events/1", status: 500, setup: failingJournal},
+
+	{name: "caldav home options", method: http.MethodOptions, target: "/caldav/users/1/", status: 200},
+	{name: "caldav calendar options", method: http.MethodOptions, target: "/caldav/users/1/calendar/", status: 200},
+	{name: "caldav get", method: http.MethodGet, target: "/caldav/users/1/calendar/1.ics", status: 200},
+	{name: "caldav get other user", method: http.MethodGet, target: "/caldav/users/1/calendar/3.ics", status: 404},
+	{name: "caldav get wrong user", method: http.MethodGet, target: "/caldav/users/x/calendar/1.ics", status: 400},
+	{name: "caldav put", method: http.MethodPut, target: "/caldav/users/1/calendar/new.ics", status: 201,
+		body: "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nSUMMARY:call\r\nDTSTART:20220512T100000Z\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"},
+	{name: "caldav put replace", method: http.MethodPut, target: "/caldav/users/1/calendar/1.ics", status: 204,
+		body: "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nSUMMARY:renamed\r\nDTSTART:20220510T070000Z\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"},
+	{name: "caldav put without summary", method: http.MethodPut, target: "/caldav/users/1/calendar/new.ics", status: 400,
+		body: "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nDTSTART:20220512T100000Z\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"},
+	{name: "caldav put overlapping", method: http.MethodPut, target: "/caldav/users/1/calendar/new.ics?reject_overlaps=true", status: 409,
+		body: "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nSUMMARY:call\r\nDTSTART:20220510T073000Z\r\nDTEND:20220510T083000Z\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"},
+	{name: "caldav put existing", method: http.MethodPut, target: "/caldav/users/1/calendar/1.ics", status: 412, header: map[string]string{"If-None-Match": "*"},
+		body: "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nSUMMARY:renamed\r\nDTSTART:20220510T070000Z\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"},
+	{name: "caldav put storage failure", method: http.MethodPut, target: "/caldav/users/1/calendar/new.ics", status: 500, setup: failingJournal,
+		body: "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nSUMMARY:call\r\nDTSTART:20220512T100000Z\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"},
+	{name: "caldav delete", method: http.MethodDelete, target: "/caldav/users/1/calendar/2.ics", status: 204},
+	{name: "caldav delete missing", method: http.MethodDelete, target: "/caldav/users/1/calendar/42.ics", status: 404},
+	{name: "caldav delete stale", method: http.MethodDelete, target: "/caldav/users/1/calendar/2.ics", status: 412, header: map[string]string{"If-Match": `"7"`}},
+}
+
+// describable - методы, которые можно описать в OpenAPI. PROPFIND и REPORT проверяются в caldav_test.go.
+func describable(method string) bool {
+	return method != methodPropfind && method != methodReport
+}
+
+func TestContract(t *testing.T) {
+	doc := loadOpenAPI(t)
+	mux := (&eventServer{}).endpoints()
+
+	// успешно вызванные маршруты: у каждого метода должен быть хотя бы один успешный вызов
+	succeeded := map[string]bool{}
+	for _, tc := range contractCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := contractServer(t)
+			if tc.setup != nil {
+				tc.setup(s)
+			}
+
+			req := httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body))
+			for name, value := range tc.header {
+				req.Header.Set(name, value)
+			}
+			rec := httptest.NewRecorder()
+			s.server.Handler.ServeHTTP(rec, req)
+
+			require.Equal(t, tc.status, rec.Code, rec.Body.String())
+			pattern := mux.pattern(req.URL.Path)
+			doc.checkResponse(t, pattern, tc.method, rec)
+			if rec.Code < 300 {
+				succeeded[tc.method+" "+pattern] = true
+			}
+		})
+	}
+
+	for _, route := range mux.routes {
+		if describable(route.method) {
+			assert.True(t, succeeded[route.method+" "+route.pattern], "no successful call of %s %s", route.method, route.pattern)
+		}
+	}
+}
+
+// TestContractCoverage - документ описывает ровно те методы, которые обслуживает сервер
+func TestContractCoverage(t *testing.T) {
+	doc := loadOpenAPI(t)
+	mux := (&eventServer{}).endpoints()
+
+	var served, documented []string
+	for _, route := range mux.routes {
+		if describable(route.method) {
+			served = append(served, route.method+" "+route.pattern)
+		}
+	}
+	paths, _ := doc["paths"].(map[string]interface{})
+	for pattern, item := range paths {
+		for method := range item.(map[string]interface{}) {
+			if method != "parameters" {
+				documented = append(documented, strings.ToUpper(method)+" "+pattern)
+			}
+		}
+	}
+
+	sort.Strings(served)
+	sort.Strings(documented)
+	assert.Equal(t, served, documented)
+}
+
+// TestPatchEnd - конец события после JSON merge patch
+func TestPatchEnd(t *testing.T) {
+	loc, err := time.LoadLocation(DefaultConfig().TimeZone)
+	require.NoError(t, err)
+	at := func(day, hour int) time.Time {
+		return time.Date(2022, 5, day, hour, 0, 0, 0, loc)
+	}
+	for _, tc := range []struct {
+		name       string
+		body       string
+		start, end time.Time
+	}{
+		{name: "сдвиг начала сохраняет длительность", body: `{"start": "2022-05-12T15:00:00+03:00"}`, start: at(12, 15), end: at(12, 16)},
+		{name: "новые начало и конец", body: `{"start": "2022-05-12T15:00:00+03:00", "end": "2022-05-12T18:00:00+03:00"}`,
+			start: at(12, 15), end: at(12, 18)},
+		{name: "null удаляет конец", body: `{"end": null}`, start: at(10, 10), end: at(10, 10)},
+		{name: "null с новым началом", body: `{"start": "2022-05-12T15:00:00+03:00", "end": null}`, start: at(12, 15), end: at(12, 15)},
+		{name: "событие на весь день получает сутки", body: `{"start": "2022-05-12"}`, start: at(12, 0), end: at(13, 0)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := contractServer(t)
+			req := httptest.NewRequest(http.MethodPatch, "/v2/users/1/events/1", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", patchType)
+			rec := httptest.NewRecorder()
+			s.server.Handler.ServeHTTP(rec, req)
+			require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+			event, err := s.storage.Get(1)
+			require.NoError(t, err)
+			assert.True(t, tc.start.Equal(time.Time(event.Start)), time.Time(event.Start))
+			assert.True(t, tc.end.Equal(time.Time(event.End)), time.Time(event.End))
+		})
+	}
+}
+
+// TestActingUser - пользователь из токена подставляется только если user_id не передан, переданный 0 остается
+func TestActingUser(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/create_event", nil)
+	r = r.WithContext(context.WithValue(r.Context(), principalKey, Principal{UserId: 5}))
+
+	for body, want := range map[string]int{
+		`{"name": "call", "start": "2022-05-12"}`:               5,
+		`{"user_id": 0, "name": "call", "start": "2022-05-12"}`: 0,
+		`{"user_id": 7, "name": "call", "start": "2022-05-12"}`: 7,
+	} {
+		event := &Event{}
+		require.NoError(t, json.Unmarshal([]byte(body), event))
+		assert.Equal(t, want, actingUser(r, event.UserId, event.hasUserId), body)
+	}
+
+	form := eventFromForm(url.Values{"user_id": {"0"}, "name": {"call"}, "start": {"2022-05-12"}}, time.UTC, &validator{})
+	assert.Equal(t, 0, actingUser(r, form.UserId, form.hasUserId))
+}
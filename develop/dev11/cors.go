@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig - доступ к API из браузера со страниц других источников. AllowedOrigins - источники
+// вида https://app.example.com или "*" для любого; "*" нельзя сочетать с AllowCredentials.
+// MaxAge - сколько браузер может кешировать ответ на предварительный запрос.
+type CORSConfig struct {
+	Enabled          bool     `json:"enabled" yaml:"enabled"`
+	AllowedOrigins   []string `json:"allowed_origins" yaml:"allowed_origins"`
+	AllowedMethods   []string `json:"allowed_methods" yaml:"allowed_methods"`
+	AllowedHeaders   []string `json:"allowed_headers" yaml:"allowed_headers"`
+	ExposedHeaders   []string `json:"exposed_headers" yaml:"exposed_headers"`
+	AllowCredentials bool     `json:"allow_credentials" yaml:"allow_credentials"`
+	MaxAge           Duration `json:"max_age" yaml:"max_age"`
+}
+
+// cors - проверка запросов из браузера по CORSConfig
+type cors struct {
+	origins     map[string]bool
+	anyOrigin   bool
+	methods     map[string]bool
+	headers     map[string]bool
+	anyHeader   bool
+	credentials bool
+
+	// готовые значения заголовков ответа
+	allowMethods  string
+	allowHeaders  string
+	exposeHeaders string
+	maxAge        string
+}
+
+func newCORS(cfg CORSConfig) *cors {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	c := &cors{
+		origins:       map[string]bool{},
+		methods:       map[string]bool{},
+		headers:       map[string]bool{},
+		credentials:   cfg.AllowCredentials,
+		allowMethods:  strings.Join(cfg.AllowedMethods, ", "),
+		allowHeaders:  strings.Join(cfg.AllowedHeaders, ", "),
+		exposeHeaders: strings.Join(cfg.ExposedHeaders, ", "),
+	}
+	for _, origin := range cfg.AllowedOrigins {
+		c.anyOrigin = c.anyOrigin || origin == "*"
+		c.origins[strings.ToLower(origin)] = true
+	}
+	for _, method := range cfg.AllowedMethods {
+		c.methods[strings.ToUpper(method)] = true
+	}
+	for _, header := range cfg.AllowedHeaders {
+		c.anyHeader = c.anyHeader || header == "*"
+		c.headers[http.CanonicalHeaderKey(header)] = true
+	}
+	if cfg.MaxAge > 0 {
+		c.maxAge = strconv.Itoa(int(time.Duration(cfg.MaxAge).Seconds()))
+	}
+	return c
+}
+
+// allowOrigin - значение Access-Control-Allow-Origin для источника или пустая строка, если он не разрешен.
+// С учетными данными браузер не принимает "*", поэтому источник возвращается как есть.
+func (c *cors) allowOrigin(origin string) string {
+	switch {
+	case c.origins[strings.ToLower(origin)]:
+		return origin
+	case c.anyOrigin && c.credentials:
+		return origin
+	case c.anyOrigin:
+		return "*"
+	}
+	return ""
+}
+
+// allowRequestHeaders - разрешены ли все заголовки из Access-Control-Request-Headers
+func (c *cors) allowRequestHeaders(requested string) bool {
+	if c.anyHeader {
+		return true
+	}
+	for _, header := range strings.Split(requested, ",") {
+		header = strings.TrimSpace(header)
+		if header != "" && !c.headers[http.CanonicalHeaderKey(header)] {
+			return false
+		}
+	}
+	return true
+}
+
+// Middleware - добавляет заголовки CORS к ответам на запросы из браузера и сам отвечает на предварительные
+// запросы OPTIONS. Запросы без Origin проходят без изменений, запросы из неразрешенных источников -
+// без заголовков CORS, и браузер не отдаст ответ странице. nil - CORS выключен.
+func (c *cors) Middleware(next http.Handler) http.Handler {
+	if c == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header := w.Header()
+		header.Add("Vary", "Origin")
+		allowed := c.allowOrigin(origin)
+
+		requestMethod := r.Header.Get("Access-Control-Request-Method")
+		if r.Method != http.MethodOptions || requestMethod == "" {
+			if allowed != "" {
+				header.Set("Access-Control-Allow-Origin", allowed)
+				if c.credentials {
+					header.Set("Access-Control-Allow-Credentials", "true")
+				}
+				if c.exposeHeaders != "" {
+					header.Set("Access-Control-Expose-Headers", c.exposeHeaders)
+				}
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// предварительный запрос до обработчиков: у него нет токена, и он не должен попадать под авторизацию
+		header.Add("Vary", "Access-Control-Request-Method")
+		header.Add("Vary", "Access-Control-Request-Headers")
+		requestHeaders := r.Header.Get("Access-Control-Request-Headers")
+		if allowed == "" || !c.methods[requestMethod] || !c.allowRequestHeaders(requestHeaders) {
+			errorResponse(w, ErrCORSRejected)
+			return
+		}
+
+		header.Set("Access-Control-Allow-Origin", allowed)
+		header.Set("Access-Control-Allow-Methods", c.allowMethods)
+		if c.anyHeader {
+			// "*" в ответе браузеры не применяют к Authorization, поэтому запрошенные заголовки повторяются
+			header.Set("Access-Control-Allow-Headers", requestHeaders)
+		} else if c.allowHeaders != "" {
+			header.Set("Access-Control-Allow-Headers", c.allowHeaders)
+		}
+		if c.credentials {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if c.maxAge != "" {
+			header.Set("Access-Control-Max-Age", c.maxAge)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
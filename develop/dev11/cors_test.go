@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func corsServer(t *testing.T) *eventServer {
+	cfg := DefaultConfig()
+	cfg.Reminders.Enabled = false
+	cfg.Limits.RateLimit.Enabled = false
+	cfg.Auth = AuthConfig{Enabled: true, Secret: strings.Repeat("s", minSecretLength)}
+	cfg.CORS.Enabled = true
+	cfg.CORS.AllowedOrigins = []string{"https://app.example.com"}
+	s, err := NewServer(cfg)
+	require.NoError(t, err)
+	return s
+}
+
+func TestCORSPreflight(t *testing.T) {
+	s := corsServer(t)
+	preflight := func(origin, method, headers string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodOptions, "/v2/users/1/events/1", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", method)
+		req.Header.Set("Access-Control-Request-Headers", headers)
+		rec := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// предварительный запрос проходит без токена
+	rec := preflight("https://app.example.com", http.MethodPut, "authorization, if-match, content-type")
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "https://app.example.com", rec.Header().Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, rec.Header().Get("Access-Control-Allow-Methods"), http.MethodPut)
+	assert.Contains(t, rec.Header().Get("Access-Control-Allow-Headers"), "If-Match")
+	assert.Equal(t, "600", rec.Header().Get("Access-Control-Max-Age"))
+	assert.Contains(t, rec.Header().Values("Vary"), "Origin")
+
+	for _, tc := range []struct{ origin, method, headers string }{
+		{"https://evil.example.com", http.MethodPut, "authorization"},
+		{"https://app.example.com", "PROPFIND", ""},
+		{"https://app.example.com", http.MethodGet, "x-custom"},
+	} {
+		rec = preflight(tc.origin, tc.method, tc.headers)
+		assert.Equal(t, http.StatusForbidden, rec.Code, tc)
+		assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"), tc)
+	}
+}
+
+func TestCORSActualRequest(t *testing.T) {
+	s := corsServer(t)
+
+	// заголовки CORS есть и в ответе с ошибкой, иначе страница не увидит 401
+	req := httptest.NewRequest(http.MethodGet, "/v2/users/1/events", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	rec := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, "https://app.example.com", rec.Header().Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, rec.Header().Get("Access-Control-Expose-Headers"), "ETag")
+
+	req = httptest.NewRequest(http.MethodGet, "/healthz", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	rec = httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+
+	// OPTIONS без Access-Control-Request-Method - обычный запрос клиента CalDAV, он проходит авторизацию
+	req = httptest.NewRequest(http.MethodOptions, "/caldav/users/1/calendar", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	rec = httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Methods"))
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// ошибки бизнес-логики, которые возвращает хранилище
+var (
+	ErrNotFound      = errors.New("event does not exist")
+	ErrAlreadyExists = errors.New("event already exists")
+	ErrConflict      = errors.New("version conflict")
+)
+
+// OverlapError - событие пересекается по времени с другим событием того же пользователя Event.
+// Считается конфликтом: errors.Is(err, ErrConflict) для нее истинно.
+type OverlapError struct {
+	Event *Event
+}
+
+func (e *OverlapError) Error() string {
+	return fmt.Sprintf("event overlaps event %d starting at %s", e.Event.Id, time.Time(e.Event.Start).Format(time.RFC3339))
+}
+
+func (e *OverlapError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// ошибки доступа
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("access to events of another user is forbidden")
+
+	// ErrCORSRejected - предварительный запрос CORS с неразрешенным источником, методом или заголовком
+	ErrCORSRejected = errors.New("cross-origin request is not allowed")
+)
+
+// ошибки ограничений на запросы
+var (
+	ErrRateLimited  = errors.New("too many requests")
+	ErrBodyTooLarge = errors.New("request body is too large")
+)
+
+// ошибки маршрутизации
+var (
+	ErrRouteNotFound    = errors.New("route does not exist")
+	ErrMethodNotAllowed = errors.New("method not allowed")
+)
+
+// ValidationError - ошибка входных данных, Field - имя параметра, к которому она относится (может быть пустым),
+// Fields - ошибки по каждому неверному полю, если их было несколько
+type ValidationError struct {
+	Field   string
+	Message string
+	Fields  map[string]string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+// invalid - ошибка входных данных для параметра field
+func invalid(field, message string) error {
+	return &ValidationError{Field: field, Message: message}
+}
+
+// invalidInput - оборачивает ошибку разбора (json, strconv, time) в ошибку входных данных.
+// Превышение размера тела остается отдельной ошибкой.
+func invalidInput(field string, err error) error {
+	var validation *ValidationError
+	if errors.As(err, &validation) || errors.Is(err, ErrBodyTooLarge) {
+		return err
+	}
+	return &ValidationError{Field: field, Message: err.Error()}
+}
+
+// коды ошибок в ответе, по ним клиент может отличить одну ошибку от другой при одинаковом статусе
+const (
+	codeInvalidInput  = "invalid_input"
+	codeNotFound      = "not_found"
+	codeAlreadyExists = "already_exists"
+	codeConflict      = "conflict"
+	codeOverlap       = "overlap"
+	codeUnauthorized  = "unauthorized"
+	codeForbidden     = "forbidden"
+	codeNoRoute       = "no_route"
+	codeMethod        = "method_not_allowed"
+	codeRateLimited   = "rate_limited"
+	codeTooLarge      = "body_too_large"
+	codeInternal      = "internal"
+)
+
+// classifyError - возвращает HTTP статус и код ошибки. Согласно заданию ошибки входных данных отдаются с 400,
+// ошибки бизнес-логики с 503, все остальные с 500. Ошибки доступа отдаются со стандартными 401 и 403.
+func classifyError(err error) (status int, code string) {
+	var validation *ValidationError
+	var overlap *OverlapError
+
+	switch {
+	case errors.Is(err, ErrBodyTooLarge):
+		return http.StatusRequestEntityTooLarge, codeTooLarge
+	case errors.Is(err, ErrRateLimited):
+		return http.StatusTooManyRequests, codeRateLimited
+	case errors.As(err, &validation):
+		return http.StatusBadRequest, codeInvalidInput
+	case errors.Is(err, ErrUnauthorized):
+		return http.StatusUnauthorized, codeUnauthorized
+	case errors.Is(err, ErrForbidden), errors.Is(err, ErrCORSRejected):
+		return http.StatusForbidden, codeForbidden
+	case errors.Is(err, ErrRouteNotFound):
+		return http.StatusNotFound, codeNoRoute
+	case errors.Is(err, ErrMethodNotAllowed):
+		return http.StatusMethodNotAllowed, codeMethod
+	case errors.Is(err, ErrNotFound):
+		return http.StatusServiceUnavailable, codeNotFound
+	case errors.Is(err, ErrAlreadyExists):
+		return http.StatusServiceUnavailable, codeAlreadyExists
+	case errors.As(err, &overlap):
+		return http.StatusServiceUnavailable, codeOverlap
+	case errors.Is(err, ErrConflict):
+		return http.StatusServiceUnavailable, codeConflict
+	default:
+		return http.StatusInternalServerError, codeInternal
+	}
+}
+
+// restStatus - статус ошибки для API v2: вместо общего 503 ошибки бизнес-логики отдаются
+// стандартными 404, 409 (в том числе пересечение с другим событием) и 412 (версия из If-Match не совпала с текущей)
+func restStatus(err error) (status int, code string) {
+	status, code = classifyError(err)
+	switch code {
+	case codeNotFound:
+		status = http.StatusNotFound
+	case codeAlreadyExists, codeOverlap:
+		status = http.StatusConflict
+	case codeConflict:
+		status = http.StatusPreconditionFailed
+	}
+	return status, code
+}
+
+// errorResponse - формирует ответ {"error": "...", "code": "..."} со статусом, соответствующим ошибке.
+// Текст внутренних ошибок не отдается клиенту, а пишется в лог.
+func errorResponse(w http.ResponseWriter, err error) {
+	status, code := classifyError(err)
+	writeError(w, status, code, err)
+}
+
+// restErrorResponse - то же что errorResponse со статусами API v2
+func restErrorResponse(w http.ResponseWriter, err error) {
+	status, code := restStatus(err)
+	writeError(w, status, code, err)
+}
+
+func writeError(w http.ResponseWriter, status int, code string, err error) {
+	writeJSON(w, status, errorBody(status, code, err))
+}
+
+// errorBody - тело ответа с ошибкой, в которое обработчик может добавить свои поля
+func errorBody(status int, code string, err error) map[string]interface{} {
+	errorsTotal.Inc(code)
+
+	message := err.Error()
+	if status == http.StatusInternalServerError {
+		log.Printf("internal error: %v", err)
+		message = "internal error"
+	}
+
+	data := map[string]interface{}{
+		"error": message,
+		"code":  code,
+	}
+
+	var validation *ValidationError
+	if errors.As(err, &validation) {
+		if validation.Field != "" {
+			data["field"] = validation.Field
+		}
+		if len(validation.Fields) > 0 {
+			data["fields"] = validation.Fields
+		}
+	}
+
+	var overlap *OverlapError
+	if errors.As(err, &overlap) {
+		data["overlaps"] = overlap.Event
+	}
+
+	return data
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	snapshotFile = "snapshot.json"
+	journalFile  = "journal.log"
+)
+
+// snapshot - сжатое состояние хранилища, seq - номер последней вошедшей в него записи журнала.
+// Вместе с событиями сохраняются удаленные события, которые еще можно восстановить, и история изменений.
+type snapshot struct {
+	Seq     int             `json:"seq"`
+	NextId  int             `json:"next_id"`
+	Events  []*Event        `json:"events"`
+	Deleted []*deletedEvent `json:"deleted,omitempty"`
+	History []AuditEntry    `json:"history,omitempty"`
+}
+
+// journalLog - открытый файл журнала, в тестах подменяется файлом с ошибками записи
+type journalLog interface {
+	io.WriteSeeker
+	Truncate(size int64) error
+	Sync() error
+	Stat() (os.FileInfo, error)
+	Close() error
+}
+
+// FileStorage - хранилище событий на диске. Каждое изменение дописывается в журнал (JSON по строке на запись),
+// после compactEvery записей состояние сжимается в снимок, а журнал очищается.
+// При старте загружается снимок и поверх него проигрывается журнал.
+type FileStorage struct {
+	*EventLocalStorage
+
+	dir          string
+	log          journalLog
+	size         int64 // размер журнала в байтах
+	seq          int   // номер последней записи
+	written      int   // количество записей в журнале после последнего снимка
+	compactEvery int
+	location     *time.Location // пояс событий без поля tz
+	failed       error          // ошибка последней записи в журнал, сбрасывается успешной записью
+	closed       bool
+}
+
+// NewFileStorage - открывает хранилище в каталоге dir. События без пояса из снимка и журнала
+// переводятся в пояс loc.
+func NewFileStorage(dir string, compactEvery int, loc *time.Location) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	f := &FileStorage{
+		EventLocalStorage: NewStorage(),
+		dir:               dir,
+		compactEvery:      compactEvery,
+		location:          loc,
+	}
+
+	if err := f.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := f.replayJournal(); err != nil {
+		return nil, err
+	}
+
+	f.journal = f.append
+	return f, nil
+}
+
+// loadSnapshot - загружает последний снимок, если он есть
+func (f *FileStorage) loadSnapshot() error {
+	data, err := os.ReadFile(filepath.Join(f.dir, snapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	snap := snapshot{}
+	if err = json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("read snapshot: %w", err)
+	}
+
+	for _, event := range snap.Events {
+		event.localize(f.location)
+		f.put(event)
+	}
+	for _, d := range snap.Deleted {
+		d.Event.localize(f.location)
+		f.deleted[d.Event.Id] = d
+	}
+	for _, entry := range snap.History {
+		f.addHistory(entry)
+	}
+	f.seq = snap.Seq
+	f.nextId = snap.NextId
+	return nil
+}
+
+// localize - переводит события записи и вложенных записей пакета без пояса в пояс loc
+func (r *record) localize(loc *time.Location) {
+	if r.Event != nil {
+		r.Event.localize(loc)
+	}
+	for i := range r.Batch {
+		r.Batch[i].localize(loc)
+	}
+}
+
+// replayJournal - применяет записи журнала поверх снимка. Недописанный или поврежденный хвост журнала
+// (например после падения во время записи) отрезается.
+func (f *FileStorage) replayJournal() error {
+	file, err := os.OpenFile(filepath.Join(f.dir, journalFile), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("journal: dropping incomplete record at offset %d", offset)
+			}
+			break
+		}
+		if err != nil {
+			file.Close()
+			return err
+		}
+
+		rec := record{}
+		if err = json.Unmarshal(line, &rec); err != nil {
+			log.Printf("journal: dropping corrupted tail at offset %d: %v", offset, err)
+			break
+		}
+
+		// записи с номером не больше чем в снимке уже в него вошли
+		if rec.Seq > f.seq {
+			rec.localize(f.location)
+			if err = f.apply(rec); err != nil {
+				log.Printf("journal: dropping tail at offset %d: %v", offset, err)
+				break
+			}
+			f.seq = rec.Seq
+			f.written++
+		}
+		offset += int64(len(line))
+	}
+
+	if err = file.Truncate(offset); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+
+	f.log = file
+	f.size = offset
+	return nil
+}
+
+// append - дописывает запись в журнал, вызывается хранилищем под блокировкой
+func (f *FileStorage) append(rec record) error {
+	if f.compactEvery > 0 && f.written >= f.compactEvery {
+		if err := f.compact(); err != nil {
+			log.Printf("journal: compaction failed: %v", err)
+		}
+	}
+
+	rec.Seq = f.seq + 1
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	_, err = f.log.Write(data)
+	if err == nil {
+		err = f.log.Sync()
+	}
+	if err != nil {
+		// запись не подтверждена: убираем ее из журнала, иначе ее seq достанется следующей записи
+		// и при проигрывании та будет отброшена как повтор
+		_ = f.log.Truncate(f.size)
+		_, _ = f.log.Seek(f.size, io.SeekStart)
+		f.failed = err
+		return err
+	}
+	f.failed = nil
+
+	f.size += int64(len(data))
+	f.seq = rec.Seq
+	f.written++
+	return nil
+}
+
+// compact - записывает текущее состояние в снимок и очищает журнал.
+// Снимок сначала пишется во временный файл и затем атомарно переименовывается.
+func (f *FileStorage) compact() error {
+	f.purge(f.now())
+
+	snap := snapshot{Seq: f.seq, NextId: f.nextId, Events: make([]*Event, 0, len(f.events))}
+	for _, event := range f.events {
+		snap.Events = append(snap.Events, event)
+	}
+	sort.Slice(snap.Events, func(i, j int) bool {
+		return snap.Events[i].Id < snap.Events[j].Id
+	})
+	for _, d := range f.deleted {
+		snap.Deleted = append(snap.Deleted, d)
+	}
+	sort.Slice(snap.Deleted, func(i, j int) bool {
+		return snap.Deleted[i].Event.Id < snap.Deleted[j].Event.Id
+	})
+	for _, entries := range f.history {
+		snap.History = append(snap.History, entries...)
+	}
+	sort.Slice(snap.History, func(i, j int) bool {
+		return snap.History[i].Seq < snap.History[j].Seq
+	})
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(f.dir, snapshotFile)
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// если упадем до очистки журнала, записи из него будут пропущены по seq
+	if err = f.log.Truncate(0); err != nil {
+		return err
+	}
+	if _, err = f.log.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	f.size = 0
+	f.written = 0
+	return nil
+}
+
+// Flush - сжимает журнал в снимок, чтобы следующий запуск не проигрывал его заново
+func (f *FileStorage) Flush() error {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.closed {
+		return os.ErrClosed
+	}
+	if f.written > 0 {
+		if err := f.compact(); err != nil {
+			return err
+		}
+	}
+	return f.log.Sync()
+}
+
+// Health - возвращает ошибку, если журнал закрыт или последняя запись в него не удалась
+func (f *FileStorage) Health() error {
+	f.RLock()
+	defer f.RUnlock()
+
+	if f.closed {
+		return os.ErrClosed
+	}
+	if f.failed != nil {
+		return fmt.Errorf("journal write failed: %w", f.failed)
+	}
+	_, err := f.log.Stat()
+	return err
+}
+
+// Stats - размер хранилища вместе с размером журнала
+func (f *FileStorage) Stats() StorageStats {
+	stats := f.EventLocalStorage.Stats()
+
+	f.RLock()
+	defer f.RUnlock()
+	stats.Persistent = true
+	stats.JournalBytes = f.size
+	stats.JournalRecords = f.written
+	return stats
+}
+
+// Close - закрывает файл журнала
+func (f *FileStorage) Close() error {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	return f.log.Close()
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// reopen - закрывает хранилище и открывает его заново из того же каталога, как после перезапуска
+func reopen(t *testing.T, f *FileStorage, compactEvery int) *FileStorage {
+	require.NoError(t, f.Close())
+	f, err := NewFileStorage(f.dir, compactEvery, time.UTC)
+	require.NoError(t, err)
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func openFileStorage(t *testing.T, compactEvery int) *FileStorage {
+	f, err := NewFileStorage(t.TempDir(), compactEvery, time.UTC)
+	require.NoError(t, err)
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+// stateOf - события для сравнения: после перезапуска время читается в поясе из конфигурации, поэтому переводится в UTC
+func stateOf(t *testing.T, events []*Event) string {
+	utc := make([]*Event, 0, len(events))
+	for _, event := range events {
+		event = event.clone()
+		event.Start = jsonTime(time.Time(event.Start).UTC())
+		event.End = jsonTime(time.Time(event.End).UTC())
+		utc = append(utc, event)
+	}
+	data, err := json.Marshal(utc)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func fileEvent(name string, hour int) *Event {
+	return &Event{UserId: 1, Name: name, Start: jsonTime(time.Date(2022, 5, 10, hour, 0, 0, 0, time.UTC))}
+}
+
+// TestFileStorageLocation - события без пояса из журнала и снимка читаются в поясе из конфигурации
+func TestFileStorageLocation(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	require.NoError(t, err)
+
+	f := openFileStorage(t, 0)
+	a, b := fileEvent("a", 10), fileEvent("b", 11)
+	require.NoError(t, f.Create(a, nil))
+	require.NoError(t, f.Flush())
+	require.NoError(t, f.Create(b, nil))
+	require.NoError(t, f.Close())
+
+	f, err = NewFileStorage(f.dir, 0, tokyo)
+	require.NoError(t, err)
+	t.Cleanup(func() { f.Close() })
+	for _, event := range []*Event{a, b} {
+		got, err := f.Get(event.Id)
+		require.NoError(t, err)
+		assert.Equal(t, tokyo, time.Time(got.Start).Location(), event.Name)
+		assert.True(t, time.Time(event.Start).Equal(time.Time(got.Start)), event.Name)
+	}
+}
+
+func TestFileStorageReplay(t *testing.T) {
+	f := openFileStorage(t, 0)
+	a, b := fileEvent("a", 10), fileEvent("b", 11)
+	require.NoError(t, f.Create(a, nil))
+	require.NoError(t, f.Create(b, nil))
+	updated := a.clone()
+	updated.Name = "a2"
+	require.NoError(t, f.Update(updated, nil))
+	require.NoError(t, f.Delete(b.Id, 0, nil))
+
+	f = reopen(t, f, 0)
+	event, err := f.Get(a.Id)
+	require.NoError(t, err)
+	assert.Equal(t, "a2", event.Name)
+	assert.Equal(t, 2, event.Version)
+	_, err = f.Get(b.Id)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Equal(t, 4, f.Stats().JournalRecords)
+
+	// id не переиспользуются, даже если последнее событие удалено
+	c := fileEvent("c", 12)
+	require.NoError(t, f.Create(c, nil))
+	assert.Equal(t, 3, c.Id)
+}
+
+func TestFileStorageTornTail(t *testing.T) {
+	f := openFileStorage(t, 0)
+	require.NoError(t, f.Create(fileEvent("a", 10), nil))
+	require.NoError(t, f.Create(fileEvent("b", 11), nil))
+	require.NoError(t, f.Close())
+
+	// обрываем последнюю запись посередине, как при падении во время записи
+	path := filepath.Join(f.dir, journalFile)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, data[:len(data)-10], 0o644))
+
+	f, err = NewFileStorage(f.dir, 0, time.UTC)
+	require.NoError(t, err)
+	assert.Len(t, f.GetAll(1), 1)
+
+	// хвост отрезан, новые записи дописываются после последней целой
+	c := fileEvent("c", 12)
+	require.NoError(t, f.Create(c, nil))
+	assert.Equal(t, 2, c.Id)
+
+	f = reopen(t, f, 0)
+	assert.Len(t, f.GetAll(1), 2)
+	_, err = f.Get(c.Id)
+	assert.NoError(t, err)
+}
+
+func TestFileStorageCompaction(t *testing.T) {
+	f := openFileStorage(t, 3)
+	var ids []int
+	for i := 0; i < 7; i++ {
+		event := fileEvent("event", 8+i)
+		require.NoError(t, f.Create(event, nil))
+		ids = append(ids, event.Id)
+	}
+	require.NoError(t, f.Delete(ids[6], 0, nil))
+	assert.Less(t, f.Stats().JournalRecords, 3)
+	assert.FileExists(t, filepath.Join(f.dir, snapshotFile))
+
+	before := stateOf(t, f.GetAll(1))
+	f = reopen(t, f, 3)
+	assert.Equal(t, before, stateOf(t, f.GetAll(1)))
+	assert.Equal(t, 7, f.nextId)
+
+	// после сжатия по Flush журнал пуст, а состояние то же
+	require.NoError(t, f.Flush())
+	assert.Zero(t, f.Stats().JournalRecords)
+	f = reopen(t, f, 3)
+	assert.Equal(t, before, stateOf(t, f.GetAll(1)))
+	assert.Equal(t, 7, f.nextId)
+}
+
+func TestFileStorageBatchReplay(t *testing.T) {
+	f := openFileStorage(t, 0)
+	a := fileEvent("a", 10)
+	require.NoError(t, f.Create(a, nil))
+	size := f.Stats().JournalBytes
+
+	updated := a.clone()
+	updated.Name = "a2"
+	require.NoError(t, f.Apply([]Operation{
+		{Op: opCreate, Event: fileEvent("b", 11)},
+		{Op: opUpdate, Event: updated},
+		{Op: opCreate, Event: fileEvent("c", 12)},
+	}))
+
+	f = reopen(t, f, 0)
+	assert.Len(t, f.GetAll(1), 3)
+
+	// пакет записан одной строкой: оборванная запись не применяет ни одну из операций
+	require.NoError(t, f.Close())
+	path := filepath.Join(f.dir, journalFile)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, data[:size+(int64(len(data))-size)/2], 0o644))
+
+	f, err = NewFileStorage(f.dir, 0, time.UTC)
+	require.NoError(t, err)
+	t.Cleanup(func() { f.Close() })
+	events := f.GetAll(1)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, "a", events[0].Name)
+	}
+	assert.Equal(t, 1, f.nextId)
+}
+
+// syncFailingLog - журнал, у которого первый Sync после включения failNext завершается ошибкой
+type syncFailingLog struct {
+	*os.File
+	failNext bool
+}
+
+func (l *syncFailingLog) Sync() error {
+	if l.failNext {
+		l.failNext = false
+		return errors.New("sync failed")
+	}
+	return l.File.Sync()
+}
+
+// TestFileStorageSyncFailure - неподтвержденная запись не остается в журнале и не отнимает seq у следующей
+func TestFileStorageSyncFailure(t *testing.T) {
+	f := openFileStorage(t, 0)
+	require.NoError(t, f.Create(fileEvent("a", 10), nil))
+
+	journal := &syncFailingLog{File: f.log.(*os.File), failNext: true}
+	f.log = journal
+	assert.Error(t, f.Create(fileEvent("lost", 11), nil))
+	assert.Error(t, f.Health())
+
+	b := fileEvent("b", 12)
+	require.NoError(t, f.Create(b, nil))
+	assert.NoError(t, f.Health())
+
+	f = reopen(t, f, 0)
+	var names []string
+	for _, event := range f.GetAll(1) {
+		names = append(names, event.Name)
+	}
+	assert.Equal(t, []string{"a", "b"}, names)
+	assert.Equal(t, 2, f.seq)
+}
+
+// TestRunClosesStorageOnListenError - если порт занят, сервер все равно закрывает журнал
+func TestRunClosesStorageOnListenError(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer busy.Close()
+
+	cfg := DefaultConfig()
+	cfg.Addr = busy.Addr().String()
+	cfg.Storage = StorageConfig{Type: storageFile, Path: t.TempDir()}
+	s, err := NewServer(cfg)
+	require.NoError(t, err)
+	require.NoError(t, s.storage.Create(fileEvent("a", 10), nil))
+
+	assert.ErrorContains(t, s.RunContext(context.Background()), "address already in use")
+	assert.ErrorIs(t, s.storage.(*FileStorage).Health(), os.ErrClosed)
+	assert.FileExists(t, filepath.Join(cfg.Storage.Path, snapshotFile))
+}
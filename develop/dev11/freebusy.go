@@ -0,0 +1,189 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ограничения запроса /freebusy
+const (
+	maxFreeBusyUsers = 100
+	maxFreeBusyRange = 366 * 24 * time.Hour
+)
+
+// timeSlot - полуинтервал времени [Start, End)
+type timeSlot struct {
+	Start jsonTime `json:"start"`
+	End   jsonTime `json:"end"`
+}
+
+// userBusy - занятое время пользователя
+type userBusy struct {
+	UserId int        `json:"user_id"`
+	Busy   []timeSlot `json:"busy"`
+}
+
+// freeBusy - ответ /freebusy: занятое время каждого пользователя и общие свободные промежутки
+type freeBusy struct {
+	From  jsonTime   `json:"from"`
+	To    jsonTime   `json:"to"`
+	Users []userBusy `json:"users"`
+	Free  []timeSlot `json:"free"`
+}
+
+// busyInstances - событие или его повторения, пересекающие [from, to). События нулевой длительности
+// время не занимают и не пересекаются ни с чем.
+func busyInstances(event *Event, from, to time.Time) (events []*Event) {
+	instances := []*Event{event}
+	if event.RRule != nil {
+		instances = event.occurrences(from, to)
+	} else if !event.overlaps(from, to) {
+		return nil
+	}
+
+	for _, instance := range instances {
+		if instance.duration() > 0 {
+			events = append(events, instance)
+		}
+	}
+	return events
+}
+
+// intersects - пересекаются ли события ненулевой длительности
+func intersects(a, b *Event) bool {
+	return time.Time(a.Start).Before(time.Time(b.End)) && time.Time(b.Start).Before(time.Time(a.End))
+}
+
+// busySlots - занятые событиями промежутки пользователя userId внутри [from, to), обрезанные по границам окна
+// и объединенные. events - результат GetRange, повторения в нем уже развернуты. Приглашения, которые
+// пользователь отклонил, время не занимают.
+func busySlots(userId int, events []*Event, from, to time.Time) []timeSlot {
+	slots := []timeSlot{}
+	for _, event := range events {
+		if event.duration() <= 0 {
+			continue
+		}
+		if a := event.attendee(userId); a != nil && a.Status == rsvpDeclined {
+			continue
+		}
+		start, end := time.Time(event.Start), time.Time(event.End)
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		slots = append(slots, timeSlot{Start: jsonTime(start.In(from.Location())), End: jsonTime(end.In(from.Location()))})
+	}
+	return mergeSlots(slots)
+}
+
+// mergeSlots - упорядочивает промежутки и объединяет пересекающиеся и соседние
+func mergeSlots(slots []timeSlot) []timeSlot {
+	sort.Slice(slots, func(i, j int) bool {
+		return time.Time(slots[i].Start).Before(time.Time(slots[j].Start))
+	})
+
+	merged := make([]timeSlot, 0, len(slots))
+	for _, slot := range slots {
+		if n := len(merged); n > 0 && !time.Time(slot.Start).After(time.Time(merged[n-1].End)) {
+			if time.Time(slot.End).After(time.Time(merged[n-1].End)) {
+				merged[n-1].End = slot.End
+			}
+			continue
+		}
+		merged = append(merged, slot)
+	}
+	return merged
+}
+
+// freeSlots - промежутки [from, to), не занятые ни одним из busy, длиной не меньше minDuration.
+// busy должны быть упорядочены и объединены.
+func freeSlots(busy []timeSlot, from, to time.Time, minDuration time.Duration) []timeSlot {
+	free := []timeSlot{}
+	add := func(start, end time.Time) {
+		if end.After(start) && end.Sub(start) >= minDuration {
+			free = append(free, timeSlot{Start: jsonTime(start), End: jsonTime(end)})
+		}
+	}
+
+	cursor := from
+	for _, slot := range busy {
+		add(cursor, time.Time(slot.Start))
+		if time.Time(slot.End).After(cursor) {
+			cursor = time.Time(slot.End)
+		}
+	}
+	add(cursor, to)
+	return free
+}
+
+// parseUserIds - список пользователей через запятую из параметра user_ids, без повторов
+func parseUserIds(r *http.Request) ([]int, error) {
+	value := r.URL.Query().Get("user_ids")
+	if value == "" {
+		return nil, invalid("user_ids", "user_ids is required")
+	}
+
+	var userIds []int
+	seen := map[int]bool{}
+	for _, part := range strings.Split(value, ",") {
+		userId, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || userId < 0 {
+			return nil, invalid("user_ids", "wrong user_id "+strconv.Quote(part))
+		}
+		if !seen[userId] {
+			seen[userId] = true
+			userIds = append(userIds, userId)
+		}
+	}
+
+	if len(userIds) > maxFreeBusyUsers {
+		return nil, invalid("user_ids", "at most "+strconv.Itoa(maxFreeBusyUsers)+" users allowed")
+	}
+	return userIds, nil
+}
+
+// FreeBusyHandler - занятое время пользователей user_ids в интервале from, to и общие свободные промежутки,
+// необязательный duration - минимальная длина свободного промежутка. Отдаются только границы занятого времени
+// без самих событий, поэтому запрашивать можно и чужих пользователей.
+func (s *eventServer) FreeBusyHandler(w http.ResponseWriter, r *http.Request) {
+	userIds, err := parseUserIds(r)
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+
+	from, to, err := parseRange(r, s.location)
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+
+	v := &validator{}
+	v.check(!from.IsZero(), "from", "from and to are required")
+	v.check(to.Sub(from) <= maxFreeBusyRange, "to", "interval must not exceed 366 days")
+	var minDuration time.Duration
+	if value := r.URL.Query().Get("duration"); value != "" {
+		minDuration, err = time.ParseDuration(value)
+		v.check(err == nil && minDuration >= 0, "duration", "wrong duration")
+	}
+	if err = v.err(); err != nil {
+		errorResponse(w, err)
+		return
+	}
+
+	result := freeBusy{From: jsonTime(from), To: jsonTime(to), Users: make([]userBusy, 0, len(userIds))}
+	var all []timeSlot
+	for _, userId := range userIds {
+		busy := busySlots(userId, s.storage.GetRange(userId, from, to), from, to)
+		result.Users = append(result.Users, userBusy{UserId: userId, Busy: busy})
+		all = append(all, busy...)
+	}
+	result.Free = freeSlots(mergeSlots(all), from, to, minDuration)
+
+	jsonResponse(w, result)
+}
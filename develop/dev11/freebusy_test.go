@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRejectOverlaps(t *testing.T) {
+	s := NewStorage()
+	day := time.Date(2022, 5, 10, 0, 0, 0, 0, time.UTC)
+	at := func(hour int) jsonTime { return jsonTime(day.Add(time.Duration(hour) * time.Hour)) }
+
+	daily := &Event{UserId: 1, Name: "standup", Start: at(9), End: at(10), RRule: &Recurrence{Freq: freqDaily, Interval: 1}}
+	assert.NoError(t, s.Create(daily, nil))
+	assert.NoError(t, s.Create(&Event{UserId: 2, Name: "other user", Start: at(12), End: at(13)}, nil))
+
+	create := func(event *Event) error {
+		return s.Apply([]Operation{{Op: opCreate, Event: event, RejectOverlaps: true}})
+	}
+
+	// пересечение с повторением через неделю
+	err := create(&Event{UserId: 1, Name: "review", Start: at(7*24 + 9), End: at(7*24 + 11)})
+	var overlap *OverlapError
+	if assert.ErrorAs(t, err, &overlap) {
+		assert.Equal(t, daily.Id, overlap.Event.Id)
+		assert.Equal(t, day.AddDate(0, 0, 7).Add(9*time.Hour), time.Time(overlap.Event.Start))
+	}
+	assert.ErrorIs(t, err, ErrConflict)
+
+	// граница не пересечение, события других пользователей и события нулевой длительности не мешают
+	assert.NoError(t, create(&Event{UserId: 1, Name: "lunch", Start: at(10), End: at(11)}))
+	assert.NoError(t, create(&Event{UserId: 1, Name: "call", Start: at(12), End: at(13)}))
+	assert.NoError(t, create(&Event{UserId: 1, Name: "deadline", Start: at(24 + 9)}))
+
+	// изменение события не пересекается само с собой
+	moved := &Event{Id: daily.Id, UserId: 1, Name: "standup", Start: at(8), End: at(10), RRule: daily.RRule}
+	assert.NoError(t, s.Apply([]Operation{{Op: opUpdate, Event: moved, RejectOverlaps: true}}))
+}
+
+func TestFreeSlots(t *testing.T) {
+	day := time.Date(2022, 5, 10, 0, 0, 0, 0, time.UTC)
+	slot := func(from, to int) timeSlot {
+		return timeSlot{Start: jsonTime(day.Add(time.Duration(from) * time.Hour)), End: jsonTime(day.Add(time.Duration(to) * time.Hour))}
+	}
+
+	busy := mergeSlots([]timeSlot{slot(13, 14), slot(9, 11), slot(10, 12), slot(12, 13), slot(16, 17)})
+	assert.Equal(t, []timeSlot{slot(9, 14), slot(16, 17)}, busy)
+
+	from, to := day.Add(8*time.Hour), day.Add(18*time.Hour)
+	assert.Equal(t, []timeSlot{slot(8, 9), slot(14, 16), slot(17, 18)}, freeSlots(busy, from, to, 0))
+	assert.Equal(t, []timeSlot{slot(14, 16)}, freeSlots(busy, from, to, 2*time.Hour))
+}
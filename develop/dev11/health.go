@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// HealthHandler - проверка живости: процесс запущен и обрабатывает запросы
+func (s *eventServer) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	jsonResponse(w, "ok")
+}
+
+// ReadyHandler - проверка готовности: сервер не останавливается и хранилище работоспособно
+func (s *eventServer) ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&s.stopping) == 1 {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "shutting down"})
+		return
+	}
+
+	if checker, ok := s.storage.(HealthChecker); ok {
+		if err := checker.Health(); err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "storage: " + err.Error()})
+			return
+		}
+	}
+
+	jsonResponse(w, "ready")
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// форматы дат iCalendar (RFC 5545)
+const (
+	icsDateLayout      = "20060102"
+	icsDateTimeLayout  = "20060102T150405"
+	icsUTCLayout       = "20060102T150405Z"
+	icsLineLimit       = 75 // максимальная длина строки в октетах, длинные строки переносятся
+	icsUIDSuffix       = "@dev11"
+	icsProductId       = "-//wbL2//dev11 calendar//RU"
+	icsMaxImportEvents = 10000
+	// icsZoneYears - на сколько лет вперед VTIMEZONE описывает переходы пояса: после последнего
+	// описанного перехода клиенты пользуются последним смещением
+	icsZoneYears = 10
+)
+
+// icsImported - результат разбора одного VEVENT: либо событие, либо ошибка
+type icsImported struct {
+	UID   string `json:"uid,omitempty"`
+	Event *Event `json:"event,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// icsWriter - пишет строки iCalendar с переносом длинных строк и CRLF
+type icsWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (iw *icsWriter) line(s string) {
+	if iw.err != nil {
+		return
+	}
+
+	// переносим по границе октетов, не разрывая символы UTF-8,
+	// строка продолжения начинается с пробела, который тоже входит в лимит
+	limit := icsLineLimit
+	for len(s) > limit {
+		cut := limit
+		for cut > 0 && s[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		if _, iw.err = iw.w.WriteString(s[:cut] + "\r\n "); iw.err != nil {
+			return
+		}
+		s = s[cut:]
+		limit = icsLineLimit - 1
+	}
+	_, iw.err = iw.w.WriteString(s + "\r\n")
+}
+
+// icsEscape - экранирует текстовое значение
+func icsEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+func icsUnescape(s string) string {
+	return strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n").Replace(s)
+}
+
+// inEventZone - время в поясе события. Время события без пояса уже хранится в поясе из конфигурации
+func inEventZone(t time.Time, event *Event) time.Time {
+	loc, err := loadLocation(event.TimeZone, t.Location())
+	if err != nil {
+		return t
+	}
+	return t.In(loc)
+}
+
+// icsTime - форматирует время события: дату для событий на весь день,
+// местное время с TZID если у события задан пояс, иначе время в UTC
+func icsTime(name string, t time.Time, event *Event) string {
+	switch {
+	case event.AllDay:
+		return name + ";VALUE=DATE:" + inEventZone(t, event).Format(icsDateLayout)
+	case event.TimeZone != "":
+		return name + ";TZID=" + event.TimeZone + ":" + inEventZone(t, event).Format(icsDateTimeLayout)
+	default:
+		return name + ":" + t.UTC().Format(icsUTCLayout)
+	}
+}
+
+// icsUID - UID события: заданный клиентом или назначенный сервером по id
+func icsUID(event *Event) string {
+	if event.UID != "" {
+		return event.UID
+	}
+	return strconv.Itoa(event.Id) + icsUIDSuffix
+}
+
+// icsOffset - смещение от UTC в формате iCalendar: +0300, -0430 или +053045
+func icsOffset(seconds int) string {
+	sign := "+"
+	if seconds < 0 {
+		sign, seconds = "-", -seconds
+	}
+	s := fmt.Sprintf("%s%02d%02d", sign, seconds/3600, seconds/60%60)
+	if seconds%60 != 0 {
+		s += fmt.Sprintf("%02d", seconds%60)
+	}
+	return s
+}
+
+// zoneTransitions - моменты смены смещения пояса loc в [from, to). Пояс проверяется по дням,
+// а найденный переход уточняется до секунды делением пополам
+func zoneTransitions(loc *time.Location, from, to time.Time) (res []time.Time) {
+	_, prev := from.In(loc).Zone()
+	for day := from; day.Before(to); day = day.Add(24 * time.Hour) {
+		next := day.Add(24 * time.Hour)
+		_, offset := next.In(loc).Zone()
+		if offset == prev {
+			continue
+		}
+
+		lo, hi := day.Unix(), next.Unix()
+		for hi-lo > 1 {
+			mid := lo + (hi-lo)/2
+			if _, o := time.Unix(mid, 0).In(loc).Zone(); o == prev {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+		res = append(res, time.Unix(hi, 0))
+		prev = offset
+	}
+	return res
+}
+
+// writeObservance - период пояса, начинающийся в at: DTSTART записывается по местному времени до перехода
+func (iw *icsWriter) writeObservance(loc *time.Location, at time.Time, offsetFrom int) {
+	local := at.In(loc)
+	name, offsetTo := local.Zone()
+	kind := "STANDARD"
+	if local.IsDST() {
+		kind = "DAYLIGHT"
+	}
+
+	iw.line("BEGIN:" + kind)
+	iw.line("DTSTART:" + at.In(time.FixedZone("", offsetFrom)).Format(icsDateTimeLayout))
+	iw.line("TZOFFSETFROM:" + icsOffset(offsetFrom))
+	iw.line("TZOFFSETTO:" + icsOffset(offsetTo))
+	iw.line("TZNAME:" + name)
+	iw.line("END:" + kind)
+}
+
+// writeTimeZone - VTIMEZONE пояса с переходами от начала года from до icsZoneYears лет после to
+func (iw *icsWriter) writeTimeZone(name string, from, to time.Time) {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return
+	}
+	start := time.Date(from.In(loc).Year(), 1, 1, 0, 0, 0, 0, loc)
+	end := time.Date(to.Year()+icsZoneYears, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	iw.line("BEGIN:VTIMEZONE")
+	iw.line("TZID:" + name)
+	_, offset := start.In(loc).Zone()
+	iw.writeObservance(loc, start, offset)
+	for _, at := range zoneTransitions(loc, start, end) {
+		_, before := at.Add(-time.Second).In(loc).Zone()
+		iw.writeObservance(loc, at, before)
+	}
+	iw.line("END:VTIMEZONE")
+}
+
+// encodeICS - сериализует события в VCALENDAR. Для каждого пояса, на который ссылается TZID,
+// добавляется VTIMEZONE, как требует RFC 5545
+func encodeICS(w io.Writer, events []*Event, now time.Time) error {
+	iw := &icsWriter{w: bufio.NewWriter(w)}
+
+	iw.line("BEGIN:VCALENDAR")
+	iw.line("VERSION:2.0")
+	iw.line("PRODID:" + icsProductId)
+	iw.line("CALSCALE:GREGORIAN")
+
+	// самое раннее начало событий каждого пояса, TZID пишется только у событий со временем
+	zoneFrom := map[string]time.Time{}
+	to := now
+	for _, event := range events {
+		if event.AllDay || event.TimeZone == "" {
+			continue
+		}
+		start := time.Time(event.Start)
+		if from, ok := zoneFrom[event.TimeZone]; !ok || start.Before(from) {
+			zoneFrom[event.TimeZone] = start
+		}
+		if start.After(to) {
+			to = start
+		}
+	}
+	for _, name := range sortedKeys(zoneFrom) {
+		iw.writeTimeZone(name, zoneFrom[name], to)
+	}
+
+	for _, event := range events {
+		iw.line("BEGIN:VEVENT")
+		iw.line("UID:" + icsUID(event))
+		iw.line("DTSTAMP:" + now.UTC().Format(icsUTCLayout))
+		iw.line(icsTime("DTSTART", time.Time(event.Start), event))
+		if !time.Time(event.End).IsZero() {
+			iw.line(icsTime("DTEND", time.Time(event.End), event))
+		}
+		iw.line("SUMMARY:" + icsEscape(event.Name))
+		iw.line("SEQUENCE:" + strconv.Itoa(event.Version))
+		if event.RRule != nil {
+			iw.line("RRULE:" + event.RRule.String())
+		}
+		for _, ex := range event.ExDates {
+			if ex.Date {
+				iw.line("EXDATE;VALUE=DATE:" + ex.Time.Format(icsDateLayout))
+				continue
+			}
+			iw.line(icsTime("EXDATE", ex.Time, event))
+		}
+		iw.line("END:VEVENT")
+	}
+
+	iw.line("END:VCALENDAR")
+	if iw.err != nil {
+		return iw.err
+	}
+	return iw.w.Flush()
+}
+
+// icsProperty - свойство iCalendar: NAME;PARAM=VALUE:значение
+type icsProperty struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// parseICSLine - разбирает развернутую строку свойства
+func parseICSLine(line string) (icsProperty, error) {
+	prop := icsProperty{Params: map[string]string{}}
+
+	// двоеточие внутри значения параметра в кавычках не является разделителем
+	quoted := false
+	colon := -1
+	for i, c := range line {
+		if c == '"' {
+			quoted = !quoted
+		}
+		if c == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return prop, fmt.Errorf("malformed line %q", line)
+	}
+
+	parts := strings.Split(line[:colon], ";")
+	prop.Name = strings.ToUpper(parts[0])
+	for _, param := range parts[1:] {
+		name, value, _ := strings.Cut(param, "=")
+		prop.Params[strings.ToUpper(name)] = strings.Trim(value, `"`)
+	}
+	prop.Value = line[colon+1:]
+	return prop, nil
+}
+
+// isICSDate - задано ли значение датой без времени
+func isICSDate(prop icsProperty, value string) bool {
+	return prop.Params["VALUE"] == "DATE" || len(value) == len(icsDateLayout)
+}
+
+// parseICSTime - разбирает DATE или DATE-TIME. Время с TZID разбирается в этом поясе,
+// дата и "плавающее" время без пояса - в поясе события
+func parseICSTime(prop icsProperty, value string, event *Event) (time.Time, error) {
+	loc, err := loadLocation(event.TimeZone, time.UTC)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if isICSDate(prop, value) {
+		return time.ParseInLocation(icsDateLayout, value, loc)
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse(icsUTCLayout, value)
+		return t.In(loc), err
+	}
+
+	if tzid := prop.Params["TZID"]; tzid != "" {
+		if loc, err = time.LoadLocation(tzid); err != nil {
+			return time.Time{}, err
+		}
+	}
+	return time.ParseInLocation(icsDateTimeLayout, value, loc)
+}
+
+// unfoldICS - читает строки и склеивает перенесенные (начинающиеся с пробела или табуляции)
+func unfoldICS(r io.Reader) ([]string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var lines []string
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+// decodeICS - разбирает VCALENDAR в события пользователя userId.
+// Ошибка возвращается только если документ в целом некорректен,
+// ошибки отдельных VEVENT попадают в результат для соответствующего события.
+// Событие без TZID получает пояс loc, в нем же разбираются даты и "плавающее" время.
+func decodeICS(r io.Reader, userId int, loc *time.Location) ([]icsImported, error) {
+	lines, err := unfoldICS(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 || !strings.EqualFold(lines[0], "BEGIN:VCALENDAR") {
+		return nil, errors.New("expected BEGIN:VCALENDAR")
+	}
+
+	var (
+		res     []icsImported
+		current *icsImported
+		errs    []string
+		ended   bool
+		nested  int // глубина вложенных в VEVENT компонентов (VALARM и т.п.), их свойства пропускаются
+	)
+
+	for _, line := range lines[1:] {
+		prop, err := parseICSLine(line)
+		if err != nil {
+			if current != nil {
+				errs = append(errs, err.Error())
+			}
+			continue
+		}
+
+		switch {
+		case current != nil && prop.Name == "BEGIN" && !strings.EqualFold(prop.Value, "VEVENT"):
+			nested++
+
+		case nested > 0:
+			if prop.Name == "END" {
+				nested--
+			}
+
+		case prop.Name == "BEGIN" && strings.EqualFold(prop.Value, "VEVENT"):
+			if current != nil {
+				return nil, errors.New("nested VEVENT")
+			}
+			if len(res) >= icsMaxImportEvents {
+				return nil, fmt.Errorf("too many events, limit is %d", icsMaxImportEvents)
+			}
+			current = &icsImported{Event: &Event{UserId: userId, TimeZone: loc.String()}}
+			errs = nil
+
+		case prop.Name == "END" && strings.EqualFold(prop.Value, "VEVENT"):
+			if current == nil {
+				return nil, errors.New("END:VEVENT without BEGIN")
+			}
+			if current.Event.Name == "" {
+				errs = append(errs, "SUMMARY is required")
+			}
+			if err = current.Event.normalize(); err != nil {
+				errs = append(errs, err.Error())
+			}
+			if len(errs) > 0 {
+				current.Event = nil
+				current.Error = strings.Join(errs, "; ")
+			}
+			res = append(res, *current)
+			current = nil
+
+		case prop.Name == "END" && strings.EqualFold(prop.Value, "VCALENDAR"):
+			ended = true
+
+		case current != nil:
+			if err = applyICSProperty(current, prop); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", prop.Name, err))
+			}
+		}
+	}
+
+	if current != nil || !ended {
+		return nil, errors.New("unexpected end of calendar")
+	}
+	return res, nil
+}
+
+// applyICSProperty - переносит поддерживаемое свойство VEVENT в событие, остальные игнорируются
+func applyICSProperty(imported *icsImported, prop icsProperty) error {
+	event := imported.Event
+
+	switch prop.Name {
+	case "UID":
+		imported.UID = prop.Value
+		// UID, назначенный этим сервером, выводится из id и не хранится
+		if !strings.HasSuffix(prop.Value, icsUIDSuffix) {
+			event.UID = prop.Value
+		}
+	case "SUMMARY":
+		event.Name = icsUnescape(prop.Value)
+	case "DTSTART":
+		// пояс события берется из TZID начала, остальные даты события разбираются в нем
+		if tzid := prop.Params["TZID"]; tzid != "" {
+			if _, err := time.LoadLocation(tzid); err != nil {
+				return err
+			}
+			event.TimeZone = tzid
+		}
+		t, err := parseICSTime(prop, prop.Value, event)
+		if err != nil {
+			return err
+		}
+		event.Start = jsonTime(t)
+		event.AllDay = isICSDate(prop, prop.Value)
+	case "DTEND":
+		t, err := parseICSTime(prop, prop.Value, event)
+		if err != nil {
+			return err
+		}
+		event.End = jsonTime(t)
+	case "RRULE":
+		rule, err := ParseRecurrence(prop.Value)
+		if err != nil {
+			return err
+		}
+		event.RRule = rule
+	case "EXDATE":
+		for _, value := range strings.Split(prop.Value, ",") {
+			if isICSDate(prop, value) {
+				t, err := time.Parse(icsDateLayout, value)
+				if err != nil {
+					return err
+				}
+				event.ExDates = append(event.ExDates, ExDate{Time: t, Date: true})
+				continue
+			}
+			t, err := parseICSTime(prop, value, event)
+			if err != nil {
+				return err
+			}
+			event.ExDates = append(event.ExDates, ExDate{Time: t})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// roundTrip - событие после экспорта в iCalendar и разбора обратно, и строки экспорта
+func roundTrip(t *testing.T, event *Event) (*Event, []string) {
+	buf := &bytes.Buffer{}
+	require.NoError(t, encodeICS(buf, []*Event{event}, time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC)))
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\r\n"), "\r\n")
+	for _, line := range lines {
+		assert.LessOrEqual(t, len(line), icsLineLimit, line)
+	}
+
+	imported, err := decodeICS(buf, event.UserId, time.UTC)
+	require.NoError(t, err)
+	require.Len(t, imported, 1)
+	require.NotNil(t, imported[0].Event, imported[0].Error)
+	return imported[0].Event, lines
+}
+
+func TestICSRoundTripTimeZone(t *testing.T) {
+	moscow, err := time.LoadLocation("Europe/Moscow")
+	require.NoError(t, err)
+	rule, err := ParseRecurrence("FREQ=DAILY;COUNT=10")
+	require.NoError(t, err)
+
+	event := &Event{
+		Id: 7, UserId: 1, Name: "standup", TimeZone: "Europe/Moscow", Version: 3, RRule: rule,
+		Start: jsonTime(time.Date(2022, 5, 10, 3, 0, 0, 0, moscow)),
+		End:   jsonTime(time.Date(2022, 5, 10, 3, 30, 0, 0, moscow)),
+		ExDates: []ExDate{
+			// весь день 12 мая по Москве
+			{Time: time.Date(2022, 5, 12, 0, 0, 0, 0, time.UTC), Date: true},
+			// одно повторение в 03:00 по Москве - это полночь UTC, но не весь день
+			{Time: time.Date(2022, 5, 14, 3, 0, 0, 0, moscow)},
+			// явное время в полночь по Москве - тоже не весь день
+			{Time: time.Date(2022, 5, 16, 0, 0, 0, 0, moscow)},
+		},
+	}
+
+	decoded, lines := roundTrip(t, event)
+	assert.Contains(t, lines, "UID:7@dev11")
+	assert.Contains(t, lines, "DTSTART;TZID=Europe/Moscow:20220510T030000")
+	assert.Contains(t, lines, "EXDATE;VALUE=DATE:20220512")
+	assert.Contains(t, lines, "EXDATE;TZID=Europe/Moscow:20220514T030000")
+	assert.Contains(t, lines, "EXDATE;TZID=Europe/Moscow:20220516T000000")
+
+	assert.Equal(t, "Europe/Moscow", decoded.TimeZone)
+	assert.True(t, time.Time(event.Start).Equal(time.Time(decoded.Start)))
+	assert.True(t, time.Time(event.End).Equal(time.Time(decoded.End)))
+	assert.Equal(t, rule.String(), decoded.RRule.String())
+	if assert.Len(t, decoded.ExDates, 3) {
+		for i, ex := range event.ExDates {
+			assert.Equal(t, ex.Date, decoded.ExDates[i].Date, i)
+			assert.True(t, ex.Time.Equal(decoded.ExDates[i].Time), i)
+		}
+	}
+	// исключены 12 и 14 мая, полночь 16 мая не совпадает с повторением в 03:00
+	assert.Len(t, decoded.occurrences(time.Time(decoded.Start), time.Time(decoded.Start).AddDate(0, 0, 10)), 8)
+}
+
+func TestICSRoundTripAllDay(t *testing.T) {
+	day := time.Date(2022, 5, 10, 0, 0, 0, 0, time.UTC)
+	event := &Event{Id: 1, UserId: 1, Name: "holiday", AllDay: true, Start: jsonTime(day), End: jsonTime(day.AddDate(0, 0, 1))}
+
+	decoded, lines := roundTrip(t, event)
+	assert.Contains(t, lines, "DTSTART;VALUE=DATE:20220510")
+	assert.Contains(t, lines, "DTEND;VALUE=DATE:20220511")
+	assert.True(t, decoded.AllDay)
+	assert.True(t, day.Equal(time.Time(decoded.Start)))
+}
+
+func TestICSRoundTripFolding(t *testing.T) {
+	name := strings.Repeat("Планерка, отдел; ", 10)
+	start := time.Date(2022, 5, 10, 7, 0, 0, 0, time.UTC)
+	event := &Event{Id: 1, UserId: 1, Name: name, Start: jsonTime(start), End: jsonTime(start.Add(time.Hour)), UID: "abc@example.com"}
+
+	decoded, lines := roundTrip(t, event)
+	assert.Contains(t, lines, "DTSTART:20220510T070000Z")
+	assert.Contains(t, lines, "UID:abc@example.com")
+	assert.Equal(t, name, decoded.Name)
+	assert.Equal(t, "abc@example.com", decoded.UID)
+}
+
+// TestICSExDateFromRequest - дата без времени из формы и JSON исключает день в поясе события
+func TestICSExDateFromRequest(t *testing.T) {
+	excluded := time.Date(2022, 5, 11, 0, 0, 0, 0, time.UTC)
+
+	v := &validator{}
+	fromForm := eventFromForm(url.Values{
+		"user_id": {"1"}, "name": {"standup"}, "tz": {"Asia/Tokyo"},
+		"start": {"2022-05-10T08:00:00+09:00"}, "rrule": {"FREQ=DAILY;COUNT=3"}, "exdates": {"2022-05-11"},
+	}, time.UTC, v)
+	require.NoError(t, v.err())
+
+	fromJSON := &Event{}
+	require.NoError(t, json.Unmarshal([]byte(`{"user_id": 1, "name": "standup", "tz": "Asia/Tokyo",
+		"start": "2022-05-10T08:00:00+09:00", "rrule": "FREQ=DAILY;COUNT=3", "exdates": ["2022-05-11"]}`), fromJSON))
+
+	for name, event := range map[string]*Event{"form": fromForm, "json": fromJSON} {
+		require.Len(t, event.ExDates, 1, name)
+		assert.True(t, event.ExDates[0].Date, name)
+		assert.True(t, excluded.Equal(event.ExDates[0].Time), name)
+
+		_, lines := roundTrip(t, event)
+		assert.Contains(t, lines, "EXDATE;VALUE=DATE:20220511", name)
+		assert.Len(t, event.occurrences(time.Time(event.Start), time.Time(event.Start).AddDate(0, 0, 3)), 2, name)
+	}
+}
+
+// TestICSTimeZone - у каждого TZID есть VTIMEZONE с переходами пояса
+func TestICSTimeZone(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+	start := time.Date(2022, 5, 10, 9, 0, 0, 0, newYork)
+	events := []*Event{
+		{Id: 1, UserId: 1, Name: "standup", TimeZone: "America/New_York", Start: jsonTime(start)},
+		{Id: 2, UserId: 1, Name: "call", TimeZone: "Europe/Moscow", Start: jsonTime(start)},
+		{Id: 3, UserId: 1, Name: "utc", Start: jsonTime(start)},
+	}
+	buf := &bytes.Buffer{}
+	require.NoError(t, encodeICS(buf, events, time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC)))
+	ics := buf.String()
+
+	assert.Equal(t, 2, strings.Count(ics, "BEGIN:VTIMEZONE\r\n"))
+	assert.Contains(t, ics, "BEGIN:VTIMEZONE\r\nTZID:America/New_York\r\n"+
+		"BEGIN:STANDARD\r\nDTSTART:20220101T000000\r\nTZOFFSETFROM:-0500\r\nTZOFFSETTO:-0500\r\nTZNAME:EST\r\nEND:STANDARD\r\n"+
+		"BEGIN:DAYLIGHT\r\nDTSTART:20220313T020000\r\nTZOFFSETFROM:-0500\r\nTZOFFSETTO:-0400\r\nTZNAME:EDT\r\nEND:DAYLIGHT\r\n"+
+		"BEGIN:STANDARD\r\nDTSTART:20221106T020000\r\nTZOFFSETFROM:-0400\r\nTZOFFSETTO:-0500\r\nTZNAME:EST\r\nEND:STANDARD\r\n")
+	// переходы описаны на icsZoneYears лет вперед
+	assert.Contains(t, ics, "DTSTART:20311102T020000\r\n")
+	assert.Contains(t, ics, "BEGIN:VTIMEZONE\r\nTZID:Europe/Moscow\r\n"+
+		"BEGIN:STANDARD\r\nDTSTART:20220101T000000\r\nTZOFFSETFROM:+0300\r\nTZOFFSETTO:+0300\r\nTZNAME:MSK\r\nEND:STANDARD\r\n"+
+		"END:VTIMEZONE\r\n")
+	assert.Contains(t, ics, "DTSTART;TZID=America/New_York:20220510T090000\r\n")
+	assert.Contains(t, ics, "DTSTART:20220510T130000Z\r\n")
+
+	// VTIMEZONE при разборе пропускается
+	imported, err := decodeICS(strings.NewReader(ics), 1, time.UTC)
+	require.NoError(t, err)
+	assert.Len(t, imported, 3)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// maxLevel - максимальная высота списка, хватает на миллионы элементов
+const maxLevel = 24
+
+// indexKey - ключ индекса: пользователь, время начала события и id для уникальности
+type indexKey struct {
+	userId int
+	at     int64
+	id     int
+}
+
+func (k indexKey) less(other indexKey) bool {
+	if k.userId != other.userId {
+		return k.userId < other.userId
+	}
+	if k.at != other.at {
+		return k.at < other.at
+	}
+	return k.id < other.id
+}
+
+func keyFor(userId int, at time.Time, id int) indexKey {
+	return indexKey{userId: userId, at: at.UnixNano(), id: id}
+}
+
+type skipNode struct {
+	key   indexKey
+	event *Event
+	next  []*skipNode
+}
+
+// eventIndex - упорядоченный по (userId, время, id) индекс событий на основе skip list.
+// Вставка, удаление и поиск начала диапазона работают за O(log n).
+// Индекс не потокобезопасен, синхронизация лежит на хранилище.
+type eventIndex struct {
+	head   *skipNode
+	level  int
+	length int
+	rnd    *rand.Rand
+}
+
+func newEventIndex() *eventIndex {
+	return &eventIndex{
+		head:  &skipNode{next: make([]*skipNode, maxLevel)},
+		level: 1,
+		rnd:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (idx *eventIndex) randomLevel() int {
+	level := 1
+	for level < maxLevel && idx.rnd.Int63()&3 == 0 {
+		level++
+	}
+	return level
+}
+
+// findPrev - для каждого уровня находит последний узел с ключом меньше key
+func (idx *eventIndex) findPrev(key indexKey) []*skipNode {
+	prev := make([]*skipNode, maxLevel)
+	node := idx.head
+	for i := idx.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].key.less(key) {
+			node = node.next[i]
+		}
+		prev[i] = node
+	}
+	return prev
+}
+
+// Insert - добавляет событие по ключу, существующий ключ перезаписывается
+func (idx *eventIndex) Insert(key indexKey, event *Event) {
+	prev := idx.findPrev(key)
+	if node := prev[0].next[0]; node != nil && node.key == key {
+		node.event = event
+		return
+	}
+
+	level := idx.randomLevel()
+	if level > idx.level {
+		for i := idx.level; i < level; i++ {
+			prev[i] = idx.head
+		}
+		idx.level = level
+	}
+
+	node := &skipNode{key: key, event: event, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = prev[i].next[i]
+		prev[i].next[i] = node
+	}
+	idx.length++
+}
+
+// Delete - удаляет ключ из индекса, возвращает false если его не было
+func (idx *eventIndex) Delete(key indexKey) bool {
+	prev := idx.findPrev(key)
+	node := prev[0].next[0]
+	if node == nil || node.key != key {
+		return false
+	}
+
+	for i := 0; i < len(node.next); i++ {
+		prev[i].next[i] = node.next[i]
+	}
+	for idx.level > 1 && idx.head.next[idx.level-1] == nil {
+		idx.level--
+	}
+	idx.length--
+	return true
+}
+
+// RangeUser - обходит все события пользователя в порядке возрастания даты
+func (idx *eventIndex) RangeUser(userId int, fn func(event *Event) bool) {
+	node := idx.findPrev(indexKey{userId: userId, at: math.MinInt64})[0].next[0]
+	for ; node != nil && node.key.userId == userId; node = node.next[0] {
+		if !fn(node.event) {
+			return
+		}
+	}
+}
+
+// Range - обходит события пользователя с началом в полуинтервале [from, to) в порядке возрастания,
+// обход прекращается, если fn вернула false
+func (idx *eventIndex) Range(userId int, from, to time.Time, fn func(event *Event) bool) {
+	start := indexKey{userId: userId, at: from.UnixNano()}
+	end := indexKey{userId: userId, at: to.UnixNano()}
+
+	node := idx.findPrev(start)[0].next[0]
+	for ; node != nil && node.key.less(end); node = node.next[0] {
+		if !fn(node.event) {
+			return
+		}
+	}
+}
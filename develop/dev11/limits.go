@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LimitsConfig - ограничения на запросы клиентов. MaxBodyBytes - максимальный размер тела запроса, 0 - без ограничения
+type LimitsConfig struct {
+	MaxBodyBytes int64           `json:"max_body_bytes" yaml:"max_body_bytes"`
+	RateLimit    RateLimitConfig `json:"rate_limit" yaml:"rate_limit"`
+}
+
+// RateLimitConfig - ограничение частоты запросов. Каждый клиент может сделать Burst запросов подряд,
+// дальше - Rate запросов в секунду. Клиент определяется по пользователю запроса, а без аутентификации или с неверными
+// учетными данными - по IP адресу; TrustProxy - брать адрес из X-Forwarded-For, если сервер стоит за прокси.
+// TrustedProxies - адреса и подсети прокси (например 10.0.0.0/8), пустой список - доверять только самому
+// подключившемуся к серверу прокси.
+type RateLimitConfig struct {
+	Enabled        bool     `json:"enabled" yaml:"enabled"`
+	Rate           float64  `json:"rate" yaml:"rate"`
+	Burst          int      `json:"burst" yaml:"burst"`
+	TrustProxy     bool     `json:"trust_proxy" yaml:"trust_proxy"`
+	TrustedProxies []string `json:"trusted_proxies" yaml:"trusted_proxies"`
+}
+
+// parseProxy - адрес или подсеть прокси
+func parseProxy(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("wrong address %q", s)
+		}
+		bits := 8 * len(ip)
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	return network, err
+}
+
+// bucketIdle - через сколько после последнего запроса заполненное ведро удаляется
+const bucketIdle = 10 * time.Minute
+
+// tokenBucket - ведро токенов одного клиента
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// unlimitedPaths - пути, которые не ограничиваются по частоте: их часто опрашивают оркестратор и балансировщик.
+// Метрики и описание API ограничиваются наравне с остальными запросами.
+var unlimitedPaths = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+// rateLimiter - ограничение частоты запросов алгоритмом token bucket
+type rateLimiter struct {
+	rate       float64
+	burst      float64
+	trustProxy bool
+	proxies    []*net.IPNet
+	now        func() time.Time
+	// identify - пользователь запроса с верными учетными данными. Ограничение стоит до аутентификации,
+	// чтобы запросы с неверными токенами и ключами тоже ограничивались, поэтому пользователь определяется здесь.
+	identify func(r *http.Request) (Principal, bool)
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(cfg RateLimitConfig) *rateLimiter {
+	if !cfg.Enabled {
+		return nil
+	}
+	l := &rateLimiter{
+		rate:       cfg.Rate,
+		burst:      float64(cfg.Burst),
+		trustProxy: cfg.TrustProxy,
+		now:        time.Now,
+		buckets:    map[string]*tokenBucket{},
+	}
+	// адреса проверены в Config.Validate
+	for _, proxy := range cfg.TrustedProxies {
+		if network, err := parseProxy(proxy); err == nil {
+			l.proxies = append(l.proxies, network)
+		}
+	}
+	return l
+}
+
+// allow - берет токен из ведра клиента key. Если токенов нет, возвращает время до появления следующего.
+func (l *rateLimiter) allow(key string) (ok bool, retryAfter time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	b, exist := l.buckets[key]
+	if !exist {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep - раз в bucketIdle удаляет ведра давно не появлявшихся клиентов, чтобы карта не росла бесконечно
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < bucketIdle {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= bucketIdle {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// clientKey - ключ клиента: пользователь запроса или, если учетных данных нет или они неверны, IP адрес
+func (l *rateLimiter) clientKey(r *http.Request) string {
+	if l.identify != nil {
+		if p, ok := l.identify(r); ok {
+			return "user:" + strconv.Itoa(p.UserId)
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !l.trustProxy {
+		return "ip:" + host
+	}
+
+	// левые адреса X-Forwarded-For клиент пишет сам, поэтому цепочка читается справа: каждый доверенный прокси
+	// добавил адрес того, кто к нему подключился, и клиент - первый адрес, который не принадлежит прокси
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	client := host
+	for i := len(hops) - 1; i >= 0 && l.trusted(client, i == len(hops)-1); i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		client = hop
+	}
+	return "ip:" + client
+}
+
+// trusted - принадлежит ли адрес доверенному прокси. Без списка прокси доверенным считается только peer -
+// тот, кто подключился к серверу
+func (l *rateLimiter) trusted(addr string, peer bool) bool {
+	if len(l.proxies) == 0 {
+		return peer
+	}
+	ip := net.ParseIP(addr)
+	for _, network := range l.proxies {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware - отвечает 429 с Retry-After клиентам, превысившим частоту запросов.
+// Проверки живости и готовности не ограничиваются.
+func (l *rateLimiter) Middleware(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unlimitedPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if ok, retryAfter := l.allow(l.clientKey(r)); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			errorResponse(w, ErrRateLimited)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitedBody - тело запроса с ограничением размера. http.MaxBytesReader в go 1.18 возвращает ошибку
+// без типа, поэтому превышение определяется по количеству прочитанных байт и отдается как ErrBodyTooLarge.
+type limitedBody struct {
+	io.ReadCloser
+	limit int64
+	read  int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if err != nil && err != io.EOF && b.read >= b.limit {
+		return n, ErrBodyTooLarge
+	}
+	return n, err
+}
+
+// BodyLimitMiddleware - ограничивает размер тела запроса maxBytes байтами. Запрос с заранее известным
+// слишком большим Content-Length отклоняется сразу, без чтения тела.
+func BodyLimitMiddleware(maxBytes int64, next http.Handler) http.Handler {
+	if maxBytes <= 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > maxBytes {
+			errorResponse(w, ErrBodyTooLarge)
+			return
+		}
+		r.Body = &limitedBody{ReadCloser: http.MaxBytesReader(w, r.Body, maxBytes), limit: maxBytes}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2022, 5, 10, 0, 0, 0, 0, time.UTC)
+	l := newRateLimiter(RateLimitConfig{Enabled: true, Rate: 2, Burst: 3})
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		ok, _ := l.allow("user:1")
+		assert.True(t, ok)
+	}
+	ok, retryAfter := l.allow("user:1")
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, retryAfter)
+
+	// у другого клиента свое ведро
+	ok, _ = l.allow("user:2")
+	assert.True(t, ok)
+
+	now = now.Add(retryAfter)
+	ok, _ = l.allow("user:1")
+	assert.True(t, ok)
+
+	// давно не появлявшиеся клиенты удаляются
+	now = now.Add(bucketIdle)
+	l.allow("user:3")
+	assert.Len(t, l.buckets, 1)
+}
+
+// TestRateLimitMiddleware - ограничение стоит до аутентификации: запросы с неверными ключами ограничиваются по IP
+func TestRateLimitMiddleware(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Reminders.Enabled = false
+	cfg.Auth = AuthConfig{Enabled: true, APIKeys: []APIKeyConfig{{Key: strings.Repeat("k", minSecretLength), UserId: 1}}}
+	cfg.Limits.RateLimit = RateLimitConfig{Enabled: true, Rate: 0.5, Burst: 2}
+	s, err := NewServer(cfg)
+	require.NoError(t, err)
+
+	get := func(path, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set(apiKeyHeader, key)
+		rec := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, get("/events_for_day?user_id=1&date=2022-05-10", "wrong").Code)
+	assert.Equal(t, http.StatusUnauthorized, get("/events_for_day?user_id=1&date=2022-05-10", "wrong").Code)
+	rec := get("/events_for_day?user_id=1&date=2022-05-10", "wrong")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "2", rec.Header().Get("Retry-After"))
+
+	// метрики ограничиваются вместе с остальными запросами, проверки живости - нет
+	assert.Equal(t, http.StatusTooManyRequests, get("/metrics", "").Code)
+	assert.Equal(t, http.StatusOK, get("/healthz", "").Code)
+
+	// у пользователя с верным ключом свое ведро
+	assert.Equal(t, http.StatusOK, get("/events_for_day?user_id=1&date=2022-05-10", strings.Repeat("k", minSecretLength)).Code)
+}
+
+// TestRateLimitForwardedFor - подмена левого адреса X-Forwarded-For не дает клиенту новое ведро
+func TestRateLimitForwardedFor(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		proxies []string
+		chain   string // адреса после подделанного клиентом
+		remote  string
+	}{
+		{name: "один прокси", chain: "203.0.113.7", remote: "10.0.0.1:4000"},
+		{name: "цепочка прокси", proxies: []string{"10.0.0.0/8", "192.0.2.1"}, chain: "203.0.113.7, 10.1.1.1,192.0.2.1", remote: "10.0.0.1:4000"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l := newRateLimiter(RateLimitConfig{Enabled: true, Rate: 1, Burst: 2, TrustProxy: true, TrustedProxies: tc.proxies})
+			handler := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			codes := make([]int, 0, 3)
+			for i := 0; i < 3; i++ {
+				req := httptest.NewRequest(http.MethodGet, "/events", nil)
+				req.RemoteAddr = tc.remote
+				req.Header.Set("X-Forwarded-For", fmt.Sprintf("198.51.100.%d, %s", i, tc.chain))
+				assert.Equal(t, "ip:203.0.113.7", l.clientKey(req))
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				codes = append(codes, rec.Code)
+			}
+			assert.Equal(t, []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}, codes)
+		})
+	}
+
+	// запрос не от доверенного прокси ограничивается по адресу подключения
+	l := newRateLimiter(RateLimitConfig{Enabled: true, Rate: 1, Burst: 2, TrustProxy: true, TrustedProxies: []string{"10.0.0.0/8"}})
+	req := httptest.NewRequest(http.MethodGet, "/events", nil)
+	req.RemoteAddr = "203.0.113.9:4000"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	assert.Equal(t, "ip:203.0.113.9", l.clientKey(req))
+}
+
+func TestBodyLimitMiddleware(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Reminders.Enabled = false
+	cfg.Limits.RateLimit.Enabled = false
+	cfg.Limits.MaxBodyBytes = 64
+	s, err := NewServer(cfg)
+	require.NoError(t, err)
+
+	body := "user_id=1&date=2022-05-10T10:00&name=" + strings.Repeat("a", 100)
+	for name, contentLength := range map[string]int64{"content length": int64(len(body)), "chunked": -1} {
+		req := httptest.NewRequest(http.MethodPost, "/create_event", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.ContentLength = contentLength
+		rec := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code, name)
+		assert.Contains(t, rec.Body.String(), codeTooLarge, name)
+	}
+}
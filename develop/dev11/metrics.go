@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Метрики в текстовом формате Prometheus (text exposition format 0.0.4) без сторонних библиотек.
+// Счетчики и гистограммы глобальные, как expvar: их обновляют обработчики и middleware,
+// которым неоткуда взять сервер. Показатели хранилища считаются в момент запроса /metrics.
+
+// defaultBuckets - границы гистограммы длительности запросов в секундах
+var defaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	httpRequests = newCounterVec("calendar_http_requests_total",
+		"Количество обработанных HTTP запросов.", "route", "method", "status")
+	httpDuration = newHistogramVec("calendar_http_request_duration_seconds",
+		"Длительность обработки HTTP запросов.", defaultBuckets, "route", "method")
+	errorsTotal = newCounterVec("calendar_errors_total",
+		"Количество ответов с ошибкой по коду ошибки.", "code")
+	remindersTotal = newCounterVec("calendar_reminders_total",
+		"Количество напоминаний по результату отправки.", "result")
+)
+
+// processStart - время запуска процесса для calendar_uptime_seconds
+var processStart = time.Now()
+
+// labelKey - значения меток одной серии, склеенные в ключ карты
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// formatLabels - метки в виде {name="value",...}
+func formatLabels(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+
+	parts := make([]string, 0, len(names)+len(extra)/2)
+	for i, name := range names {
+		parts = append(parts, name+`="`+escapeLabel(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		parts = append(parts, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// counterVec - счетчики с метками
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	values []string
+	value  float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, series: map[string]*counterSeries{}}
+}
+
+// Inc - увеличивает счетчик серии с метками values на единицу
+func (c *counterVec) Inc(values ...string) {
+	key := labelKey(values)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.series[key]
+	if !ok {
+		s = &counterSeries{values: values}
+		c.series[key] = s
+	}
+	s.value++
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeHeader(w, c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.series) {
+		s := c.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, s.values), formatFloat(s.value))
+	}
+}
+
+// histogramVec - гистограммы с метками
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	values []string
+	counts []uint64 // counts[i] - наблюдения не больше buckets[i], без накопления
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogramSeries{}}
+}
+
+// Observe - добавляет наблюдение v в серию с метками values
+func (h *histogramVec) Observe(v float64, values ...string) {
+	key := labelKey(values)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{values: values, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.values, "le", formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.values, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.values), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.values), s.count)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeGauge - показатель без меток
+func writeGauge(w io.Writer, name, help string, value float64) {
+	writeHeader(w, name, help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(value))
+}
+
+// metricMethods - методы, которые попадают в метки как есть, остальные считаются вместе как "other"
+var metricMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+	methodPropfind:     true,
+	methodReport:       true,
+}
+
+// metricMethod - метод запроса для метки. Метод задает клиент, и произвольные значения порождали бы
+// бесконечное число серий
+func metricMethod(method string) string {
+	if metricMethods[method] {
+		return method
+	}
+	return "other"
+}
+
+// MetricsMiddleware - считает запросы и их длительность по шаблону маршрута, а не по пути,
+// чтобы id в пути не порождали бесконечное число серий. Неизвестные методы считаются как "other"
+func MetricsMiddleware(rt *router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		route := rt.pattern(r.URL.Path)
+		if route == "" {
+			route = "unmatched"
+		}
+
+		method := metricMethod(r.Method)
+		httpRequests.Inc(route, method, strconv.Itoa(status))
+		httpDuration.Observe(time.Since(start).Seconds(), route, method)
+	})
+}
+
+// MetricsHandler - показатели сервера в текстовом формате Prometheus
+func (s *eventServer) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	httpRequests.write(w)
+	httpDuration.write(w)
+	errorsTotal.write(w)
+	remindersTotal.write(w)
+
+	if reporter, ok := s.storage.(StatsReporter); ok {
+		stats := reporter.Stats()
+		writeGauge(w, "calendar_storage_events", "Количество событий в хранилище.", float64(stats.Events))
+		writeGauge(w, "calendar_storage_recurring_events", "Количество повторяющихся событий в хранилище.", float64(stats.Recurring))
+		writeGauge(w, "calendar_storage_users", "Количество пользователей с событиями.", float64(stats.Users))
+		writeGauge(w, "calendar_storage_deleted_events", "Удаленных событий, которые хранятся для восстановления.", float64(stats.Deleted))
+		if stats.Persistent {
+			writeGauge(w, "calendar_storage_journal_bytes", "Размер журнала файлового хранилища.", float64(stats.JournalBytes))
+			writeGauge(w, "calendar_storage_journal_records", "Записей в журнале после последнего снимка.", float64(stats.JournalRecords))
+		}
+	}
+	if s.feed != nil {
+		writeGauge(w, "calendar_stream_subscribers", "Количество открытых потоков изменений.", float64(s.feed.subscribers()))
+	}
+
+	writeGauge(w, "calendar_goroutines", "Количество горутин.", float64(runtime.NumGoroutine()))
+	writeGauge(w, "calendar_uptime_seconds", "Время работы процесса.", time.Since(processStart).Seconds())
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsFormat(t *testing.T) {
+	counter := newCounterVec("test_total", "Test counter.", "route")
+	counter.Inc(`/a"b`)
+	counter.Inc(`/a"b`)
+
+	histogram := newHistogramVec("test_seconds", "Test histogram.", []float64{0.1, 1}, "route")
+	histogram.Observe(0.05, "/a")
+	histogram.Observe(0.5, "/a")
+	histogram.Observe(5, "/a")
+
+	var b strings.Builder
+	counter.write(&b)
+	histogram.write(&b)
+
+	assert.Equal(t, `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{route="/a\"b"} 2
+# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{route="/a",le="0.1"} 1
+test_seconds_bucket{route="/a",le="1"} 2
+test_seconds_bucket{route="/a",le="+Inf"} 3
+test_seconds_sum{route="/a"} 5.55
+test_seconds_count{route="/a"} 3
+`, b.String())
+}
+
+// TestMetricsMethod - произвольные методы клиентов не создают новые серии
+func TestMetricsMethod(t *testing.T) {
+	handler := MetricsMiddleware((&eventServer{}).endpoints(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, method := range []string{"FOO1", "FOO2", methodPropfind} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, "/metrics-method-test", nil))
+	}
+
+	var b strings.Builder
+	httpRequests.write(&b)
+	assert.Contains(t, b.String(), `route="unmatched",method="other",status="200"`)
+	assert.Contains(t, b.String(), `route="unmatched",method="PROPFIND",status="200"`)
+	assert.NotContains(t, b.String(), "FOO")
+}
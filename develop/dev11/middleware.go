@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// requestIdHeader - заголовок с идентификатором запроса, входящий идентификатор сохраняется,
+// иначе генерируется новый
+const requestIdHeader = "X-Request-ID"
+
+type contextKey int
+
+const (
+	requestIdKey contextKey = iota
+	principalKey
+	routeParamsKey
+)
+
+// requestId - идентификатор текущего запроса из контекста
+func requestId(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey).(string)
+	return id
+}
+
+// newRequestId - случайный идентификатор из 16 байт в hex
+func newRequestId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// validRequestId - входящий идентификатор принимается, только если он короткий и печатный,
+// чтобы клиент не мог сломать формат лога
+func validRequestId(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' || id[i] == '"' {
+			return false
+		}
+	}
+	return true
+}
+
+// statusRecorder - обертка над http.ResponseWriter, запоминающая статус и количество записанных байт
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// Flush - пробрасывает Flush, если его поддерживает исходный writer
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		if r.status == 0 {
+			r.status = http.StatusOK
+		}
+		flusher.Flush()
+	}
+}
+
+// Hijack - пробрасывает Hijack, если его поддерживает исходный writer
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking is not supported")
+	}
+	return hijacker.Hijack()
+}
+
+// Unwrap - исходный writer для http.ResponseController
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// accessEntry - данные об обработанном запросе для записи в лог
+type accessEntry struct {
+	Time       time.Time
+	RequestId  string
+	RemoteAddr string
+	Method     string
+	URI        string
+	Proto      string
+	Status     int
+	Bytes      int
+	Duration   time.Duration
+	Referer    string
+	UserAgent  string
+}
+
+// accessLog - логгер без префикса для форматов, которые разбираются машиной
+var accessLog = log.New(log.Writer(), "", 0)
+
+// formatPlain - формат по умолчанию, как раньше, но со статусом, размером и id запроса
+func formatPlain(e accessEntry) string {
+	return fmt.Sprintf("%s %s %d %dB %s id=%s", e.Method, logSafe(e.URI), e.Status, e.Bytes, e.Duration, e.RequestId)
+}
+
+// logSafe - экранирует управляющие символы, кавычки и обратную косую черту, как %q без внешних кавычек.
+// URI передает клиент, и без экранирования CR/LF в нем добавили бы в лог поддельные строки
+func logSafe(s string) string {
+	unsafe := strings.IndexFunc(s, func(r rune) bool {
+		return unicode.IsControl(r) || r == '"' || r == '\\'
+	})
+	if unsafe < 0 {
+		return s
+	}
+	quoted := strconv.Quote(s)
+	return quoted[1 : len(quoted)-1]
+}
+
+// formatJSON - одна JSON строка на запрос
+func formatJSON(e accessEntry) string {
+	var b strings.Builder
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	_ = encoder.Encode(map[string]interface{}{
+		"time":        e.Time.Format(time.RFC3339Nano),
+		"request_id":  e.RequestId,
+		"remote_addr": e.RemoteAddr,
+		"method":      e.Method,
+		"uri":         e.URI,
+		"proto":       e.Proto,
+		"status":      e.Status,
+		"bytes":       e.Bytes,
+		"duration_ms": float64(e.Duration.Microseconds()) / 1000,
+		"referer":     e.Referer,
+		"user_agent":  e.UserAgent,
+	})
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// formatCombined - Apache combined log format
+func formatCombined(e accessEntry) string {
+	host := e.RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	size := "-"
+	if e.Bytes > 0 {
+		size = fmt.Sprint(e.Bytes)
+	}
+
+	return fmt.Sprintf(`%s - - [%s] "%s %s %s" %d %s %q %q`,
+		host, e.Time.Format("02/Jan/2006:15:04:05 -0700"), e.Method, logSafe(e.URI), e.Proto,
+		e.Status, size, orDash(e.Referer), orDash(e.UserAgent))
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// LoggingMiddleware - пишет в лог каждый обработанный запрос в формате format (plain, json или combined)
+// и проставляет запросу X-Request-ID
+func LoggingMiddleware(format string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		id := req.Header.Get(requestIdHeader)
+		if !validRequestId(id) {
+			id = newRequestId()
+		}
+		w.Header().Set(requestIdHeader, id)
+		req = req.WithContext(context.WithValue(req.Context(), requestIdKey, id))
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, req)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		entry := accessEntry{
+			Time:       start,
+			RequestId:  id,
+			RemoteAddr: req.RemoteAddr,
+			Method:     req.Method,
+			URI:        req.RequestURI,
+			Proto:      req.Proto,
+			Status:     recorder.status,
+			Bytes:      recorder.bytes,
+			Duration:   time.Since(start),
+			Referer:    req.Referer(),
+			UserAgent:  req.UserAgent(),
+		}
+
+		switch format {
+		case logFormatJSON:
+			accessLog.Print(formatJSON(entry))
+		case logFormatCombined:
+			accessLog.Print(formatCombined(entry))
+		default:
+			log.Print(formatPlain(entry))
+		}
+	})
+}
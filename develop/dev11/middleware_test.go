@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestAccessLogEscaping - CR/LF из URI не разрывают строку лога
+func TestAccessLogEscaping(t *testing.T) {
+	entry := accessEntry{
+		Time: time.Date(2022, 5, 10, 12, 0, 0, 0, time.UTC), RemoteAddr: "10.0.0.1:5000", Method: http.MethodGet,
+		URI: "/search?q=a\r\nGET /admin 200", Proto: "HTTP/1.1", Status: http.StatusOK,
+	}
+
+	for name, line := range map[string]string{"plain": formatPlain(entry), "combined": formatCombined(entry), "json": formatJSON(entry)} {
+		assert.False(t, strings.ContainsAny(line, "\r\n"), name)
+		assert.Contains(t, line, `/search?q=a\r\nGET /admin 200`, name)
+	}
+	assert.Equal(t, "/events/1", logSafe("/events/1"))
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPISpec - описание API в формате OpenAPI 3. При добавлении методов документ нужно дополнять:
+// контрактные тесты проверяют, что каждый маршрут в нем описан и ответы ему соответствуют.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// OpenAPIHandler - отдает описание API
+func (s *eventServer) OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(openAPISpec)
+}
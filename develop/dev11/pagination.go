@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ограничения размера страницы
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// pageCursor - позиция в списке, упорядоченном по дате и id: последнее отданное событие.
+// У повторений одного события id совпадает, поэтому позиция задается парой (начало, id).
+type pageCursor struct {
+	at int64
+	id int
+}
+
+func cursorFor(event *Event) pageCursor {
+	return pageCursor{at: time.Time(event.Start).UnixNano(), id: event.Id}
+}
+
+// after - лежит ли событие после позиции курсора
+func (c pageCursor) after(event *Event) bool {
+	at := time.Time(event.Start).UnixNano()
+	return at > c.at || at == c.at && event.Id > c.id
+}
+
+// String - курсор в непрозрачном для клиента виде
+func (c pageCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", c.at, c.id)))
+}
+
+func parseCursor(s string) (c pageCursor, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	at, id, ok := strings.Cut(string(b), ":")
+	if !ok {
+		return c, fmt.Errorf("malformed cursor")
+	}
+	if c.at, err = strconv.ParseInt(at, 10, 64); err != nil {
+		return c, err
+	}
+	c.id, err = strconv.Atoi(id)
+	return c, err
+}
+
+// pageParams - параметры выдачи списка: cursor - курсор из предыдущего ответа, limit - размер страницы,
+// name - подстрока названия без учета регистра
+type pageParams struct {
+	cursor *pageCursor
+	limit  int
+	name   string
+}
+
+// parsePage - параметры выдачи из запроса. defaultLimit 0 означает, что без limit и cursor список
+// отдается целиком: так старые методы продолжают возвращать все события.
+func parsePage(values url.Values, defaultLimit int, v *validator) pageParams {
+	p := pageParams{name: strings.ToLower(values.Get("name"))}
+
+	if value := values.Get("cursor"); value != "" {
+		c, err := parseCursor(value)
+		if err != nil {
+			v.add("cursor", "wrong cursor")
+		}
+		p.cursor = &c
+		if defaultLimit == 0 {
+			defaultLimit = defaultPageLimit
+		}
+	}
+
+	p.limit = defaultLimit
+	if value := values.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		v.check(err == nil && limit > 0 && limit <= maxPageLimit, "limit",
+			fmt.Sprintf("limit must be between 1 and %d", maxPageLimit))
+		p.limit = limit
+	}
+	return p
+}
+
+// apply - фильтрует упорядоченный по дате и id список и вырезает страницу после курсора.
+// next - курсор следующей страницы, пустой если страница последняя.
+func (p pageParams) apply(events []*Event) (page []*Event, next string) {
+	if p.name != "" {
+		filtered := make([]*Event, 0, len(events))
+		for _, event := range events {
+			if strings.Contains(strings.ToLower(event.Name), p.name) {
+				filtered = append(filtered, event)
+			}
+		}
+		events = filtered
+	}
+
+	if p.cursor != nil {
+		events = events[sort.Search(len(events), func(i int) bool {
+			return p.cursor.after(events[i])
+		}):]
+	}
+
+	if p.limit > 0 && len(events) > p.limit {
+		events = events[:p.limit]
+		next = cursorFor(events[len(events)-1]).String()
+	}
+	return events, next
+}
+
+// pageResponse - ответ {"result": [...], "next_cursor": "..."} со страницей событий,
+// next_cursor есть только если есть следующая страница
+func pageResponse(w http.ResponseWriter, events []*Event, p pageParams) {
+	events, next := p.apply(events)
+	if events == nil {
+		events = []*Event{}
+	}
+	data := map[string]interface{}{"result": events}
+	if next != "" {
+		data["next_cursor"] = next
+	}
+	writeJSON(w, http.StatusOK, data)
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// частоты повторения
+const (
+	freqDaily   = "DAILY"
+	freqWeekly  = "WEEKLY"
+	freqMonthly = "MONTHLY"
+	freqYearly  = "YEARLY"
+)
+
+// форматы UNTIL из RFC 5545: дата или дата со временем в UTC
+const (
+	rruleDateLayout     = "20060102"
+	rruleDateTimeLayout = "20060102T150405Z"
+)
+
+var weekdays = map[string]time.Weekday{
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+	"SU": time.Sunday,
+}
+
+// Recurrence - правило повторения события, подмножество RRULE из RFC 5545:
+// FREQ (DAILY, WEEKLY, MONTHLY, YEARLY), INTERVAL, COUNT, UNTIL и BYDAY без порядковых номеров.
+// В JSON передается строкой, например "FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,WE".
+// UntilDate - UNTIL задан датой без времени: серия включает этот день целиком по местному времени события,
+// а Until хранит дату как полночь UTC.
+type Recurrence struct {
+	Freq      string
+	Interval  int
+	Count     int
+	Until     time.Time
+	UntilDate bool
+	ByDay     []time.Weekday
+}
+
+// ParseRecurrence - разбирает строку RRULE, префикс "RRULE:" допускается
+func ParseRecurrence(s string) (*Recurrence, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "RRULE:")
+	if s == "" {
+		return nil, errors.New("empty rrule")
+	}
+
+	r := &Recurrence{Interval: 1}
+	for _, part := range strings.Split(s, ";") {
+		name, value, ok := strings.Cut(part, "=")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("wrong rrule part %q", part)
+		}
+
+		var err error
+		switch strings.ToUpper(name) {
+		case "FREQ":
+			r.Freq = strings.ToUpper(value)
+		case "INTERVAL":
+			r.Interval, err = strconv.Atoi(value)
+			if err == nil && r.Interval < 1 {
+				err = errors.New("must be positive")
+			}
+		case "COUNT":
+			r.Count, err = strconv.Atoi(value)
+			if err == nil && r.Count < 1 {
+				err = errors.New("must be positive")
+			}
+		case "UNTIL":
+			r.Until, err = time.Parse(rruleDateTimeLayout, value)
+			if err != nil {
+				r.Until, err = time.Parse(rruleDateLayout, value)
+				r.UntilDate = true
+			}
+		case "BYDAY":
+			for _, day := range strings.Split(strings.ToUpper(value), ",") {
+				weekday, exist := weekdays[day]
+				if !exist {
+					return nil, fmt.Errorf("unsupported BYDAY value %q", day)
+				}
+				r.ByDay = append(r.ByDay, weekday)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported rrule part %q", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("wrong %s: %w", strings.ToUpper(name), err)
+		}
+	}
+
+	switch r.Freq {
+	case freqDaily, freqWeekly, freqMonthly:
+	case freqYearly:
+		if len(r.ByDay) > 0 {
+			return nil, errors.New("BYDAY is not supported for YEARLY")
+		}
+	case "":
+		return nil, errors.New("FREQ is required")
+	default:
+		return nil, fmt.Errorf("unsupported FREQ %q", r.Freq)
+	}
+
+	if r.Count > 0 && !r.Until.IsZero() {
+		return nil, errors.New("COUNT and UNTIL are mutually exclusive")
+	}
+
+	// дни недели храним начиная с понедельника, как в RFC 5545 при WKST=MO
+	sort.Slice(r.ByDay, func(i, j int) bool {
+		return mondayFirst(r.ByDay[i]) < mondayFirst(r.ByDay[j])
+	})
+
+	return r, nil
+}
+
+func (r *Recurrence) String() string {
+	parts := []string{"FREQ=" + r.Freq}
+	if r.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if r.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.Count))
+	}
+	if r.UntilDate {
+		parts = append(parts, "UNTIL="+r.Until.Format(rruleDateLayout))
+	} else if !r.Until.IsZero() {
+		parts = append(parts, "UNTIL="+r.Until.UTC().Format(rruleDateTimeLayout))
+	}
+	if len(r.ByDay) > 0 {
+		days := make([]string, 0, len(r.ByDay))
+		for _, weekday := range r.ByDay {
+			days = append(days, strings.ToUpper(weekday.String()[:2]))
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	return strings.Join(parts, ";")
+}
+
+func (r *Recurrence) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	parsed, err := ParseRecurrence(s)
+	if err != nil {
+		return err
+	}
+	*r = *parsed
+	return nil
+}
+
+func (r *Recurrence) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+func mondayFirst(d time.Weekday) int {
+	return (int(d) + 6) % 7
+}
+
+func (r *Recurrence) hasDay(d time.Weekday) bool {
+	for _, weekday := range r.ByDay {
+		if weekday == d {
+			return true
+		}
+	}
+	return false
+}
+
+// period - возвращает кандидатов на повторение для k-го периода правила в хронологическом порядке
+func (r *Recurrence) period(start time.Time, k int) []time.Time {
+	n := k * r.Interval
+
+	switch r.Freq {
+	case freqDaily:
+		t := start.AddDate(0, 0, n)
+		if len(r.ByDay) > 0 && !r.hasDay(t.Weekday()) {
+			return nil
+		}
+		return []time.Time{t}
+
+	case freqWeekly:
+		if len(r.ByDay) == 0 {
+			return []time.Time{start.AddDate(0, 0, 7*n)}
+		}
+		monday := start.AddDate(0, 0, 7*n-mondayFirst(start.Weekday()))
+		res := make([]time.Time, 0, len(r.ByDay))
+		for _, weekday := range r.ByDay {
+			res = append(res, monday.AddDate(0, 0, mondayFirst(weekday)))
+		}
+		return res
+
+	case freqMonthly:
+		first := time.Date(start.Year(), start.Month(), 1, start.Hour(), start.Minute(), start.Second(),
+			start.Nanosecond(), start.Location()).AddDate(0, n, 0)
+		if len(r.ByDay) == 0 {
+			// несуществующие даты (например 31 февраля) пропускаются
+			t := first.AddDate(0, 0, start.Day()-1)
+			if t.Month() != first.Month() {
+				return nil
+			}
+			return []time.Time{t}
+		}
+		var res []time.Time
+		for t := first; t.Month() == first.Month(); t = t.AddDate(0, 0, 1) {
+			if r.hasDay(t.Weekday()) {
+				res = append(res, t)
+			}
+		}
+		return res
+
+	case freqYearly:
+		t := start.AddDate(n, 0, 0)
+		if t.Day() != start.Day() {
+			return nil
+		}
+		return []time.Time{t}
+	}
+
+	return nil
+}
+
+// periodStart - номинальное начало k-го периода
+func (r *Recurrence) periodStart(start time.Time, k int) time.Time {
+	n := k * r.Interval
+
+	switch r.Freq {
+	case freqDaily:
+		return start.AddDate(0, 0, n)
+	case freqWeekly:
+		return start.AddDate(0, 0, 7*n)
+	case freqMonthly:
+		return start.AddDate(0, n, 0)
+	default:
+		return start.AddDate(n, 0, 0)
+	}
+}
+
+// skipPeriods - сколько периодов можно пропустить не считая повторений, чтобы не перебирать
+// бесконечную серию с самого начала. При COUNT пропускать нельзя: нужно считать повторения.
+func (r *Recurrence) skipPeriods(start, from time.Time) int {
+	if r.Count > 0 || !from.After(start) {
+		return 0
+	}
+
+	var length time.Duration
+	switch r.Freq {
+	case freqDaily:
+		length = 24 * time.Hour
+	case freqWeekly:
+		length = 7 * 24 * time.Hour
+	default:
+		return 0
+	}
+
+	// с запасом в один период на переходы часовых поясов
+	k := int(from.Sub(start)/(length*time.Duration(r.Interval))) - 1
+	if k < 0 {
+		return 0
+	}
+	return k
+}
+
+// Occurrences - вызывает fn для каждого повторения серии, начинающейся в start, попадающего в [from, to).
+// Повторения из exdates пропускаются, но учитываются в COUNT, как того требует RFC 5545.
+func (r *Recurrence) Occurrences(start time.Time, exdates []ExDate, from, to time.Time, fn func(t time.Time)) {
+	count := 0
+	for k := r.skipPeriods(start, from); ; k++ {
+		candidates := r.period(start, k)
+		for _, t := range candidates {
+			if t.Before(start) {
+				continue
+			}
+			if !t.Before(to) || r.ended(t) {
+				return
+			}
+
+			count++
+			if !t.Before(from) && !excluded(t, exdates) {
+				fn(t)
+			}
+			if r.Count > 0 && count >= r.Count {
+				return
+			}
+		}
+
+		// периоды без повторений (например 31 число в коротком месяце) проверяем по их началу
+		if len(candidates) == 0 && !r.periodStart(start, k).Before(to) {
+			return
+		}
+	}
+}
+
+// ended - закончилась ли серия к повторению t. Дата без времени в UNTIL сравнивается с датой повторения
+// по его местному времени, то есть в поясе события
+func (r *Recurrence) ended(t time.Time) bool {
+	switch {
+	case r.Until.IsZero():
+		return false
+	case r.UntilDate:
+		y, m, d := t.Date()
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC).After(r.Until)
+	default:
+		return t.After(r.Until)
+	}
+}
+
+// ExDate - исключенное повторение. Date - дата задана без времени и исключает весь день по местному
+// времени повторения, тогда Time хранит эту дату в полночь UTC, как Until при UntilDate
+type ExDate struct {
+	Time time.Time
+	Date bool
+}
+
+// parseExDate - разбирает исключенную дату: время в RFC 3339 переводится в пояс loc, дата остается датой
+func parseExDate(s string, loc *time.Location) (ExDate, error) {
+	t, date, err := parseEventTime(s, loc)
+	if err != nil {
+		return ExDate{}, err
+	}
+	if date {
+		y, m, d := t.Date()
+		t = time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	}
+	return ExDate{Time: t, Date: date}, nil
+}
+
+// MarshalJSON - дата без времени пишется датой, чтобы после чтения обратно она осталась датой
+func (x ExDate) MarshalJSON() ([]byte, error) {
+	if x.Date {
+		return json.Marshal(x.Time.Format("2006-01-02"))
+	}
+	return jsonTime(x.Time).MarshalJSON()
+}
+
+// excluded - проверяет попадание повторения в исключенные даты.
+// Дата без времени исключает весь день по местному времени повторения, время - только это повторение.
+func excluded(t time.Time, exdates []ExDate) bool {
+	y, m, d := t.Date()
+	day := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	for _, ex := range exdates {
+		if (ex.Date && ex.Time.Equal(day)) || (!ex.Date && ex.Time.Equal(t)) {
+			return true
+		}
+	}
+	return false
+}
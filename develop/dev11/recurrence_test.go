@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func dates(r *Recurrence, start time.Time, exdates []ExDate, from, to time.Time) (res []string) {
+	r.Occurrences(start, exdates, from, to, func(t time.Time) {
+		res = append(res, t.Format("2006-01-02"))
+	})
+	return res
+}
+
+func TestRecurrence(t *testing.T) {
+	start := time.Date(2022, 1, 31, 10, 0, 0, 0, time.UTC) // понедельник
+	year := start.AddDate(1, 0, 0)
+
+	r, err := ParseRecurrence("FREQ=DAILY;COUNT=3")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2022-01-31", "2022-02-01", "2022-02-02"}, dates(r, start, nil, start, year))
+
+	// исключенная дата учитывается в COUNT
+	exdates := []ExDate{{Time: time.Date(2022, 2, 1, 0, 0, 0, 0, time.UTC), Date: true}}
+	assert.Equal(t, []string{"2022-01-31", "2022-02-02"}, dates(r, start, exdates, start, year))
+	// время в полночь без признака даты исключает только повторение в полночь
+	exdates = []ExDate{{Time: time.Date(2022, 2, 1, 0, 0, 0, 0, time.UTC)}}
+	assert.Equal(t, []string{"2022-01-31", "2022-02-01", "2022-02-02"}, dates(r, start, exdates, start, year))
+
+	r, err = ParseRecurrence("RRULE:FREQ=WEEKLY;INTERVAL=2;BYDAY=WE,MO;UNTIL=20220216")
+	assert.NoError(t, err)
+	assert.Equal(t, "FREQ=WEEKLY;INTERVAL=2;UNTIL=20220216;BYDAY=MO,WE", r.String())
+	assert.Equal(t, []string{"2022-01-31", "2022-02-02", "2022-02-14", "2022-02-16"}, dates(r, start, nil, start, year))
+
+	// 31 число есть не в каждом месяце
+	r, err = ParseRecurrence("FREQ=MONTHLY;COUNT=3")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2022-01-31", "2022-03-31", "2022-05-31"}, dates(r, start, nil, start, year))
+
+	// бесконечная серия, запрошенная далеко от начала
+	r, err = ParseRecurrence("FREQ=DAILY;INTERVAL=3")
+	assert.NoError(t, err)
+	from := time.Date(2030, 6, 1, 0, 0, 0, 0, time.UTC)
+	assert.Len(t, dates(r, start, nil, from, from.AddDate(0, 0, 30)), 10)
+
+	for _, wrong := range []string{"", "COUNT=3", "FREQ=HOURLY", "FREQ=DAILY;COUNT=0", "FREQ=DAILY;COUNT=2;UNTIL=20220101",
+		"FREQ=WEEKLY;BYDAY=1MO", "FREQ=YEARLY;BYDAY=MO"} {
+		_, err = ParseRecurrence(wrong)
+		assert.Error(t, err, wrong)
+	}
+}
+
+// TestRecurrenceUntilDate - дата в UNTIL включает последний день по местному времени события, а не по UTC
+func TestRecurrenceUntilDate(t *testing.T) {
+	r, err := ParseRecurrence("FREQ=DAILY;UNTIL=20220216")
+	assert.NoError(t, err)
+
+	for _, tc := range []struct {
+		zone string
+		hour int
+	}{
+		{zone: "Europe/Moscow", hour: 1},     // повторения накануне по UTC
+		{zone: "America/New_York", hour: 20}, // повторения на следующий день по UTC
+		{zone: "UTC", hour: 23},
+	} {
+		loc, err := time.LoadLocation(tc.zone)
+		assert.NoError(t, err)
+		start := time.Date(2022, 2, 14, tc.hour, 0, 0, 0, loc)
+		assert.Equal(t, []string{"2022-02-14", "2022-02-15", "2022-02-16"}, dates(r, start, nil, start, start.AddDate(0, 1, 0)), tc.zone)
+	}
+
+	// дата сохраняется датой при записи правила
+	restored, err := ParseRecurrence(r.String())
+	assert.NoError(t, err)
+	assert.Equal(t, r, restored)
+}
+
+func TestGetRangeRecurring(t *testing.T) {
+	s := NewStorage()
+	start := time.Date(2022, 5, 2, 0, 0, 0, 0, time.UTC)
+	rule, _ := ParseRecurrence("FREQ=DAILY;BYDAY=MO,TU,WE,TH,FR")
+
+	assert.NoError(t, s.Create(&Event{UserId: 1, Name: "standup", Start: jsonTime(start.Add(10 * time.Hour)), RRule: rule}, nil))
+	assert.NoError(t, s.Create(&Event{UserId: 1, Name: "lunch", Start: jsonTime(start.Add(13 * time.Hour))}, nil))
+
+	assert.Len(t, s.GetRange(1, start, start.AddDate(0, 0, 7)), 6)
+
+	events := s.GetRange(1, start, start.AddDate(0, 0, 1))
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, "standup", events[0].Name)
+		assert.Equal(t, "lunch", events[1].Name)
+	}
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ограничения напоминаний одного события
+const (
+	maxReminders      = 10
+	maxReminderBefore = 4 * 7 * 24 * time.Hour
+)
+
+// remindersStateFile - файл состояния планировщика в каталоге файлового хранилища
+const remindersStateFile = "reminders.json"
+
+// типы отправки напоминаний
+const (
+	notifierLog     = "log"
+	notifierWebhook = "webhook"
+)
+
+// maxBackoff - предельная пауза между повторными попытками отправки
+const maxBackoff = time.Minute
+
+// RemindersConfig - настройки напоминаний. MaxDelay - напоминания, опоздавшие больше чем на MaxDelay
+// (например пока сервер был остановлен), не отправляются; 0 - отправлять любые опоздавшие.
+type RemindersConfig struct {
+	Enabled  bool          `json:"enabled" yaml:"enabled"`
+	Notifier string        `json:"notifier" yaml:"notifier"`
+	MaxDelay Duration      `json:"max_delay" yaml:"max_delay"`
+	Webhook  WebhookConfig `json:"webhook" yaml:"webhook"`
+}
+
+// WebhookConfig - настройки отправки напоминаний POST запросом. Retries - число повторных попыток,
+// пауза между ними начинается с Backoff и удваивается после каждой попытки.
+type WebhookConfig struct {
+	URL     string   `json:"url" yaml:"url"`
+	Timeout Duration `json:"timeout" yaml:"timeout"`
+	Retries int      `json:"retries" yaml:"retries"`
+	Backoff Duration `json:"backoff" yaml:"backoff"`
+}
+
+// Notification - напоминание о начале события или его повторения
+type Notification struct {
+	EventId int       `json:"event_id"`
+	UserId  int       `json:"user_id"`
+	Name    string    `json:"name"`
+	Start   time.Time `json:"start"`
+	Before  Duration  `json:"before"`
+	FireAt  time.Time `json:"fire_at"`
+	Late    bool      `json:"late,omitempty"` // напоминание опоздало больше чем на lateAfter
+}
+
+// lateAfter - после какого опоздания напоминание помечается как опоздавшее
+const lateAfter = time.Minute
+
+// Notifier - способ доставки напоминаний
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// newNotifier - создает способ доставки по конфигурации
+func newNotifier(cfg RemindersConfig) (Notifier, error) {
+	switch cfg.Notifier {
+	case "", notifierLog:
+		return LogNotifier{}, nil
+	case notifierWebhook:
+		return &WebhookNotifier{
+			URL:     cfg.Webhook.URL,
+			Client:  &http.Client{Timeout: time.Duration(cfg.Webhook.Timeout)},
+			Retries: cfg.Webhook.Retries,
+			Backoff: time.Duration(cfg.Webhook.Backoff),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown notifier %q", cfg.Notifier)
+	}
+}
+
+// LogNotifier - пишет напоминания в лог
+type LogNotifier struct{}
+
+func (LogNotifier) Notify(_ context.Context, n Notification) error {
+	log.Printf("reminder: event %d %q of user %d starts at %s (in %s)", n.EventId, n.Name, n.UserId,
+		n.Start.Format(time.RFC3339), time.Duration(n.Before))
+	return nil
+}
+
+// WebhookNotifier - отправляет напоминания POST запросом с JSON телом. Сетевые ошибки, 5xx, 408 и 429
+// повторяются с экспоненциальной паузой, остальные ответы кроме 2xx считаются окончательной ошибкой.
+type WebhookNotifier struct {
+	URL     string
+	Client  *http.Client
+	Retries int
+	Backoff time.Duration
+}
+
+// permanentError - ошибка, которую бесполезно повторять
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (w *WebhookNotifier) Notify(ctx context.Context, n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	backoff := w.Backoff
+	for attempt := 0; ; attempt++ {
+		err = w.post(ctx, body)
+		var permanent *permanentError
+		if err == nil || errors.As(err, &permanent) || attempt >= w.Retries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w (last error: %v)", ctx.Err(), err)
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (w *WebhookNotifier) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return &permanentError{err: err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	default:
+		return &permanentError{err: fmt.Errorf("webhook responded %s", resp.Status)}
+	}
+}
+
+// reminderJob - запланированное напоминание, index - его позиция в очереди.
+// При изменении или удалении события его напоминания убираются из очереди по индексу.
+type reminderJob struct {
+	fireAt     time.Time
+	occurrence time.Time
+	before     time.Duration
+	eventId    int
+	index      int
+}
+
+// jobQueue - очередь напоминаний по времени отправки
+type jobQueue []*reminderJob
+
+func (q jobQueue) Len() int           { return len(q) }
+func (q jobQueue) Less(i, j int) bool { return q[i].fireAt.Before(q[j].fireAt) }
+func (q jobQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index, q[j].index = i, j
+}
+func (q *jobQueue) Push(x interface{}) {
+	job := x.(*reminderJob)
+	job.index = len(*q)
+	*q = append(*q, job)
+}
+func (q *jobQueue) Pop() interface{} {
+	old := *q
+	job := old[len(old)-1]
+	*q = old[:len(old)-1]
+	job.index = -1
+	return job
+}
+
+// nextFire - первое напоминание за before до начала события или его повторения, наступающее позже after
+func nextFire(event *Event, before time.Duration, after time.Time) (fireAt, occurrence time.Time, ok bool) {
+	start := time.Time(event.Start)
+	if event.RRule == nil {
+		fireAt = start.Add(-before)
+		return fireAt, start, fireAt.After(after)
+	}
+
+	// повторения ищутся в расширяющихся окнах, чтобы не перебирать далекое будущее частых серий;
+	// девяти лет хватает даже на ежегодное событие 29 февраля
+	from := after.Add(before)
+	for _, window := range []time.Duration{32 * 24 * time.Hour, 366 * 24 * time.Hour, 9 * 366 * 24 * time.Hour} {
+		event.RRule.Occurrences(start, event.ExDates, from, from.Add(window), func(t time.Time) {
+			if !ok && t.After(from) {
+				occurrence, ok = t, true
+			}
+		})
+		if ok {
+			return occurrence.Add(-before), occurrence, true
+		}
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+// Scheduler - планировщик напоминаний. Узнает об изменениях событий из хранилища и отправляет напоминания
+// в срок через Notifier. Время, до которого напоминания отправлены, сохраняется в statePath, поэтому после
+// перезапуска отправляются напоминания, пропущенные пока сервер был остановлен или прерванные остановкой,
+// и не повторяются отправленные.
+type Scheduler struct {
+	notifier  Notifier
+	statePath string
+	maxDelay  time.Duration
+	now       func() time.Time
+
+	mu     sync.Mutex
+	queue  jobQueue
+	events map[int]*Event         // события с напоминаниями в очереди
+	jobs   map[int][]*reminderJob // напоминания в очереди по id события
+	// watermark - время отправки последнего напоминания, планируются только более поздние
+	watermark time.Time
+	// inflight - количество начатых и еще не завершенных отправок по времени напоминания в UnixNano.
+	// В файл состояния попадает время перед самой ранней из них, чтобы прерванная отправка повторилась
+	// после перезапуска
+	inflight map[int64]int
+	saved    time.Time
+	// saveMu - упорядочивает запись файла состояния из цикла Run и из завершившихся отправок
+	saveMu sync.Mutex
+
+	wake       chan struct{}
+	deliveries sync.WaitGroup
+}
+
+// schedulerState - содержимое файла состояния планировщика
+type schedulerState struct {
+	FiredUntil time.Time `json:"fired_until"`
+}
+
+// NewScheduler - создает планировщик, statePath может быть пустым, если хранилище не сохраняется между запусками
+func NewScheduler(notifier Notifier, statePath string, maxDelay time.Duration) (*Scheduler, error) {
+	s := &Scheduler{
+		notifier:  notifier,
+		statePath: statePath,
+		maxDelay:  maxDelay,
+		now:       time.Now,
+		events:    map[int]*Event{},
+		jobs:      map[int][]*reminderJob{},
+		inflight:  map[int64]int{},
+		wake:      make(chan struct{}, 1),
+	}
+	s.watermark = s.now()
+
+	if statePath == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := schedulerState{}
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("read %s: %w", statePath, err)
+	}
+	s.watermark, s.saved = state.FiredUntil, state.FiredUntil
+	return s, nil
+}
+
+// Watch - подписывает планировщик на изменения хранилища и планирует напоминания существующих событий
+func (s *Scheduler) Watch(w Watcher) {
+	events := w.Watch(s.onChange)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, event := range events {
+		s.schedule(event, s.watermark)
+	}
+	s.signal()
+}
+
+func (s *Scheduler) onChange(c Change) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c.Op == opDelete {
+		s.unschedule(c.Event.Id)
+		s.signal()
+		return
+	}
+	// напоминания, время которых уже прошло к моменту сохранения события, не отправляются:
+	// иначе они приходили бы сразу после создания и заново после каждого изменения
+	after := s.now()
+	if s.watermark.After(after) {
+		after = s.watermark
+	}
+	s.schedule(c.Event, after)
+	s.signal()
+}
+
+// schedule - заменяет напоминания события в очереди ближайшими по его текущей версии с временем отправки
+// позже after, вызывается под блокировкой
+func (s *Scheduler) schedule(event *Event, after time.Time) {
+	s.unschedule(event.Id)
+	for _, before := range event.Reminders {
+		s.push(event, time.Duration(before), after)
+	}
+}
+
+// unschedule - убирает событие и его напоминания из очереди, вызывается под блокировкой
+func (s *Scheduler) unschedule(eventId int) {
+	for _, job := range s.jobs[eventId] {
+		heap.Remove(&s.queue, job.index)
+	}
+	delete(s.jobs, eventId)
+	delete(s.events, eventId)
+}
+
+func (s *Scheduler) push(event *Event, before time.Duration, after time.Time) {
+	if fireAt, occurrence, ok := nextFire(event, before, after); ok {
+		job := &reminderJob{
+			fireAt:     fireAt,
+			occurrence: occurrence,
+			before:     before,
+			eventId:    event.Id,
+		}
+		heap.Push(&s.queue, job)
+		s.jobs[event.Id] = append(s.jobs[event.Id], job)
+		s.events[event.Id] = event
+	}
+}
+
+// advance - переносит отправленное напоминание повторяющегося события на следующее повторение
+// или убирает его из очереди, вызывается под блокировкой
+func (s *Scheduler) advance(job *reminderJob, event *Event) {
+	if event.RRule != nil {
+		if fireAt, occurrence, ok := nextFire(event, job.before, job.fireAt); ok {
+			job.fireAt, job.occurrence = fireAt, occurrence
+			heap.Fix(&s.queue, job.index)
+			return
+		}
+	}
+
+	heap.Remove(&s.queue, job.index)
+	jobs := s.jobs[job.eventId]
+	for i := range jobs {
+		if jobs[i] == job {
+			jobs = append(jobs[:i], jobs[i+1:]...)
+			break
+		}
+	}
+	if len(jobs) == 0 {
+		delete(s.jobs, job.eventId)
+		delete(s.events, job.eventId)
+		return
+	}
+	s.jobs[job.eventId] = jobs
+}
+
+// signal - будит цикл Run, чтобы он пересчитал время ближайшего напоминания
+func (s *Scheduler) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run - отправляет напоминания до отмены ctx, затем дожидается начатых отправок и сохраняет состояние
+func (s *Scheduler) Run(ctx context.Context) error {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		if s.fireDue(ctx) {
+			continue
+		}
+
+		s.mu.Lock()
+		wait := time.Duration(-1)
+		if len(s.queue) > 0 {
+			wait = s.queue[0].fireAt.Sub(s.now())
+		}
+		s.mu.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		var fire <-chan time.Time
+		if wait >= 0 {
+			timer.Reset(wait)
+			fire = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			s.deliveries.Wait()
+			return s.saveState()
+		case <-s.wake:
+		case <-fire:
+		}
+	}
+}
+
+// fireDue - отправляет одно наступившее напоминание, false - если таких нет
+func (s *Scheduler) fireDue(ctx context.Context) bool {
+	s.mu.Lock()
+	now := s.now()
+	if len(s.queue) == 0 || s.queue[0].fireAt.After(now) {
+		s.mu.Unlock()
+		return false
+	}
+
+	job := *s.queue[0]
+	if job.fireAt.After(s.watermark) {
+		s.watermark = job.fireAt
+	}
+	event := s.events[job.eventId]
+	s.advance(s.queue[0], event)
+	s.mu.Unlock()
+
+	late := now.Sub(job.fireAt)
+	if s.maxDelay > 0 && late > s.maxDelay {
+		remindersTotal.Inc("skipped")
+		log.Printf("reminder for event %d at %s skipped: missed by %s", job.eventId, job.fireAt.Format(time.RFC3339), late.Round(time.Second))
+	} else {
+		n := Notification{
+			EventId: event.Id,
+			UserId:  event.UserId,
+			Name:    event.Name,
+			Start:   job.occurrence,
+			Before:  Duration(job.before),
+			FireAt:  job.fireAt,
+			Late:    late > lateAfter,
+		}
+		s.mu.Lock()
+		s.inflight[job.fireAt.UnixNano()]++
+		s.mu.Unlock()
+		s.deliveries.Add(1)
+		go s.deliver(ctx, n)
+	}
+
+	if err := s.saveState(); err != nil {
+		log.Printf("save reminders state: %v", err)
+	}
+	return true
+}
+
+// deliver - отправляет напоминание и отмечает отправку завершенной. Отправка, прерванная остановкой
+// планировщика, остается незавершенной и повторяется после перезапуска
+func (s *Scheduler) deliver(ctx context.Context, n Notification) {
+	defer s.deliveries.Done()
+
+	err := s.notifier.Notify(ctx, n)
+	if err != nil && ctx.Err() != nil {
+		log.Printf("reminder for event %d interrupted: %v", n.EventId, err)
+		return
+	}
+	if err != nil {
+		remindersTotal.Inc("failed")
+		log.Printf("reminder for event %d: %v", n.EventId, err)
+	} else {
+		remindersTotal.Inc("sent")
+	}
+
+	s.mu.Lock()
+	key := n.FireAt.UnixNano()
+	if s.inflight[key]--; s.inflight[key] == 0 {
+		delete(s.inflight, key)
+	}
+	s.mu.Unlock()
+
+	if err = s.saveState(); err != nil {
+		log.Printf("save reminders state: %v", err)
+	}
+}
+
+// firedUntil - время, до которого включительно все напоминания отправлены: watermark, если незавершенных
+// отправок нет, иначе момент перед самой ранней из них. Вызывается под блокировкой
+func (s *Scheduler) firedUntil() time.Time {
+	until := s.watermark
+	for key := range s.inflight {
+		if t := time.Unix(0, key).Add(-time.Nanosecond); t.Before(until) {
+			until = t
+		}
+	}
+	return until
+}
+
+// saveState - сохраняет время, до которого отправлены напоминания, файл заменяется целиком через переименование
+func (s *Scheduler) saveState() error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	s.mu.Lock()
+	watermark := s.firedUntil()
+	changed := !watermark.Equal(s.saved)
+	s.mu.Unlock()
+
+	if s.statePath == "" || !changed {
+		return nil
+	}
+
+	data, err := json.Marshal(schedulerState{FiredUntil: watermark})
+	if err != nil {
+		return err
+	}
+	tmp := s.statePath + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, s.statePath); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.saved = watermark
+	s.mu.Unlock()
+	return nil
+}
+
+// remindersStatePath - путь к файлу состояния планировщика, если хранилище сохраняется на диск
+func remindersStatePath(cfg StorageConfig) string {
+	if cfg.Type != storageFile {
+		return ""
+	}
+	return filepath.Join(cfg.Path, remindersStateFile)
+}
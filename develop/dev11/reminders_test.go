@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingNotifier - запоминает отправленные напоминания
+type recordingNotifier struct {
+	mu   sync.Mutex
+	sent []Notification
+}
+
+func (r *recordingNotifier) Notify(_ context.Context, n Notification) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sent = append(r.sent, n)
+	return nil
+}
+
+func (r *recordingNotifier) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.sent)
+}
+
+func TestNextFire(t *testing.T) {
+	start := time.Date(2022, 5, 10, 9, 0, 0, 0, time.UTC)
+	before := 15 * time.Minute
+	event := &Event{Start: jsonTime(start)}
+
+	fireAt, _, ok := nextFire(event, before, start.Add(-time.Hour))
+	assert.True(t, ok)
+	assert.Equal(t, start.Add(-before), fireAt)
+
+	_, _, ok = nextFire(event, before, start)
+	assert.False(t, ok)
+
+	rule, err := ParseRecurrence("FREQ=WEEKLY")
+	assert.NoError(t, err)
+	event.RRule = rule
+	fireAt, occurrence, ok := nextFire(event, before, start)
+	assert.True(t, ok)
+	assert.Equal(t, start.AddDate(0, 0, 7), occurrence)
+	assert.Equal(t, occurrence.Add(-before), fireAt)
+}
+
+// TestScheduler - напоминания отправляются по часам планировщика, которые тест переводит сам
+func TestScheduler(t *testing.T) {
+	state := filepath.Join(t.TempDir(), remindersStateFile)
+	storage := NewStorage()
+	notifier := &recordingNotifier{}
+
+	scheduler, err := NewScheduler(notifier, state, time.Hour)
+	require.NoError(t, err)
+	now := scheduler.watermark
+	scheduler.now = func() time.Time { return now }
+	scheduler.Watch(storage)
+
+	fire := func() (names []string) {
+		for scheduler.fireDue(context.Background()) {
+		}
+		scheduler.deliveries.Wait()
+		for _, n := range notifier.sent {
+			names = append(names, n.Name)
+		}
+		return names
+	}
+	create := func(name string, start time.Duration, before time.Duration) *Event {
+		event := &Event{UserId: 1, Name: name, Start: jsonTime(now.Add(start)), Reminders: []Duration{Duration(before)}}
+		require.NoError(t, storage.Create(event, nil))
+		return event
+	}
+
+	create("soon", time.Hour, 15*time.Minute)
+	// напоминания удаленного события убираются из очереди
+	deleted := create("deleted", time.Hour, 10*time.Minute)
+	require.NoError(t, storage.Delete(deleted.Id, 0, nil))
+	// при изменении события его старые напоминания заменяются новыми
+	moved := create("moved", time.Hour, 10*time.Minute)
+	moved.Start = jsonTime(now.Add(3 * time.Hour))
+	require.NoError(t, storage.Update(moved, nil))
+	assert.Len(t, scheduler.queue, 2)
+	assert.Empty(t, fire())
+
+	now = now.Add(time.Hour)
+	assert.Equal(t, []string{"soon"}, fire())
+	assert.Len(t, scheduler.queue, 1)
+
+	// напоминание, время которого прошло до сохранения события, не отправляется ни сразу, ни после изменения
+	past := create("past", 5*time.Minute, 15*time.Minute)
+	past.Name = "past edited"
+	require.NoError(t, storage.Update(past, nil))
+	assert.Equal(t, []string{"soon"}, fire())
+	assert.Len(t, scheduler.queue, 1)
+
+	// напоминание повторяющегося события переносится на следующее повторение
+	daily := create("daily", time.Hour, 0)
+	daily.RRule, err = ParseRecurrence("FREQ=DAILY")
+	require.NoError(t, err)
+	require.NoError(t, storage.Update(daily, nil))
+	now = now.Add(time.Hour)
+	assert.Equal(t, []string{"soon", "daily"}, fire())
+	assert.Len(t, scheduler.queue, 2)
+	assert.Equal(t, now.AddDate(0, 0, 1), scheduler.jobs[daily.Id][0].occurrence)
+
+	now = now.Add(time.Hour)
+	assert.Equal(t, []string{"soon", "daily", "moved"}, fire())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.NoError(t, scheduler.Run(ctx))
+
+	// после перезапуска отправленные напоминания не повторяются
+	restarted, err := NewScheduler(notifier, state, time.Hour)
+	require.NoError(t, err)
+	restarted.now = scheduler.now
+	restarted.Watch(storage)
+	assert.False(t, restarted.fireDue(context.Background()))
+	assert.Len(t, restarted.queue, 1)
+}
+
+// blockingNotifier - отправляет напоминания только после закрытия release, до этого ждет отмены ctx
+type blockingNotifier struct {
+	recordingNotifier
+	release chan struct{}
+}
+
+func (b *blockingNotifier) Notify(ctx context.Context, n Notification) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-b.release:
+		return b.recordingNotifier.Notify(ctx, n)
+	}
+}
+
+// TestSchedulerInterrupted - отправка, прерванная остановкой планировщика, повторяется после перезапуска
+func TestSchedulerInterrupted(t *testing.T) {
+	state := filepath.Join(t.TempDir(), remindersStateFile)
+	storage := NewStorage()
+	notifier := &blockingNotifier{release: make(chan struct{})}
+
+	scheduler, err := NewScheduler(notifier, state, time.Hour)
+	require.NoError(t, err)
+	now := scheduler.watermark
+	scheduler.now = func() time.Time { return now }
+	scheduler.Watch(storage)
+	require.NoError(t, storage.Create(&Event{UserId: 1, Name: "standup", Start: jsonTime(now.Add(time.Hour)),
+		Reminders: []Duration{Duration(15 * time.Minute)}}, nil))
+
+	now = now.Add(time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	require.True(t, scheduler.fireDue(ctx))
+	cancel()
+	require.NoError(t, scheduler.Run(ctx))
+	assert.Zero(t, notifier.count())
+
+	close(notifier.release)
+	restarted, err := NewScheduler(notifier, state, time.Hour)
+	require.NoError(t, err)
+	restarted.now = scheduler.now
+	restarted.Watch(storage)
+	require.True(t, restarted.fireDue(context.Background()))
+	restarted.deliveries.Wait()
+	assert.Equal(t, 1, notifier.count())
+}
+
+func TestWebhookRetry(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			atomic.AddInt32(&calls, 1)
+			http.NotFound(w, r)
+			return
+		}
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	notifier := &WebhookNotifier{URL: server.URL, Client: server.Client(), Retries: 5, Backoff: time.Millisecond}
+	assert.NoError(t, notifier.Notify(context.Background(), Notification{EventId: 1}))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	// на ошибку клиента повтор не делается
+	notifier.URL = server.URL + "/missing"
+	atomic.StoreInt32(&calls, 0)
+	assert.Error(t, notifier.Notify(context.Background(), Notification{EventId: 1}))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
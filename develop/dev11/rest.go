@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// API v2: события пользователя как ресурсы
+//
+//	GET    /v2/users/{user_id}/events?from=&to=&tz=  список событий, без from и to - все события;
+//	                                                 q - поиск по словам названия, name - по подстроке,
+//	                                                 limit и cursor - постраничная выдача
+//	POST   /v2/users/{user_id}/events                создание, 201 и Location нового события
+//	GET    /v2/users/{user_id}/events/{id}           событие, If-None-Match - 304 если не изменилось
+//	PUT    /v2/users/{user_id}/events/{id}           замена события
+//	PATCH  /v2/users/{user_id}/events/{id}           частичное изменение в формате JSON merge patch
+//	DELETE /v2/users/{user_id}/events/{id}           удаление, 204
+//
+// ETag события - его версия. If-Match в PUT, PATCH и DELETE задает ожидаемую версию,
+// при несовпадении возвращается 412. Чужие и несуществующие события отдаются с 404.
+
+// etag - ETag события по его версии
+func etag(event *Event) string {
+	return `"` + strconv.Itoa(event.Version) + `"`
+}
+
+// matchETag - совпадает ли ETag события со списком из заголовка If-Match или If-None-Match
+func matchETag(header string, event *Event) bool {
+	tag := etag(event)
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// ifMatch - ожидаемая версия события из If-Match. Без заголовка подставляется текущая версия,
+// чтобы событие не изменилось между проверкой доступа и записью.
+func ifMatch(r *http.Request, current *Event) (int, error) {
+	header := r.Header.Get("If-Match")
+	if header != "" && !matchETag(header, current) {
+		return 0, fmt.Errorf("%w: current version is %d", ErrConflict, current.Version)
+	}
+	return current.Version, nil
+}
+
+// pathInt - целочисленный параметр пути
+func pathInt(r *http.Request, name string) (int, error) {
+	n, err := strconv.Atoi(pathParam(r, name))
+	if err != nil || n < 0 {
+		return 0, invalid(name, "wrong "+name)
+	}
+	return n, nil
+}
+
+// pathUser - пользователь из пути с проверкой доступа к его событиям
+func pathUser(r *http.Request) (int, error) {
+	userId, err := pathInt(r, "user_id")
+	if err != nil {
+		return 0, err
+	}
+	return userId, authorize(r, userId)
+}
+
+// userEvent - событие из пути. Событие другого пользователя считается несуществующим,
+// чтобы по ответу нельзя было узнать о чужих событиях.
+func (s *eventServer) userEvent(r *http.Request) (*Event, error) {
+	return s.pathEvent(r, false)
+}
+
+// visibleEvent - событие из пути, которое пользователь видит в календаре: свое или то, в которое он приглашен
+func (s *eventServer) visibleEvent(r *http.Request) (*Event, error) {
+	return s.pathEvent(r, true)
+}
+
+// pathEvent - событие из пути, withInvites - считать своими и события, в которые пользователь приглашен
+func (s *eventServer) pathEvent(r *http.Request, withInvites bool) (*Event, error) {
+	userId, err := pathUser(r)
+	if err != nil {
+		return nil, err
+	}
+	id, err := pathInt(r, "id")
+	if err != nil {
+		return nil, err
+	}
+
+	event, err := s.storage.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if event.UserId != userId && !(withInvites && event.involves(userId)) {
+		return nil, ErrNotFound
+	}
+	return event, nil
+}
+
+// eventLocation - адрес ресурса события
+func eventLocation(event *Event) string {
+	return fmt.Sprintf("/v2/users/%d/events/%d", event.UserId, event.Id)
+}
+
+// resourceResponse - ответ {"result": событие} с его ETag
+func resourceResponse(w http.ResponseWriter, status int, event *Event) {
+	w.Header().Set("ETag", etag(event))
+	writeJSON(w, status, map[string]interface{}{"result": event})
+}
+
+// parseRange - необязательный интервал [from, to) из query string, даты без пояса интерпретируются в поясе tz,
+// а если он не задан - в поясе loc
+func parseRange(r *http.Request, loc *time.Location) (from, to time.Time, err error) {
+	query := r.URL.Query()
+	if query.Get("from") == "" && query.Get("to") == "" {
+		return time.Time{}, time.Time{}, nil
+	}
+
+	v := &validator{}
+	v.check(query.Get("from") != "", "from", "from is required with to")
+	v.check(query.Get("to") != "", "to", "to is required with from")
+	if err = v.err(); err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	if tz := query.Get("tz"); tz != "" {
+		if tzLoc, err := time.LoadLocation(tz); err == nil {
+			loc = tzLoc
+		} else {
+			v.add("tz", err.Error())
+		}
+	}
+	from, _, err = parseEventTime(query.Get("from"), loc)
+	v.check(err == nil, "from", "wrong from")
+	to, _, err = parseEventTime(query.Get("to"), loc)
+	v.check(err == nil, "to", "wrong to")
+	if err = v.err(); err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	if !to.After(from) {
+		return time.Time{}, time.Time{}, invalid("to", "to must be after from")
+	}
+	return from, to, nil
+}
+
+// ListEventsHandler - события пользователя в интервале или все его события, по страницам
+func (s *eventServer) ListEventsHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := pathUser(r)
+	if err != nil {
+		restErrorResponse(w, err)
+		return
+	}
+	from, to, err := parseRange(r, s.location)
+	if err != nil {
+		restErrorResponse(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+	v := &validator{}
+	page := parsePage(query, defaultPageLimit, v)
+	if err = v.err(); err != nil {
+		restErrorResponse(w, err)
+		return
+	}
+
+	var events []*Event
+	switch {
+	case query.Get("q") != "":
+		events = s.storage.Search(userId, query.Get("q"), from, to)
+	case from.IsZero():
+		events = s.storage.GetAll(userId)
+	default:
+		events = s.storage.GetRange(userId, from, to)
+	}
+
+	pageResponse(w, events, page)
+}
+
+// PostEventHandler - создает событие пользователя из пути
+func (s *eventServer) PostEventHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := pathUser(r)
+	if err != nil {
+		restErrorResponse(w, err)
+		return
+	}
+	event, err := parseEvent(r, s.location)
+	if err != nil {
+		restErrorResponse(w, err)
+		return
+	}
+	if event.UserId != 0 && event.UserId != userId {
+		restErrorResponse(w, invalid("user_id", "user_id does not match path"))
+		return
+	}
+
+	event.UserId = userId
+	if err = s.saveEvent(r, opCreate, event); err != nil {
+		restErrorResponse(w, err)
+		return
+	}
+
+	w.Header().Set("Location", eventLocation(event))
+	resourceResponse(w, http.StatusCreated, event)
+}
+
+// GetEventHandler - событие по id, участники тоже могут его получить
+func (s *eventServer) GetEventHandler(w http.ResponseWriter, r *http.Request) {
+	event, err := s.visibleEvent(r)
+	if err != nil {
+		restErrorResponse(w, err)
+		return
+	}
+
+	if header := r.Header.Get("If-None-Match"); header != "" && matchETag(header, event) {
+		w.Header().Set("ETag", etag(event))
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	resourceResponse(w, http.StatusOK, event)
+}
+
+// PutEventHandler - заменяет событие целиком
+func (s *eventServer) PutEventHandler(w http.ResponseWriter, r *http.Request) {
+	current, err := s.userEvent(r)
+	if err != nil {
+		restErrorResponse(w, err)
+		return
+	}
+	event, err := parseEvent(r, s.location)
+	if err != nil {
+		restErrorResponse(w, err)
+		return
+	}
+	if event.UserId != 0 && event.UserId != current.UserId {
+		restErrorResponse(w, invalid("user_id", "user_id does not match path"))
+		return
+	}
+
+	event.Id, event.UserId = current.Id, current.UserId
+	if event.Version, err = ifMatch(r, current); err == nil {
+		err = s.saveEvent(r, opUpdate, event)
+	}
+	if err != nil {
+		restErrorResponse(w, err)
+		return
+	}
+
+	resourceResponse(w, http.StatusOK, event)
+}
+
+// PatchEventHandler - меняет только переданные поля события. Если передано новое начало без конца,
+// событие сдвигается целиком с сохранением длительности.
+func (s *eventServer) PatchEventHandler(w http.ResponseWriter, r *http.Request) {
+	current, err := s.userEvent(r)
+	if err != nil {
+		restErrorResponse(w, err)
+		return
+	}
+	event, err := applyPatch(r, current, s.location)
+	if err != nil {
+		restErrorResponse(w, err)
+		return
+	}
+
+	if event.Version, err = ifMatch(r, current); err == nil {
+		err = s.saveEvent(r, opUpdate, event)
+	}
+	if err != nil {
+		restErrorResponse(w, err)
+		return
+	}
+
+	resourceResponse(w, http.StatusOK, event)
+}
+
+// applyPatch - применяет JSON merge patch из тела запроса к копии события.
+// Событие без пояса получает пояс loc, как при создании
+func applyPatch(r *http.Request, current *Event, loc *time.Location) (*Event, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/merge-patch+json" {
+		format, err := bodyFormat(r)
+		if err != nil {
+			return nil, err
+		}
+		if format != bodyJSON {
+			return nil, invalid("Content-Type", "patch must be a JSON object")
+		}
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, invalidInput("", err)
+	}
+	fields := map[string]json.RawMessage{}
+	if err = json.Unmarshal(body, &fields); err != nil {
+		return nil, invalidInput("", err)
+	}
+
+	// null по RFC 7396 удаляет поле: начало у события обязательно, а конец сбрасывается на значение по умолчанию
+	for _, field := range []string{"start", "date"} {
+		if string(fields[field]) == "null" {
+			return nil, invalid(field, field+" is required")
+		}
+	}
+
+	event := current.clone()
+	if event.TimeZone == "" {
+		event.TimeZone = loc.String()
+	}
+	_, startChanged := fields["start"]
+	if _, ok := fields["date"]; ok {
+		startChanged = true
+	}
+	end, endChanged := fields["end"]
+	if startChanged {
+		// признак события на весь день определяется заново по формату нового начала
+		event.AllDay = false
+	}
+	if string(end) == "null" {
+		event.End = jsonTime{}
+	}
+
+	if err = json.Unmarshal(body, event); err != nil {
+		return nil, invalidInput("", err)
+	}
+	event.Id, event.UserId = current.Id, current.UserId
+	if startChanged && !endChanged {
+		// событие сдвигается с сохранением длительности, а при смене типа (весь день или время)
+		// получает длительность по умолчанию
+		if event.AllDay == current.AllDay {
+			event.End = jsonTime(time.Time(event.Start).Add(current.duration()))
+		} else {
+			event.End = jsonTime{}
+		}
+	}
+
+	v := &validator{}
+	validateEvent(event, v)
+	if err = v.err(); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// DeleteEventV2Handler - удаляет событие
+func (s *eventServer) DeleteEventV2Handler(w http.ResponseWriter, r *http.Request) {
+	current, err := s.userEvent(r)
+	if err != nil {
+		restErrorResponse(w, err)
+		return
+	}
+
+	version, err := ifMatch(r, current)
+	if err == nil {
+		_, err = s.mutate(r, Operation{Op: opDelete, Id: current.Id, Version: version})
+	}
+	if err != nil {
+		restErrorResponse(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
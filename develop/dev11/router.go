@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// route - обработчик для метода и шаблона пути. Сегменты шаблона вида {name} совпадают с любым
+// непустым сегментом пути и доступны обработчику через pathParam.
+type route struct {
+	method   string
+	pattern  string
+	segments []string
+	handler  http.Handler
+}
+
+// router - маршрутизатор с проверкой метода: если путь найден, а метод нет, отвечает 405 с заголовком Allow.
+// Стандартный ServeMux в go 1.18 не умеет ни шаблонов в пути, ни методов.
+type router struct {
+	routes []route
+}
+
+func newRouter() *router {
+	return &router{}
+}
+
+func splitPath(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
+
+// Handle - регистрирует обработчик для метода и шаблона пути
+func (rt *router) Handle(method, pattern string, handler http.Handler) {
+	rt.routes = append(rt.routes, route{method: method, pattern: pattern, segments: splitPath(pattern), handler: handler})
+}
+
+// HandleFunc - то же что Handle для функции
+func (rt *router) HandleFunc(method, pattern string, handler http.HandlerFunc) {
+	rt.Handle(method, pattern, handler)
+}
+
+// match - сопоставляет путь с шаблоном и возвращает параметры пути
+func (r route) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(r.segments) {
+		return nil, false
+	}
+
+	var params map[string]string
+	for i, segment := range r.segments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			if segments[i] == "" {
+				return nil, false
+			}
+			if params == nil {
+				params = map[string]string{}
+			}
+			params[segment[1:len(segment)-1]] = segments[i]
+			continue
+		}
+		if segment != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments := splitPath(r.URL.Path)
+	method := r.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+
+	var allowed []string
+	for _, route := range rt.routes {
+		params, ok := route.match(segments)
+		if !ok {
+			continue
+		}
+		if route.method != method {
+			allowed = append(allowed, route.method)
+			continue
+		}
+
+		if params != nil {
+			r = r.WithContext(context.WithValue(r.Context(), routeParamsKey, params))
+		}
+		route.handler.ServeHTTP(w, r)
+		return
+	}
+
+	if len(allowed) > 0 {
+		sort.Strings(allowed)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		errorResponse(w, ErrMethodNotAllowed)
+		return
+	}
+	errorResponse(w, ErrRouteNotFound)
+}
+
+// pattern - шаблон маршрута, которому соответствует путь, или пустая строка
+func (rt *router) pattern(path string) string {
+	segments := splitPath(path)
+	for _, route := range rt.routes {
+		if _, ok := route.match(segments); ok {
+			return route.pattern
+		}
+	}
+	return ""
+}
+
+// pathParam - значение параметра пути текущего маршрута
+func pathParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(routeParamsKey).(map[string]string)
+	return params[name]
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// tokenize - слова названия в нижнем регистре без повторов. Словом считается последовательность букв и цифр.
+func tokenize(s string) []string {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	seen := make(map[string]bool, len(words))
+	tokens := words[:0]
+	for _, word := range words {
+		if !seen[word] {
+			seen[word] = true
+			tokens = append(tokens, word)
+		}
+	}
+	return tokens
+}
+
+// nameIndex - обратный индекс по названиям событий: пользователь -> слово -> id событий.
+// Индекс отдельный для каждого пользователя, чтобы поиск не касался чужих событий.
+// Индекс не потокобезопасен, синхронизация лежит на хранилище.
+type nameIndex struct {
+	users map[int]map[string]map[int]struct{}
+}
+
+func newNameIndex() *nameIndex {
+	return &nameIndex{users: map[int]map[string]map[int]struct{}{}}
+}
+
+// Add - индексирует название события
+func (idx *nameIndex) Add(event *Event) {
+	words := idx.users[event.UserId]
+	if words == nil {
+		words = map[string]map[int]struct{}{}
+		idx.users[event.UserId] = words
+	}
+
+	for _, token := range tokenize(event.Name) {
+		if words[token] == nil {
+			words[token] = map[int]struct{}{}
+		}
+		words[token][event.Id] = struct{}{}
+	}
+}
+
+// Remove - убирает событие из индекса
+func (idx *nameIndex) Remove(event *Event) {
+	words := idx.users[event.UserId]
+	for _, token := range tokenize(event.Name) {
+		delete(words[token], event.Id)
+		if len(words[token]) == 0 {
+			delete(words, token)
+		}
+	}
+	if len(words) == 0 {
+		delete(idx.users, event.UserId)
+	}
+}
+
+// Lookup - id событий пользователя, в названии которых есть все слова запроса
+func (idx *nameIndex) Lookup(userId int, tokens []string) []int {
+	words := idx.users[userId]
+	if len(tokens) == 0 || words == nil {
+		return nil
+	}
+
+	// пересечение начинается с самого короткого списка
+	smallest := words[tokens[0]]
+	for _, token := range tokens[1:] {
+		if len(words[token]) < len(smallest) {
+			smallest = words[token]
+		}
+	}
+
+	var ids []int
+	for id := range smallest {
+		found := true
+		for _, token := range tokens {
+			if _, ok := words[token][id]; !ok {
+				found = false
+				break
+			}
+		}
+		if found {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,784 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Storage - интерфейс хранилища событий, от него зависят обработчики сервера
+type Storage interface {
+	Get(id int) (*Event, error)
+	GetByDAVName(userId int, name string) (*Event, error)
+	Create(event *Event, actor *int) error
+	Update(event *Event, actor *int) error
+	Delete(eventId, version int, actor *int) error
+	GetRange(userId int, from, to time.Time) []*Event
+	GetAll(userId int) []*Event
+	Search(userId int, query string, from, to time.Time) []*Event
+	Apply(ops []Operation) error
+	Invitations(userId int) []*Event
+	Respond(eventId, userId int, status string) (*Event, error)
+	Deleted(id int) (*Event, error)
+	History(id int) ([]AuditEntry, error)
+}
+
+// Flusher - хранилище, которое нужно сбросить на диск перед остановкой сервера
+type Flusher interface {
+	Flush() error
+}
+
+// HealthChecker - хранилище, которое может сообщить о своей неработоспособности
+type HealthChecker interface {
+	Health() error
+}
+
+// StorageStats - размер хранилища для метрик. Journal* заполняются только для хранилища на диске.
+type StorageStats struct {
+	Events         int
+	Recurring      int
+	Deleted        int
+	Users          int
+	Persistent     bool
+	JournalBytes   int64
+	JournalRecords int
+}
+
+// StatsReporter - хранилище, которое сообщает свой размер
+type StatsReporter interface {
+	Stats() StorageStats
+}
+
+// Watcher - хранилище, которое сообщает об изменениях событий
+type Watcher interface {
+	Watch(fn func(Change)) []*Event
+}
+
+// closeStorage - сбрасывает и закрывает хранилище, если оно это поддерживает
+func closeStorage(s Storage) error {
+	if f, ok := s.(Flusher); ok {
+		if err := f.Flush(); err != nil {
+			return err
+		}
+	}
+	if c, ok := s.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// типы хранилищ
+const (
+	storageMemory = "memory"
+	storageFile   = "file"
+)
+
+// StorageConfig - настройки хранилища
+type StorageConfig struct {
+	Type         string `json:"type" yaml:"type"`
+	Path         string `json:"path" yaml:"path"`
+	CompactEvery int    `json:"compact_every" yaml:"compact_every"`
+
+	// Retention - сколько удаленные события можно восстановить и сколько хранится история изменений,
+	// 0 - удаление сразу окончательное, история не хранится
+	Retention Duration `json:"retention" yaml:"retention"`
+}
+
+// newStorage - создает хранилище по конфигурации, события без пояса из файлов хранилища читаются в поясе loc
+func newStorage(cfg StorageConfig, loc *time.Location) (Storage, error) {
+	switch cfg.Type {
+	case "", storageMemory:
+		s := NewStorage()
+		s.retention = time.Duration(cfg.Retention)
+		return s, nil
+	case storageFile:
+		f, err := NewFileStorage(cfg.Path, cfg.CompactEvery, loc)
+		if err != nil {
+			return nil, err
+		}
+		f.retention = time.Duration(cfg.Retention)
+		return f, nil
+	default:
+		return nil, fmt.Errorf("unknown storage type %q", cfg.Type)
+	}
+}
+
+// операции над событиями, которые попадают в журнал
+const (
+	opCreate  = "create"
+	opUpdate  = "update"
+	opDelete  = "delete"
+	opRestore = "restore"
+	opBatch   = "batch"
+)
+
+// record - запись об изменении хранилища. Пакет изменений пишется одной записью с вложенными Batch,
+// поэтому после сбоя он либо восстанавливается целиком, либо отбрасывается.
+// Actor и At - кто и когда сделал изменение, по ним восстанавливается история событий.
+type record struct {
+	Seq   int       `json:"seq"`
+	Op    string    `json:"op"`
+	Id    int       `json:"id,omitempty"`
+	Event *Event    `json:"event,omitempty"`
+	Batch []record  `json:"batch,omitempty"`
+	Actor int       `json:"actor,omitempty"`
+	At    time.Time `json:"at"`
+}
+
+// Operation - операция пакетного изменения: Op - opCreate, opUpdate, opDelete или opRestore.
+// Для создания и изменения задается Event, для удаления - Id и ожидаемая Version (0 - без проверки),
+// для восстановления удаленного события - Id.
+// RejectOverlaps - не создавать и не изменять событие, если оно пересечется с другим событием владельца.
+// Actor - пользователь, от имени которого выполняется операция, nil - владелец события.
+type Operation struct {
+	Op             string
+	Event          *Event
+	Id             int
+	Version        int
+	RejectOverlaps bool
+	Actor          *int
+}
+
+// BatchError - ошибка операции пакета с индексом Index, из-за которой пакет не применен
+type BatchError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("operation %d: %v", e.Index, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// Change - изменение события: Op - операция из opCreate, opUpdate, opDelete,
+// Event - новое состояние события, для удаления - удаленное событие,
+// Previous - состояние до изменения для opUpdate, по нему видно, кого убрали из участников
+type Change struct {
+	Op       string
+	Event    *Event
+	Previous *Event
+}
+
+// EventLocalStorage - хранилище данных о событиях, key - id, value - событие
+type EventLocalStorage struct {
+	sync.RWMutex
+
+	events  map[int]*Event
+	index   *eventIndex               // события упорядоченные по пользователю и дате
+	series  map[int]map[int]*Event    // повторяющиеся события: userId -> id -> событие
+	invites map[int]map[int]*Event    // приглашения: userId участника -> id -> событие
+	dav     map[int]map[string]*Event // ресурсы CalDAV: userId -> DAVName -> событие
+	names   *nameIndex                // обратный индекс по словам названий
+	nextId  int                       // последний выданный id, id выдаются монотонно и не переиспользуются
+
+	// longest - самая большая длительность неповторяющихся событий пользователя, на нее расширяется
+	// поиск по индексу, чтобы найти события, начавшиеся раньше окна и пересекающие его.
+	// durations - сколько событий каждой длительности у пользователя, по ним longest уменьшается при удалении.
+	longest   map[int]time.Duration
+	durations map[int]map[time.Duration]int
+
+	// journal вызывается под блокировкой перед применением изменения,
+	// если он вернул ошибку - изменение не применяется
+	journal func(rec record) error
+
+	// watchers вызываются под блокировкой после применения изменения
+	watchers []func(Change)
+
+	deleted   map[int]*deletedEvent // удаленные события, которые еще можно восстановить
+	retention time.Duration         // сколько хранятся удаленные события
+	history   map[int][]AuditEntry  // история изменений по id события
+	auditSeq  int                   // номер последней записи истории
+	now       func() time.Time
+}
+
+func NewStorage() *EventLocalStorage {
+	return &EventLocalStorage{
+		events:  map[int]*Event{},
+		index:   newEventIndex(),
+		series:  map[int]map[int]*Event{},
+		invites: map[int]map[int]*Event{},
+		dav:     map[int]map[string]*Event{},
+		names:   newNameIndex(),
+		deleted: map[int]*deletedEvent{},
+		history: map[int][]AuditEntry{},
+
+		longest:   map[int]time.Duration{},
+		durations: map[int]map[time.Duration]int{},
+		retention: defaultRetention,
+		now:       time.Now,
+	}
+}
+
+// put - кладет событие в map и индекс, заменяя предыдущую версию.
+// Повторяющиеся события не индексируются по дате, а разворачиваются при выборке.
+func (s *EventLocalStorage) put(event *Event) {
+	s.remove(event.Id)
+	s.events[event.Id] = event
+	s.names.Add(event)
+	for _, a := range event.Attendees {
+		if s.invites[a.UserId] == nil {
+			s.invites[a.UserId] = map[int]*Event{}
+		}
+		s.invites[a.UserId][event.Id] = event
+	}
+	if event.DAVName != "" {
+		if s.dav[event.UserId] == nil {
+			s.dav[event.UserId] = map[string]*Event{}
+		}
+		s.dav[event.UserId][event.DAVName] = event
+	}
+
+	if event.RRule != nil {
+		if s.series[event.UserId] == nil {
+			s.series[event.UserId] = map[int]*Event{}
+		}
+		s.series[event.UserId][event.Id] = event
+		return
+	}
+	s.index.Insert(keyFor(event.UserId, time.Time(event.Start), event.Id), event)
+	s.addDuration(event.UserId, event.duration())
+}
+
+// remove - убирает событие из map и индекса
+func (s *EventLocalStorage) remove(id int) {
+	old, exist := s.events[id]
+	if !exist {
+		return
+	}
+	delete(s.events, id)
+	s.names.Remove(old)
+	for _, a := range old.Attendees {
+		delete(s.invites[a.UserId], id)
+		if len(s.invites[a.UserId]) == 0 {
+			delete(s.invites, a.UserId)
+		}
+	}
+	if old.DAVName != "" {
+		delete(s.dav[old.UserId], old.DAVName)
+		if len(s.dav[old.UserId]) == 0 {
+			delete(s.dav, old.UserId)
+		}
+	}
+
+	if old.RRule != nil {
+		delete(s.series[old.UserId], id)
+		if len(s.series[old.UserId]) == 0 {
+			delete(s.series, old.UserId)
+		}
+		return
+	}
+	s.index.Delete(keyFor(old.UserId, time.Time(old.Start), old.Id))
+	s.removeDuration(old.UserId, old.duration())
+}
+
+// addDuration - учитывает длительность нового события пользователя
+func (s *EventLocalStorage) addDuration(userId int, d time.Duration) {
+	if s.durations[userId] == nil {
+		s.durations[userId] = map[time.Duration]int{}
+	}
+	s.durations[userId][d]++
+	if d > s.longest[userId] {
+		s.longest[userId] = d
+	}
+}
+
+// removeDuration - забывает длительность удаленного события. Если это было последнее самое длинное событие
+// пользователя, longest пересчитывается по оставшимся длительностям.
+func (s *EventLocalStorage) removeDuration(userId int, d time.Duration) {
+	counts := s.durations[userId]
+	if counts[d]--; counts[d] > 0 {
+		return
+	}
+	delete(counts, d)
+	if len(counts) == 0 {
+		delete(s.durations, userId)
+		delete(s.longest, userId)
+		return
+	}
+	if d < s.longest[userId] {
+		return
+	}
+
+	longest := time.Duration(0)
+	for other := range counts {
+		if other > longest {
+			longest = other
+		}
+	}
+	s.longest[userId] = longest
+}
+
+// commit - передает изменение в журнал, если он задан
+func (s *EventLocalStorage) commit(rec record) error {
+	if s.journal == nil {
+		return nil
+	}
+	return s.journal(rec)
+}
+
+// notify - сообщает об изменении подписчикам
+func (s *EventLocalStorage) notify(op string, event, previous *Event) {
+	for _, fn := range s.watchers {
+		fn(Change{Op: op, Event: event, Previous: previous})
+	}
+}
+
+// Watch - подписывает fn на изменения и возвращает события, существующие на момент подписки,
+// так что ни одно изменение не теряется между выборкой и подпиской. fn вызывается под блокировкой
+// хранилища, поэтому должна быть быстрой и не должна обращаться к хранилищу.
+func (s *EventLocalStorage) Watch(fn func(Change)) []*Event {
+	s.Lock()
+	defer s.Unlock()
+
+	s.watchers = append(s.watchers, fn)
+	events := make([]*Event, 0, len(s.events))
+	for _, event := range s.events {
+		events = append(events, event)
+	}
+	return events
+}
+
+// apply - применяет запись к хранилищу без проверок и дописывает ее в историю события.
+// Используется и для проверенных изменений после записи в журнал, и при восстановлении из журнала.
+func (s *EventLocalStorage) apply(rec record) error {
+	switch rec.Op {
+	case opCreate, opUpdate, opRestore:
+		if rec.Event == nil {
+			return errors.New("record without event")
+		}
+		before := s.events[rec.Event.Id]
+		if d, ok := s.deleted[rec.Event.Id]; ok {
+			before = d.Event
+			delete(s.deleted, rec.Event.Id)
+		}
+		s.put(rec.Event)
+		if rec.Event.Id > s.nextId {
+			s.nextId = rec.Event.Id
+		}
+		s.audit(rec, rec.Event.Id, before, rec.Event)
+	case opDelete:
+		old, exist := s.events[rec.Id]
+		if !exist {
+			return nil
+		}
+		s.remove(rec.Id)
+		s.deleted[rec.Id] = &deletedEvent{Event: old, DeletedAt: rec.At}
+		s.audit(rec, rec.Id, old, nil)
+	case opBatch:
+		for _, r := range rec.Batch {
+			if (r.Op == opCreate || r.Op == opUpdate || r.Op == opRestore) && r.Event == nil {
+				return errors.New("batch record without event")
+			}
+		}
+		for _, r := range rec.Batch {
+			if err := s.apply(r); err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.New("unknown operation " + rec.Op)
+	}
+	return nil
+}
+
+// Get - возвращает событие по id
+func (s *EventLocalStorage) Get(id int) (*Event, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	event, exist := s.events[id]
+	if !exist {
+		return nil, ErrNotFound
+	}
+	return event, nil
+}
+
+// GetByDAVName - событие пользователя, созданное через CalDAV под именем ресурса name
+func (s *EventLocalStorage) GetByDAVName(userId int, name string) (*Event, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	event, exist := s.dav[userId][name]
+	if !exist {
+		return nil, ErrNotFound
+	}
+	return event, nil
+}
+
+// Create - сохраняет новое событие, id и первая версия назначаются хранилищем, участники получают needs-action.
+// actor - пользователь, от имени которого создается событие, как в Operation
+func (s *EventLocalStorage) Create(event *Event, actor *int) error {
+	s.Lock()
+	defer s.Unlock()
+
+	event.Id = s.nextId + 1
+	event.Version = 1
+	event.inviteAttendees(nil)
+
+	rec := record{Op: opCreate, Event: event, Actor: actorOf(actor, event.UserId), At: s.now()}
+	if err := s.commit(rec); err != nil {
+		return err
+	}
+
+	_ = s.apply(rec)
+	s.notify(opCreate, event, nil)
+	return nil
+}
+
+// Update - заменяет событие. Если в event передана версия, она должна совпадать с текущей,
+// иначе возвращается ошибка конфликта. После обновления версия увеличивается.
+// Ответы участников, оставшихся в событии, сохраняются.
+func (s *EventLocalStorage) Update(event *Event, actor *int) error {
+	s.Lock()
+	defer s.Unlock()
+
+	current, exist := s.events[event.Id]
+	if !exist {
+		return ErrNotFound
+	}
+
+	if event.Version != 0 && event.Version != current.Version {
+		return fmt.Errorf("%w: current version is %d", ErrConflict, current.Version)
+	}
+	event.Version = current.Version + 1
+	event.inviteAttendees(current)
+	event.keepIdentity(current)
+
+	rec := record{Op: opUpdate, Event: event, Actor: actorOf(actor, event.UserId), At: s.now()}
+	if err := s.commit(rec); err != nil {
+		event.Version = current.Version
+		return err
+	}
+
+	_ = s.apply(rec)
+	s.notify(opUpdate, event, current)
+	return nil
+}
+
+// Delete - удаляет событие, ненулевая version проверяется так же как в Update.
+// Удаленное событие можно восстановить через Apply с opRestore, пока не истек срок хранения.
+func (s *EventLocalStorage) Delete(eventId, version int, actor *int) error {
+	s.Lock()
+	defer s.Unlock()
+
+	current, exist := s.events[eventId]
+	if !exist {
+		return ErrNotFound
+	}
+
+	if version != 0 && version != current.Version {
+		return fmt.Errorf("%w: current version is %d", ErrConflict, current.Version)
+	}
+
+	rec := record{Op: opDelete, Id: eventId, Actor: actorOf(actor, current.UserId), At: s.now()}
+	if err := s.commit(rec); err != nil {
+		return err
+	}
+
+	_ = s.apply(rec)
+	s.purge(rec.At)
+	s.notify(opDelete, current, nil)
+	return nil
+}
+
+// Apply - выполняет операции атомарно: либо все, либо ни одной. Операции проверяются по очереди с учетом
+// предыдущих операций пакета, первая неудачная возвращается как *BatchError. Id и версии созданных
+// и измененных событий проставляются в Event операций.
+func (s *EventLocalStorage) Apply(ops []Operation) error {
+	s.Lock()
+	defer s.Unlock()
+
+	// pending - состояние событий после уже проверенных операций пакета, nil - событие удалено
+	pending := map[int]*Event{}
+	lookup := func(id int) *Event {
+		if event, ok := pending[id]; ok {
+			return event
+		}
+		return s.events[id]
+	}
+
+	now := s.now()
+	nextId := s.nextId
+	batch := make([]record, len(ops))
+	for i, op := range ops {
+		switch op.Op {
+		case opCreate:
+			nextId++
+			op.Event.Id = nextId
+			if op.RejectOverlaps {
+				if other := s.findOverlap(op.Event, pending); other != nil {
+					return &BatchError{Index: i, Err: &OverlapError{Event: other}}
+				}
+			}
+			op.Event.Version = 1
+			op.Event.inviteAttendees(nil)
+			pending[op.Event.Id] = op.Event
+			batch[i] = record{Op: opCreate, Event: op.Event, Actor: actorOf(op.Actor, op.Event.UserId), At: now}
+		case opUpdate:
+			current := lookup(op.Event.Id)
+			if current == nil {
+				return &BatchError{Index: i, Err: ErrNotFound}
+			}
+			if op.Event.Version != 0 && op.Event.Version != current.Version {
+				return &BatchError{Index: i, Err: fmt.Errorf("%w: current version is %d", ErrConflict, current.Version)}
+			}
+			if op.RejectOverlaps {
+				if other := s.findOverlap(op.Event, pending); other != nil {
+					return &BatchError{Index: i, Err: &OverlapError{Event: other}}
+				}
+			}
+			op.Event.Version = current.Version + 1
+			op.Event.inviteAttendees(current)
+			op.Event.keepIdentity(current)
+			pending[op.Event.Id] = op.Event
+			batch[i] = record{Op: opUpdate, Event: op.Event, Actor: actorOf(op.Actor, op.Event.UserId), At: now}
+		case opDelete:
+			current := lookup(op.Id)
+			if current == nil {
+				return &BatchError{Index: i, Err: ErrNotFound}
+			}
+			if op.Version != 0 && op.Version != current.Version {
+				return &BatchError{Index: i, Err: fmt.Errorf("%w: current version is %d", ErrConflict, current.Version)}
+			}
+			pending[op.Id] = nil
+			batch[i] = record{Op: opDelete, Id: op.Id, Actor: actorOf(op.Actor, current.UserId), At: now}
+		case opRestore:
+			if lookup(op.Id) != nil {
+				return &BatchError{Index: i, Err: ErrAlreadyExists}
+			}
+			// событие, удаленное этим же пакетом, еще нельзя восстановить
+			d := s.restorable(op.Id, now)
+			if _, deletedNow := pending[op.Id]; d == nil || deletedNow {
+				return &BatchError{Index: i, Err: ErrNotFound}
+			}
+			restored := d.Event.clone()
+			restored.Version = d.Event.Version + 1
+			ops[i].Event = restored
+			pending[op.Id] = restored
+			batch[i] = record{Op: opRestore, Event: restored, Actor: actorOf(op.Actor, restored.UserId), At: now}
+		default:
+			return &BatchError{Index: i, Err: invalid("op", "unknown operation "+op.Op)}
+		}
+	}
+
+	if err := s.commit(record{Op: opBatch, Batch: batch}); err != nil {
+		return err
+	}
+
+	s.nextId = nextId
+	for _, rec := range batch {
+		switch rec.Op {
+		case opDelete:
+			old := s.events[rec.Id]
+			_ = s.apply(rec)
+			s.notify(opDelete, old, nil)
+		case opRestore:
+			// для подписчиков восстановленное событие появляется заново
+			_ = s.apply(rec)
+			s.notify(opCreate, rec.Event, nil)
+		default:
+			previous := s.events[rec.Event.Id]
+			_ = s.apply(rec)
+			s.notify(rec.Op, rec.Event, previous)
+		}
+	}
+	s.purge(now)
+	return nil
+}
+
+// overlapHorizon - на сколько вперед от начала повторяющегося события ищутся пересечения с ним:
+// бесконечную серию нельзя сравнить с другими целиком
+const overlapHorizon = 366 * 24 * time.Hour
+
+// findOverlap - событие владельца event (для повторяющегося - экземпляр повторения), которое пересекается
+// с event по времени, или nil. pending - состояние событий после уже проверенных операций пакета.
+func (s *EventLocalStorage) findOverlap(event *Event, pending map[int]*Event) *Event {
+	from, to := time.Time(event.Start), time.Time(event.End)
+	if event.RRule != nil {
+		to = from.Add(overlapHorizon + event.duration())
+	}
+	own := busyInstances(event, from, to)
+	if len(own) == 0 {
+		return nil
+	}
+
+	var candidates []*Event
+	s.index.Range(event.UserId, from.Add(-s.longest[event.UserId]), to, func(other *Event) bool {
+		candidates = append(candidates, other)
+		return true
+	})
+	for _, other := range s.series[event.UserId] {
+		candidates = append(candidates, other)
+	}
+	for _, other := range pending {
+		if other != nil && other.UserId == event.UserId {
+			candidates = append(candidates, other)
+		}
+	}
+
+	for _, other := range candidates {
+		// изменяемое событие не мешает само себе, а измененные и удаленные пакетом учитываются по pending
+		if other.Id == event.Id {
+			continue
+		}
+		if p, ok := pending[other.Id]; ok && p != other {
+			continue
+		}
+
+		for _, instance := range busyInstances(other, from, to) {
+			for _, mine := range own {
+				if intersects(mine, instance) {
+					return instance
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// GetRange - возвращает события календаря пользователя (его собственные и те, в которые он приглашен),
+// пересекающие полуинтервал [from, to), упорядоченные по началу.
+// Повторяющиеся события возвращаются по одному экземпляру на каждое повторение в интервале.
+func (s *EventLocalStorage) GetRange(userId int, from, to time.Time) (events []*Event) {
+	s.RLock()
+	defer s.RUnlock()
+
+	s.index.Range(userId, from.Add(-s.longest[userId]), to, func(event *Event) bool {
+		if event.overlaps(from, to) {
+			events = append(events, event)
+		}
+		return true
+	})
+
+	if len(s.series[userId]) == 0 && len(s.invites[userId]) == 0 {
+		return events
+	}
+
+	for _, event := range s.series[userId] {
+		events = append(events, event.occurrences(from, to)...)
+	}
+	// приглашений у пользователя немного, поэтому они проверяются перебором
+	for _, event := range s.invites[userId] {
+		if event.RRule != nil {
+			events = append(events, event.occurrences(from, to)...)
+		} else if event.overlaps(from, to) {
+			events = append(events, event)
+		}
+	}
+	sortEvents(events)
+
+	return events
+}
+
+// Invitations - события, в которые приглашен пользователь, без разворачивания повторений, упорядоченные по дате
+func (s *EventLocalStorage) Invitations(userId int) (events []*Event) {
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, event := range s.invites[userId] {
+		events = append(events, event)
+	}
+	sortEvents(events)
+
+	return events
+}
+
+// Respond - записывает ответ участника userId на приглашение в событие eventId и возвращает новую версию события.
+// Если пользователь не приглашен, событие для него считается несуществующим.
+func (s *EventLocalStorage) Respond(eventId, userId int, status string) (*Event, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	current, exist := s.events[eventId]
+	if !exist || current.attendee(userId) == nil {
+		return nil, ErrNotFound
+	}
+
+	event := current.clone()
+	event.attendee(userId).Status = status
+	event.Version = current.Version + 1
+
+	rec := record{Op: opUpdate, Event: event, Actor: userId, At: s.now()}
+	if err := s.commit(rec); err != nil {
+		return nil, err
+	}
+
+	_ = s.apply(rec)
+	s.notify(opUpdate, event, current)
+	return event, nil
+}
+
+// GetAll - возвращает все события пользователя без разворачивания повторений, упорядоченные по дате
+func (s *EventLocalStorage) GetAll(userId int) (events []*Event) {
+	s.RLock()
+	defer s.RUnlock()
+
+	s.index.RangeUser(userId, func(event *Event) bool {
+		events = append(events, event)
+		return true
+	})
+	for _, event := range s.series[userId] {
+		events = append(events, event)
+	}
+	sortEvents(events)
+
+	return events
+}
+
+// Search - события пользователя, в названии которых есть все слова запроса, упорядоченные по дате.
+// Если задан интервал [from, to), возвращаются только пересекающие его события, повторяющиеся - по экземпляру
+// на каждое повторение; без интервала повторения не разворачиваются.
+func (s *EventLocalStorage) Search(userId int, query string, from, to time.Time) (events []*Event) {
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, id := range s.names.Lookup(userId, tokenize(query)) {
+		event := s.events[id]
+		switch {
+		case from.IsZero():
+			events = append(events, event)
+		case event.RRule != nil:
+			events = append(events, event.occurrences(from, to)...)
+		case event.overlaps(from, to):
+			events = append(events, event)
+		}
+	}
+	sortEvents(events)
+
+	return events
+}
+
+// Stats - количество событий и пользователей
+func (s *EventLocalStorage) Stats() StorageStats {
+	s.RLock()
+	defer s.RUnlock()
+
+	users := map[int]struct{}{}
+	for _, event := range s.events {
+		users[event.UserId] = struct{}{}
+	}
+
+	recurring := 0
+	for _, series := range s.series {
+		recurring += len(series)
+	}
+
+	return StorageStats{Events: len(s.events), Recurring: recurring, Users: len(users), Deleted: len(s.deleted)}
+}
+
+// sortEvents - упорядочивает события по дате, а при совпадении дат по id
+func sortEvents(events []*Event) {
+	sort.SliceStable(events, func(i, j int) bool {
+		a, b := time.Time(events[i].Start), time.Time(events[j].Start)
+		if !a.Equal(b) {
+			return a.Before(b)
+		}
+		return events[i].Id < events[j].Id
+	})
+}
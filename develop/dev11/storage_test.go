@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetRange(t *testing.T) {
+	s := NewStorage()
+	day := time.Date(2022, 5, 10, 0, 0, 0, 0, time.UTC)
+
+	for _, e := range []*Event{
+		{UserId: 1, Name: "b", Start: jsonTime(day.Add(5 * time.Hour))},
+		{UserId: 1, Name: "a", Start: jsonTime(day.Add(time.Hour))},
+		{UserId: 1, Name: "next day", Start: jsonTime(day.AddDate(0, 0, 1))},
+		{UserId: 2, Name: "other user", Start: jsonTime(day.Add(time.Hour))},
+	} {
+		assert.NoError(t, s.Create(e, nil))
+	}
+
+	events := s.GetRange(1, day, day.AddDate(0, 0, 1))
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, "a", events[0].Name)
+		assert.Equal(t, "b", events[1].Name)
+	}
+
+	// перенос события на другой день должен обновить индекс
+	moved := *events[0]
+	moved.Start = jsonTime(day.AddDate(0, 0, 2))
+	assert.NoError(t, s.Update(&moved, nil))
+	assert.Len(t, s.GetRange(1, day, day.AddDate(0, 0, 1)), 1)
+	assert.Len(t, s.GetRange(1, day, day.AddDate(0, 0, 3)), 3)
+
+	assert.NoError(t, s.Delete(moved.Id, 0, nil))
+	assert.Len(t, s.GetRange(1, day, day.AddDate(0, 0, 3)), 2)
+}
+
+// TestLongestDuration - длинное событие расширяет поиск только для своего владельца и до своего удаления
+func TestLongestDuration(t *testing.T) {
+	s := NewStorage()
+	day := time.Date(2022, 5, 10, 0, 0, 0, 0, time.UTC)
+
+	long := &Event{UserId: 1, Name: "vacation", Start: jsonTime(day.AddDate(0, -1, 0)), End: jsonTime(day.AddDate(0, 1, 0))}
+	assert.NoError(t, s.Create(long, nil))
+	assert.NoError(t, s.Create(&Event{UserId: 1, Name: "meeting", Start: jsonTime(day), End: jsonTime(day.Add(time.Hour))}, nil))
+	assert.NoError(t, s.Create(&Event{UserId: 2, Name: "meeting", Start: jsonTime(day), End: jsonTime(day.Add(time.Hour))}, nil))
+
+	assert.Len(t, s.GetRange(1, day.AddDate(0, 0, 5), day.AddDate(0, 0, 6)), 1)
+	assert.Equal(t, time.Hour, s.longest[2])
+
+	assert.NoError(t, s.Delete(long.Id, 0, nil))
+	assert.Equal(t, time.Hour, s.longest[1])
+	assert.Empty(t, s.GetRange(1, day.AddDate(0, 0, 5), day.AddDate(0, 0, 6)))
+}
+
+func TestSearch(t *testing.T) {
+	s := NewStorage()
+	day := time.Date(2022, 5, 10, 0, 0, 0, 0, time.UTC)
+
+	for _, e := range []*Event{
+		{UserId: 1, Name: "Team meeting", Start: jsonTime(day.Add(3 * time.Hour))},
+		{UserId: 1, Name: "meeting with Team lead", Start: jsonTime(day.Add(time.Hour))},
+		{UserId: 1, Name: "Lunch", Start: jsonTime(day.Add(2 * time.Hour))},
+		{UserId: 2, Name: "team meeting", Start: jsonTime(day.Add(time.Hour))},
+	} {
+		assert.NoError(t, s.Create(e, nil))
+	}
+
+	events := s.Search(1, "TEAM, meeting", time.Time{}, time.Time{})
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, 2, events[0].Id)
+		assert.Equal(t, 1, events[1].Id)
+	}
+	assert.Len(t, s.Search(1, "team", day, day.Add(2*time.Hour)), 1)
+
+	// переименованное событие ищется только по новому названию
+	renamed := *events[0]
+	renamed.Name = "one on one"
+	assert.NoError(t, s.Update(&renamed, nil))
+	assert.Len(t, s.Search(1, "meeting", time.Time{}, time.Time{}), 1)
+	assert.Len(t, s.Search(1, "one", time.Time{}, time.Time{}), 1)
+}
+
+func TestPagination(t *testing.T) {
+	s := NewStorage()
+	day := time.Date(2022, 5, 10, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		// у событий одинаковое начало, порядок между ними задает id
+		assert.NoError(t, s.Create(&Event{UserId: 1, Name: "event", Start: jsonTime(day)}, nil))
+	}
+
+	var ids []int
+	page := pageParams{limit: 2}
+	for {
+		events, next := page.apply(s.GetAll(1))
+		for _, event := range events {
+			ids = append(ids, event.Id)
+		}
+		if next == "" {
+			break
+		}
+		c, err := parseCursor(next)
+		assert.NoError(t, err)
+		page.cursor = &c
+	}
+	assert.Equal(t, []int{1, 2, 3, 4, 5}, ids)
+}
+
+func TestApply(t *testing.T) {
+	s := NewStorage()
+	day := time.Date(2022, 5, 10, 0, 0, 0, 0, time.UTC)
+	assert.NoError(t, s.Create(&Event{UserId: 1, Name: "a", Start: jsonTime(day)}, nil))
+
+	// вторая операция не проходит - первая тоже не должна примениться
+	err := s.Apply([]Operation{
+		{Op: opCreate, Event: &Event{UserId: 1, Name: "b", Start: jsonTime(day)}},
+		{Op: opDelete, Id: 1},
+		{Op: opDelete, Id: 1},
+	})
+	var batchErr *BatchError
+	if assert.ErrorAs(t, err, &batchErr) {
+		assert.Equal(t, 2, batchErr.Index)
+		assert.ErrorIs(t, err, ErrNotFound)
+	}
+	assert.Len(t, s.GetAll(1), 1)
+
+	assert.NoError(t, s.Apply([]Operation{
+		{Op: opCreate, Event: &Event{UserId: 1, Name: "b", Start: jsonTime(day)}},
+		{Op: opDelete, Id: 1},
+	}))
+	events := s.GetAll(1)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, "b", events[0].Name)
+	}
+}
+
+func TestAttendees(t *testing.T) {
+	s := NewStorage()
+	day := time.Date(2022, 5, 10, 0, 0, 0, 0, time.UTC)
+
+	// владелец не может ответить за участников и сам участником не становится
+	event := &Event{UserId: 1, Name: "team", Start: jsonTime(day.Add(10 * time.Hour)),
+		Attendees: []Attendee{{UserId: 1}, {UserId: 2, Status: rsvpAccepted}, {UserId: 3}}}
+	assert.NoError(t, s.Create(event, nil))
+	assert.Equal(t, []Attendee{{UserId: 2, Status: rsvpNeedsAction}, {UserId: 3, Status: rsvpNeedsAction}}, event.Attendees)
+
+	assert.Len(t, s.GetRange(2, day, day.AddDate(0, 0, 1)), 1)
+	assert.Len(t, s.Invitations(3), 1)
+
+	responded, err := s.Respond(event.Id, 2, rsvpAccepted)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, responded.Version)
+	_, err = s.Respond(event.Id, 4, rsvpAccepted)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// при изменении события ответы оставшихся участников сохраняются
+	updated := responded.clone()
+	updated.Attendees = []Attendee{{UserId: 2, Status: rsvpDeclined}, {UserId: 4}}
+	assert.NoError(t, s.Update(updated, nil))
+	assert.Equal(t, []Attendee{{UserId: 2, Status: rsvpAccepted}, {UserId: 4, Status: rsvpNeedsAction}}, updated.Attendees)
+	assert.Empty(t, s.Invitations(3))
+	assert.Empty(t, s.GetRange(3, day, day.AddDate(0, 0, 1)))
+}
+
+func TestRestore(t *testing.T) {
+	s := NewStorage()
+	now := time.Date(2022, 5, 10, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	actor := 2
+	event := &Event{UserId: 1, Name: "a", Start: jsonTime(now)}
+	assert.NoError(t, s.Create(event, nil))
+	assert.NoError(t, s.Delete(event.Id, 0, &actor))
+	assert.Empty(t, s.GetAll(1))
+
+	// событие, которое не удалено, восстановить нельзя
+	err := s.Apply([]Operation{{Op: opRestore, Id: event.Id}, {Op: opRestore, Id: event.Id}})
+	assert.ErrorIs(t, err, ErrAlreadyExists)
+
+	ops := []Operation{{Op: opRestore, Id: event.Id, Actor: &actor}}
+	assert.NoError(t, s.Apply(ops))
+	assert.Equal(t, 2, ops[0].Event.Version)
+	assert.Len(t, s.GetAll(1), 1)
+
+	history, err := s.History(event.Id)
+	assert.NoError(t, err)
+	if assert.Len(t, history, 3) {
+		assert.Equal(t, []string{opCreate, opDelete, opRestore}, []string{history[0].Op, history[1].Op, history[2].Op})
+		assert.Nil(t, history[1].After)
+		assert.Equal(t, 1, history[1].Before.Version)
+		assert.Equal(t, []int{1, 2, 2}, []int{history[0].Actor, history[1].Actor, history[2].Actor})
+	}
+
+	// после срока хранения удаленное событие и его история забываются
+	assert.NoError(t, s.Delete(event.Id, 0, nil))
+	now = now.Add(defaultRetention)
+	_, err = s.Deleted(event.Id)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Error(t, s.Apply([]Operation{{Op: opRestore, Id: event.Id}}))
+
+	// удаление другого события вычищает просроченные
+	other := &Event{UserId: 1, Name: "b", Start: jsonTime(now)}
+	assert.NoError(t, s.Create(other, nil))
+	assert.NoError(t, s.Delete(other.Id, 0, nil))
+	assert.NotContains(t, s.deleted, event.Id)
+	assert.NotContains(t, s.history, event.Id)
+	_, err = s.History(event.Id)
+	assert.ErrorIs(t, err, ErrNotFound)
+	history, err = s.History(other.Id)
+	assert.NoError(t, err)
+	assert.Len(t, history, 2)
+}
+
+// TestRestoreZeroRetention - с нулевым сроком хранения удаленное событие и история сразу забываются
+func TestRestoreZeroRetention(t *testing.T) {
+	s := NewStorage()
+	now := time.Date(2022, 5, 10, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	s.retention = 0
+
+	event := &Event{UserId: 1, Name: "a", Start: jsonTime(now)}
+	assert.NoError(t, s.Create(event, nil))
+	assert.NoError(t, s.Delete(event.Id, 0, nil))
+
+	_, err := s.Deleted(event.Id)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.ErrorIs(t, s.Apply([]Operation{{Op: opRestore, Id: event.Id}}), ErrNotFound)
+	assert.Empty(t, s.deleted)
+	assert.Empty(t, s.history)
+
+	_, err = s.History(event.Id)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+// TestVisibleHistory - после смены владельца каждый владелец видит только записи о своем событии
+func TestVisibleHistory(t *testing.T) {
+	s := NewStorage()
+	event := &Event{UserId: 1, Name: "a", Start: jsonTime(time.Date(2022, 5, 10, 12, 0, 0, 0, time.UTC))}
+	require.NoError(t, s.Create(event, nil))
+	moved := event.clone()
+	moved.UserId = 2
+	require.NoError(t, s.Update(moved, nil))
+	moved = moved.clone()
+	moved.Name = "b"
+	require.NoError(t, s.Update(moved, nil))
+	entries, err := s.History(event.Id)
+	require.NoError(t, err)
+
+	as := func(userId int) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/events/1/history", nil)
+		return r.WithContext(context.WithValue(r.Context(), principalKey, Principal{UserId: userId}))
+	}
+	visible, err := visibleHistory(as(1), entries)
+	require.NoError(t, err)
+	assert.Len(t, visible, 2)
+	visible, err = visibleHistory(as(2), entries)
+	require.NoError(t, err)
+	assert.Len(t, visible, 2)
+	_, err = visibleHistory(as(3), entries)
+	assert.ErrorIs(t, err, ErrForbidden)
+}
+
+// TestIdsAfterRestart - id продолжают расти после перезапуска, откуда бы ни восстанавливался последний выданный:
+// из снимка, из журнала или из журнала поверх снимка. Удаление последнего события id не освобождает.
+func TestIdsAfterRestart(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		compactEvery int
+		flush        bool
+	}{
+		{name: "журнал", compactEvery: 0},
+		{name: "снимок", compactEvery: 0, flush: true},
+		{name: "журнал поверх снимка", compactEvery: 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := openFileStorage(t, tc.compactEvery)
+			var last *Event
+			for i := 0; i < 3; i++ {
+				last = fileEvent("event", 10+i)
+				require.NoError(t, f.Create(last, nil))
+			}
+			require.NoError(t, f.Delete(last.Id, 0, nil))
+			if tc.flush {
+				require.NoError(t, f.Flush())
+			}
+			if tc.compactEvery > 0 {
+				// три создания ушли в снимок, удаление осталось в журнале
+				require.FileExists(t, filepath.Join(f.dir, snapshotFile))
+				require.Equal(t, 1, f.Stats().JournalRecords)
+			}
+
+			f = reopen(t, f, tc.compactEvery)
+			event := fileEvent("after restart", 15)
+			require.NoError(t, f.Create(event, nil))
+			assert.Equal(t, 4, event.Id)
+
+			// пакет тоже выдает следующие id
+			batch := []Operation{{Op: opCreate, Event: fileEvent("batch", 16)}}
+			require.NoError(t, f.Apply(batch))
+			assert.Equal(t, 5, batch[0].Event.Id)
+		})
+	}
+}
+
+// TestStaleVersion - изменение и удаление по устаревшей версии отклоняются с ErrConflict и ничего не меняют
+func TestStaleVersion(t *testing.T) {
+	s := NewStorage()
+	event := &Event{UserId: 1, Name: "a", Start: jsonTime(time.Date(2022, 5, 10, 10, 0, 0, 0, time.UTC))}
+	require.NoError(t, s.Create(event, nil))
+	fresh := event.clone()
+	fresh.Name = "b"
+	require.NoError(t, s.Update(fresh, nil))
+	require.Equal(t, 2, fresh.Version)
+
+	stale := event.clone()
+	stale.Name = "c"
+	require.Equal(t, 1, stale.Version)
+	assert.ErrorIs(t, s.Update(stale, nil), ErrConflict)
+	assert.ErrorIs(t, s.Delete(event.Id, 1, nil), ErrConflict)
+	assert.ErrorIs(t, s.Apply([]Operation{{Op: opUpdate, Event: stale}}), ErrConflict)
+	assert.ErrorIs(t, s.Apply([]Operation{{Op: opDelete, Id: event.Id, Version: 1}}), ErrConflict)
+
+	current, err := s.Get(event.Id)
+	require.NoError(t, err)
+	assert.Equal(t, "b", current.Name)
+	assert.Equal(t, 2, current.Version)
+
+	// версия 0 означает изменение без проверки
+	stale.Version = 0
+	assert.NoError(t, s.Update(stale, nil))
+	assert.Equal(t, 3, stale.Version)
+}
+
+const (
+	benchEvents = 1000000
+	benchUsers  = 1000
+)
+
+var (
+	benchOnce    sync.Once
+	benchStorage *EventLocalStorage
+	benchStart   = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// benchmarkStorage - хранилище с миллионом событий, равномерно распределенных по пользователям и трем годам
+func benchmarkStorage() *EventLocalStorage {
+	benchOnce.Do(func() {
+		rnd := rand.New(rand.NewSource(1))
+		benchStorage = NewStorage()
+		for i := 0; i < benchEvents; i++ {
+			_ = benchStorage.Create(&Event{
+				UserId: rnd.Intn(benchUsers),
+				Name:   "event",
+				Start:  jsonTime(benchStart.Add(time.Duration(rnd.Int63n(int64(3 * 365 * 24 * time.Hour))))),
+			}, nil)
+		}
+	})
+	return benchStorage
+}
+
+// scanRange - полный перебор событий, как выборки работали до появления индекса
+func scanRange(s *EventLocalStorage, userId int, from, to time.Time) (events []*Event) {
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, v := range s.events {
+		if v.UserId == userId && !time.Time(v.Start).Before(from) && time.Time(v.Start).Before(to) {
+			events = append(events, v)
+		}
+	}
+	return events
+}
+
+func benchmarkRange(b *testing.B, get func(s *EventLocalStorage, userId int, from, to time.Time) []*Event, days int) {
+	s := benchmarkStorage()
+	rnd := rand.New(rand.NewSource(2))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		from := benchStart.AddDate(0, 0, rnd.Intn(3*365))
+		get(s, rnd.Intn(benchUsers), from, from.AddDate(0, 0, days))
+	}
+}
+
+func indexRange(s *EventLocalStorage, userId int, from, to time.Time) []*Event {
+	return s.GetRange(userId, from, to)
+}
+
+func BenchmarkGetRangeDay(b *testing.B)   { benchmarkRange(b, indexRange, 1) }
+func BenchmarkGetRangeMonth(b *testing.B) { benchmarkRange(b, indexRange, 30) }
+func BenchmarkScanDay(b *testing.B)       { benchmarkRange(b, scanRange, 1) }
+func BenchmarkScanMonth(b *testing.B)     { benchmarkRange(b, scanRange, 30) }
+
+// BenchmarkGetRangeDayLongEvent - одно событие длиной в полгода среди миллиона не замедляет выборки других пользователей
+func BenchmarkGetRangeDayLongEvent(b *testing.B) {
+	s := benchmarkStorage()
+	long := &Event{UserId: 0, Name: "sabbatical", Start: jsonTime(benchStart), End: jsonTime(benchStart.AddDate(0, 6, 0))}
+	if err := s.Create(long, nil); err != nil {
+		b.Fatal(err)
+	}
+	defer s.Delete(long.Id, 0, nil)
+
+	benchmarkRange(b, indexRange, 1)
+}
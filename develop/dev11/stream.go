@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// subscriberBuffer - сколько изменений может ждать отправки медленному подписчику.
+// Если буфер переполнен, поток закрывается, и клиент продолжает с Last-Event-ID.
+const subscriberBuffer = 64
+
+// StreamConfig - настройки потока изменений. LogSize - сколько последних изменений хранится
+// для продолжения потока после переподключения, Heartbeat - период пустых сообщений,
+// которые не дают прокси закрыть простаивающее соединение.
+type StreamConfig struct {
+	LogSize   int      `json:"log_size" yaml:"log_size"`
+	Heartbeat Duration `json:"heartbeat" yaml:"heartbeat"`
+}
+
+// streamLifetime - сколько живет поток при write timeout сервера: с запасом на отправку последнего сообщения
+// до того, как сервер оборвет соединение. 0 - без ограничения.
+func streamLifetime(writeTimeout time.Duration) time.Duration {
+	return writeTimeout - writeTimeout/10
+}
+
+// feedEntry - изменение в журнале потока, previous - событие до изменения
+type feedEntry struct {
+	seq      int64
+	op       string
+	userId   int
+	event    *Event
+	previous *Event
+}
+
+// inCalendar - событие есть в календаре пользователя: он владелец или участник
+func inCalendar(event *Event, userId int) bool {
+	return event != nil && (event.UserId == userId || event.attendee(userId) != nil)
+}
+
+// forUser - изменение так, как его видит пользователь. Владелец и участники получают его как есть,
+// а тот, у кого событие пропало из календаря (его убрали из участников), - удаление прежней версии события.
+// ok = false, если изменение не касается пользователя.
+func (e feedEntry) forUser(userId int) (entry feedEntry, ok bool) {
+	if e.userId == userId || inCalendar(e.event, userId) {
+		return e, true
+	}
+	if inCalendar(e.previous, userId) {
+		e.op, e.event = opDelete, e.previous
+		return e, true
+	}
+	return e, false
+}
+
+// feedSubscriber - подписчик на изменения событий пользователя
+type feedSubscriber struct {
+	userId int
+	ch     chan feedEntry
+}
+
+// changeFeed - ограниченный журнал изменений в памяти и рассылка новых изменений подписчикам.
+// Идентификатор изменения состоит из эпохи (времени запуска процесса) и номера, так что идентификатор
+// из прошлого запуска распознается, а не путается с номером из текущего.
+type changeFeed struct {
+	mu      sync.Mutex
+	epoch   string
+	seq     int64
+	log     []feedEntry // кольцевой буфер, start - индекс самой старой записи
+	start   int
+	size    int
+	clients map[*feedSubscriber]struct{}
+}
+
+func newChangeFeed(size int) *changeFeed {
+	return &changeFeed{
+		epoch:   strconv.FormatInt(time.Now().UnixNano(), 36),
+		log:     make([]feedEntry, size),
+		clients: map[*feedSubscriber]struct{}{},
+	}
+}
+
+// entryId - идентификатор изменения для поля id
+func (f *changeFeed) entryId(seq int64) string {
+	return f.epoch + "-" + strconv.FormatInt(seq, 10)
+}
+
+// publish - добавляет изменение хранилища в журнал и рассылает его подписчикам владельца и участников события
+func (f *changeFeed) publish(c Change) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.seq++
+	entry := feedEntry{seq: f.seq, op: c.Op, userId: c.Event.UserId, event: c.Event, previous: c.Previous}
+	if len(f.log) > 0 {
+		if f.size < len(f.log) {
+			f.log[(f.start+f.size)%len(f.log)] = entry
+			f.size++
+		} else {
+			f.log[f.start] = entry
+			f.start = (f.start + 1) % len(f.log)
+		}
+	}
+
+	for sub := range f.clients {
+		visible, ok := entry.forUser(sub.userId)
+		if !ok {
+			continue
+		}
+		select {
+		case sub.ch <- visible:
+		default:
+			// подписчик не успевает читать: закрываем поток, клиент переподключится и дочитает из журнала
+			delete(f.clients, sub)
+			close(sub.ch)
+		}
+	}
+}
+
+// opReset - изменение, означающее что клиенту нужно заново загрузить события
+const opReset = "reset"
+
+// subscribe - подписывает на изменения пользователя. lastId - идентификатор последнего полученного клиентом
+// изменения; возвращаются изменения после него из журнала. Если продолжить с lastId нельзя (идентификатор
+// из другого запуска или нужные изменения уже вытеснены из журнала), возвращается одно изменение opReset.
+func (f *changeFeed) subscribe(userId int, lastId string) (sub *feedSubscriber, backlog []feedEntry) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sub = &feedSubscriber{userId: userId, ch: make(chan feedEntry, subscriberBuffer)}
+	f.clients[sub] = struct{}{}
+
+	if lastId == "" {
+		return sub, nil
+	}
+
+	epoch, seqText, _ := strings.Cut(lastId, "-")
+	last, err := strconv.ParseInt(seqText, 10, 64)
+	if err != nil || epoch != f.epoch || last > f.seq || last+1 < f.seq-int64(f.size)+1 {
+		return sub, []feedEntry{{seq: f.seq, op: opReset, userId: userId}}
+	}
+
+	for i := 0; i < f.size; i++ {
+		entry := f.log[(f.start+i)%len(f.log)]
+		if visible, ok := entry.forUser(userId); entry.seq > last && ok {
+			backlog = append(backlog, visible)
+		}
+	}
+	return sub, backlog
+}
+
+// unsubscribe - отписывает, если подписчик еще не был отключен из-за переполнения
+func (f *changeFeed) unsubscribe(sub *feedSubscriber) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.clients[sub]; ok {
+		delete(f.clients, sub)
+		close(sub.ch)
+	}
+}
+
+// subscribers - количество подписчиков
+func (f *changeFeed) subscribers() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.clients)
+}
+
+// StreamHandler - поток изменений событий пользователя в формате Server-Sent Events.
+// Каждое изменение отправляется как событие create, update или delete с событием календаря в data.
+// Если продолжить с Last-Event-ID нельзя, первым отправляется событие reset: клиенту нужно
+// заново загрузить события. Поток закрывается до истечения write timeout сервера и при остановке,
+// браузерный EventSource в этом случае сам переподключается с Last-Event-ID.
+func (s *eventServer) StreamHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := parseUserId(r)
+	if err == nil {
+		err = authorize(r, userId)
+	}
+	if err != nil {
+		errorResponse(w, err)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok || s.feed == nil {
+		errorResponse(w, fmt.Errorf("streaming is not supported"))
+		return
+	}
+
+	lastId := r.Header.Get("Last-Event-ID")
+	if lastId == "" {
+		lastId = r.URL.Query().Get("last_event_id")
+	}
+	sub, backlog := s.feed.subscribe(userId, lastId)
+	defer s.feed.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// клиенту советуем переподключаться через секунду
+	fmt.Fprint(w, "retry: 1000\n\n")
+	for _, entry := range backlog {
+		s.writeEntry(w, entry)
+	}
+	flusher.Flush()
+
+	var deadline <-chan time.Time
+	if lifetime := streamLifetime(s.server.WriteTimeout); lifetime > 0 {
+		timer := time.NewTimer(lifetime)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	heartbeat := time.NewTicker(s.heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case entry, ok := <-sub.ch:
+			if !ok {
+				return
+			}
+			s.writeEntry(w, entry)
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case <-deadline:
+			return
+		case <-s.quit:
+			return
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeEntry - пишет изменение как событие SSE
+func (s *eventServer) writeEntry(w http.ResponseWriter, entry feedEntry) {
+	data := []byte("{}")
+	if entry.event != nil {
+		var err error
+		if data, err = json.Marshal(entry.event); err != nil {
+			return
+		}
+	}
+	fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", s.feed.entryId(entry.seq), entry.op, data)
+}
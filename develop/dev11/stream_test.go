@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChangeFeedResume(t *testing.T) {
+	feed := newChangeFeed(3)
+	for i := 1; i <= 4; i++ {
+		feed.publish(Change{Op: opCreate, Event: &Event{Id: i, UserId: i % 2}})
+	}
+
+	// в журнале остались изменения 2, 3, 4, пользователю 0 из них принадлежат 2 и 4
+	sub, backlog := feed.subscribe(0, feed.entryId(1))
+	if assert.Len(t, backlog, 2) {
+		assert.Equal(t, 2, backlog[0].event.Id)
+		assert.Equal(t, 4, backlog[1].event.Id)
+	}
+
+	feed.publish(Change{Op: opDelete, Event: &Event{Id: 2, UserId: 0}})
+	entry := <-sub.ch
+	assert.Equal(t, opDelete, entry.op)
+	feed.unsubscribe(sub)
+
+	// изменение 1 вытеснено из журнала, продолжить с него нельзя
+	_, backlog = feed.subscribe(0, feed.entryId(0))
+	if assert.Len(t, backlog, 1) {
+		assert.Equal(t, opReset, backlog[0].op)
+	}
+
+	_, backlog = feed.subscribe(0, "other-1")
+	if assert.Len(t, backlog, 1) {
+		assert.Equal(t, opReset, backlog[0].op)
+	}
+}
+
+// TestChangeFeedAttendeeRemoved - участник, которого убрали из события, получает удаление события
+func TestChangeFeedAttendeeRemoved(t *testing.T) {
+	s := NewStorage()
+	feed := newChangeFeed(10)
+	s.Watch(feed.publish)
+
+	event := &Event{UserId: 1, Name: "meeting", Start: jsonTime(time.Date(2022, 5, 10, 10, 0, 0, 0, time.UTC)),
+		Attendees: []Attendee{{UserId: 2}, {UserId: 3}}}
+	assert.NoError(t, s.Create(event, nil))
+	sub, _ := feed.subscribe(2, "")
+	defer feed.unsubscribe(sub)
+
+	updated := event.clone()
+	updated.Name = "meeting without 2"
+	updated.Attendees = []Attendee{{UserId: 3}}
+	assert.NoError(t, s.Update(updated, nil))
+
+	entry := <-sub.ch
+	assert.Equal(t, opDelete, entry.op)
+	// удаленному участнику не видно новое состояние события
+	assert.Equal(t, "meeting", entry.event.Name)
+
+	// то же при продолжении потока из журнала, а оставшийся участник получает обычное изменение
+	_, backlog := feed.subscribe(2, feed.entryId(1))
+	if assert.Len(t, backlog, 1) {
+		assert.Equal(t, opDelete, backlog[0].op)
+	}
+	_, backlog = feed.subscribe(3, feed.entryId(1))
+	if assert.Len(t, backlog, 1) {
+		assert.Equal(t, opUpdate, backlog[0].op)
+	}
+
+	// дальнейшие изменения события бывшему участнику не приходят
+	assert.NoError(t, s.Delete(event.Id, 0, nil))
+	select {
+	case entry = <-sub.ch:
+		t.Fatalf("unexpected change %s", entry.op)
+	default:
+	}
+}
@@ -1,17 +1,21 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"io"
+	"flag"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	_ "time/tzdata"
 )
 
 /*
@@ -47,276 +51,739 @@ GET /events_for_month
 	4. Код должен проходить проверки go vet и golint.
 */
 
-// Event - модель тела запроса
+// loadLocation - часовой пояс по имени IANA, пустое имя означает пояс fallback
+func loadLocation(name string, fallback *time.Location) (*time.Location, error) {
+	if name == "" {
+		return fallback, nil
+	}
+	return time.LoadLocation(name)
+}
+
+// Event - модель тела запроса. Id назначается сервером при создании,
+// Version увеличивается при каждом изменении и используется для оптимистичной блокировки.
+// Start и End - границы события, End не включается; TimeZone - пояс IANA, в котором событие было создано
+// и в котором разворачиваются его повторения. AllDay - событие на весь день, задается датой без времени.
+// Для повторяющихся событий Start - начало серии, RRule - правило повторения, ExDates - исключенные даты.
+// Reminders - за сколько до начала события (или каждого повторения) отправить напоминание.
+// Attendees - приглашенные пользователи, событие появляется и в их календаре.
 type Event struct {
-	Id     int      `json:"id"`
-	UserId int      `json:"user_id"`
-	Name   string   `json:"name"`
-	Date   jsonTime `json:"date"`
+	Id       int         `json:"id"`
+	UserId   int         `json:"user_id"`
+	Name     string      `json:"name"`
+	Start    jsonTime    `json:"start"`
+	End      jsonTime    `json:"end"`
+	TimeZone string      `json:"tz,omitempty"`
+	AllDay   bool        `json:"all_day,omitempty"`
+	Version  int         `json:"version"`
+	RRule    *Recurrence `json:"rrule,omitempty"`
+	ExDates  []ExDate    `json:"exdates,omitempty"`
+
+	Reminders []Duration `json:"reminders,omitempty"`
+	Attendees []Attendee `json:"attendees,omitempty"`
+
+	// UID - идентификатор события в iCalendar, заданный клиентом; пустой - UID назначает сервер.
+	// DAVName - имя ресурса CalDAV, под которым клиент создал событие; пустое - {id}.ics.
+	UID     string `json:"uid,omitempty"`
+	DAVName string `json:"dav_name,omitempty"`
+
+	// hasUserId - user_id был передан в запросе, иначе владельцем становится пользователь из токена
+	hasUserId bool
 }
 
-// jsonTime - тип который реализует интерфейс для работы с json
-type jsonTime time.Time
+// UnmarshalJSON - разбирает событие с учетом часового пояса tz: время в RFC 3339 переводится в этот пояс,
+// дата без времени означает полночь в нем и делает событие событием на весь день.
+// Исключенные даты разбираются в том же поясе. Для совместимости начало можно передать в старом поле date.
+// Пустой tz не затирает пояс, заданный в e до разбора (сервер подставляет туда пояс из конфигурации),
+// а если пояса нет и там, даты читаются в UTC.
+func (e *Event) UnmarshalJSON(b []byte) error {
+	timeZone := e.TimeZone
+	type plain Event
+	data := &struct {
+		*plain
+		UserId  *int            `json:"user_id"`
+		Date    string          `json:"date"`
+		Start   string          `json:"start"`
+		End     string          `json:"end"`
+		ExDates json.RawMessage `json:"exdates"`
+	}{plain: (*plain)(e)}
+	if err := json.Unmarshal(b, data); err != nil {
+		return err
+	}
 
-func (j *jsonTime) UnmarshalJSON(b []byte) error {
-	s := strings.Trim(string(b), "\"")
-	t, err := time.Parse("2006-01-02", s)
+	if data.UserId != nil {
+		e.UserId, e.hasUserId = *data.UserId, true
+	}
+	if e.TimeZone == "" {
+		e.TimeZone = timeZone
+	}
+	loc, err := loadLocation(e.TimeZone, time.UTC)
 	if err != nil {
 		return err
 	}
-	*j = jsonTime(t)
-	return nil
-}
-
-func (j jsonTime) MarshalJSON() ([]byte, error) {
-	return json.Marshal(time.Time(j))
-}
-
-// EventLocalStorage - хранилище данных о событиях, key - id, value - событие
-type EventLocalStorage struct {
-	sync.RWMutex
-
-	events map[int]*Event
-}
 
-func NewStorage() *EventLocalStorage {
-	return &EventLocalStorage{
-		events: map[int]*Event{},
+	start := data.Start
+	if start == "" {
+		start = data.Date
+	}
+	if start != "" {
+		t, allDay, err := parseEventTime(start, loc)
+		if err != nil {
+			return err
+		}
+		e.Start = jsonTime(t)
+		e.AllDay = e.AllDay || allDay
 	}
-}
 
-func (s *EventLocalStorage) Create(event *Event) error {
-	s.Lock()
-	defer s.Unlock()
+	if data.End != "" {
+		t, _, err := parseEventTime(data.End, loc)
+		if err != nil {
+			return err
+		}
+		e.End = jsonTime(t)
+	}
 
-	if _, exist := s.events[event.Id]; exist {
-		return errors.New("event already exists")
+	if len(data.ExDates) > 0 {
+		var exdates []string
+		if err := json.Unmarshal(data.ExDates, &exdates); err != nil {
+			return err
+		}
+		e.ExDates = nil
+		for _, value := range exdates {
+			if value == "" {
+				e.ExDates = append(e.ExDates, ExDate{})
+				continue
+			}
+			ex, err := parseExDate(value, loc)
+			if err != nil {
+				return err
+			}
+			e.ExDates = append(e.ExDates, ex)
+		}
 	}
 
-	s.events[event.Id] = event
 	return nil
 }
 
-func (s *EventLocalStorage) Update(event *Event) error {
-	s.Lock()
-	defer s.Unlock()
-
-	if _, exist := s.events[event.Id]; !exist {
-		return errors.New("event does not exist")
+// parseEventTime - разбирает время в RFC 3339 или дату без времени в поясе loc
+func parseEventTime(s string, loc *time.Location) (t time.Time, allDay bool, err error) {
+	t, err = time.ParseInLocation("2006-01-02", s, loc)
+	if err == nil {
+		return t, true, nil
 	}
 
-	s.events[event.Id] = event
-	return nil
+	t, err = time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return t.In(loc), false, nil
 }
 
-func (s *EventLocalStorage) Delete(eventId int) error {
-	s.Lock()
-	defer s.Unlock()
+// normalize - проверяет границы события и заполняет конец по умолчанию:
+// событие на весь день длится сутки, остальные - нулевой длительности
+func (e *Event) normalize() error {
+	start, end := time.Time(e.Start), time.Time(e.End)
+	if start.IsZero() {
+		return invalid("start", "start is required")
+	}
 
-	if _, exist := s.events[eventId]; !exist {
-		return errors.New("event does not exist")
+	if end.IsZero() {
+		end = start
+		if e.AllDay {
+			end = start.AddDate(0, 0, 1)
+		}
+		e.End = jsonTime(end)
 	}
 
-	delete(s.events, eventId)
+	if end.Before(start) {
+		return invalid("end", "end is before start")
+	}
 	return nil
 }
 
-func (s *EventLocalStorage) GetForDay(userId int, begin time.Time) (events []*Event) {
-	s.RLock()
-	defer s.RUnlock()
-
-	end := begin.AddDate(0, 0, 1)
+// duration - длительность события
+func (e *Event) duration() time.Duration {
+	if time.Time(e.End).IsZero() {
+		return 0
+	}
+	return time.Time(e.End).Sub(time.Time(e.Start))
+}
 
-	for _, v := range s.events {
-		if v.UserId == userId {
-			if time.Time(v.Date).After(begin) && time.Time(v.Date).Before(end) {
-				events = append(events, v)
-			}
-		}
+// overlaps - пересекается ли событие с полуинтервалом [from, to).
+// Событие нулевой длительности пересекается, если его начало лежит в интервале.
+func (e *Event) overlaps(from, to time.Time) bool {
+	start, end := time.Time(e.Start), time.Time(e.End)
+	if !start.Before(to) {
+		return false
+	}
+	if end.After(start) {
+		return end.After(from)
 	}
+	return !start.Before(from)
+}
 
+// occurrences - разворачивает повторяющееся событие в копии с датами повторений, пересекающими [from, to)
+func (e *Event) occurrences(from, to time.Time) (events []*Event) {
+	start := time.Time(e.Start)
+	duration := e.duration()
+	days := int((duration + 12*time.Hour) / (24 * time.Hour))
+
+	e.RRule.Occurrences(start, e.ExDates, from.Add(-duration), to, func(t time.Time) {
+		occurrence := *e
+		occurrence.Start = jsonTime(t)
+		// у событий на весь день длительность считается в днях, чтобы не съезжать при переводе часов
+		if e.AllDay {
+			occurrence.End = jsonTime(t.AddDate(0, 0, days))
+		} else {
+			occurrence.End = jsonTime(t.Add(duration))
+		}
+		if occurrence.overlaps(from, to) {
+			events = append(events, &occurrence)
+		}
+	})
 	return events
 }
 
-func (s *EventLocalStorage) GetForWeek(userId int, begin time.Time) (events []*Event) {
-	s.RLock()
-	defer s.RUnlock()
-
-	end := begin.AddDate(0, 0, 7)
+// clone - копия события, которую можно менять, не затрагивая сохраненное в хранилище
+func (e *Event) clone() *Event {
+	c := *e
+	if e.RRule != nil {
+		rule := *e.RRule
+		c.RRule = &rule
+	}
+	c.ExDates = append([]ExDate(nil), e.ExDates...)
+	c.Reminders = append([]Duration(nil), e.Reminders...)
+	c.Attendees = append([]Attendee(nil), e.Attendees...)
+	return &c
+}
 
-	for _, v := range s.events {
-		if v.UserId == userId {
-			if time.Time(v.Date).After(begin) && time.Time(v.Date).Before(end) {
-				events = append(events, v)
-			}
+// localize - переводит времена события без пояса в пояс loc, например для событий, записанных в журнал
+// без поля tz: после перезапуска они показываются и повторяются в поясе из конфигурации
+func (e *Event) localize(loc *time.Location) {
+	if e.TimeZone != "" {
+		return
+	}
+	e.Start = jsonTime(time.Time(e.Start).In(loc))
+	e.End = jsonTime(time.Time(e.End).In(loc))
+	for i, ex := range e.ExDates {
+		if !ex.Date {
+			e.ExDates[i].Time = ex.Time.In(loc)
 		}
 	}
+}
 
-	return events
+// keepIdentity - UID и имя ресурса CalDAV назначаются при создании и при изменении события сохраняются
+func (e *Event) keepIdentity(previous *Event) {
+	e.UID, e.DAVName = previous.UID, previous.DAVName
 }
 
-func (s *EventLocalStorage) GetForMonth(userId int, begin time.Time) (events []*Event) {
-	s.RLock()
-	defer s.RUnlock()
+// jsonTime - тип который реализует интерфейс для работы с json
+type jsonTime time.Time
 
-	end := begin.AddDate(0, 1, 0)
+func (j *jsonTime) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), "\"")
+	if s == "" {
+		*j = jsonTime{}
+		return nil
+	}
 
-	for _, v := range s.events {
-		if v.UserId == userId {
-			if time.Time(v.Date).After(begin) && time.Time(v.Date).Before(end) {
-				events = append(events, v)
-			}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		// MarshalJSON пишет время в RFC 3339, его тоже нужно уметь читать обратно
+		t, err = time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return err
 		}
 	}
+	*j = jsonTime(t)
+	return nil
+}
 
-	return events
+func (j jsonTime) MarshalJSON() ([]byte, error) {
+	if time.Time(j).IsZero() {
+		return []byte(`""`), nil
+	}
+	return json.Marshal(time.Time(j))
 }
 
 // eventServer - основная структура сервера
 type eventServer struct {
-	storage *EventLocalStorage
-	server  *http.Server
+	storage         Storage
+	auth            *authenticator
+	limiter         *rateLimiter  // nil если частота запросов не ограничена
+	cors            *cors         // nil если CORS выключен
+	certs           *certReloader // nil если сервер работает без TLS
+	maxBodyBytes    int64
+	scheduler       *Scheduler  // nil если напоминания выключены
+	feed            *changeFeed // nil если хранилище не сообщает об изменениях
+	heartbeat       time.Duration
+	location        *time.Location // пояс для дат, переданных без пояса
+	server          *http.Server
+	logFormat       string
+	shutdownTimeout time.Duration
+
+	// stopping - выставляется в 1 при начале остановки, после этого /readyz отвечает 503
+	stopping int32
+	// quit - закрывается при начале остановки, чтобы завершить долгие запросы вроде потока изменений
+	quit chan struct{}
 }
 
-func NewServer(port string) *eventServer {
-	return &eventServer{
-		storage: NewStorage(),
+// NewServer - создает сервер по конфигурации. Часовой пояс из конфигурации становится поясом по умолчанию
+// для дат, переданных без пояса, и для событий без пояса в хранилище.
+func NewServer(cfg Config) (*eventServer, error) {
+	location, err := time.LoadLocation(cfg.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+
+	storage, err := newStorage(cfg.Storage, location)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &eventServer{
+		storage:         storage,
+		auth:            newAuthenticator(cfg.Auth),
+		limiter:         newRateLimiter(cfg.Limits.RateLimit),
+		cors:            newCORS(cfg.CORS),
+		maxBodyBytes:    cfg.Limits.MaxBodyBytes,
+		logFormat:       cfg.LogFormat,
+		shutdownTimeout: time.Duration(cfg.ShutdownTimeout),
+		heartbeat:       time.Duration(cfg.Stream.Heartbeat),
+		location:        location,
+		quit:            make(chan struct{}),
 		server: &http.Server{
-			Addr: net.JoinHostPort("localhost", port),
+			Addr:         cfg.Addr,
+			ReadTimeout:  time.Duration(cfg.ReadTimeout),
+			WriteTimeout: time.Duration(cfg.WriteTimeout),
+			IdleTimeout:  time.Duration(cfg.IdleTimeout),
 		},
 	}
+	if s.limiter != nil {
+		s.limiter.identify = s.auth.identify
+	}
+	s.server.Handler = s.routes()
+
+	if cfg.TLS.Enabled() {
+		s.certs, err = newCertReloader(cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+		s.server.TLSConfig = s.certs.tlsConfig()
+	}
+
+	if watcher, ok := storage.(Watcher); ok {
+		s.feed = newChangeFeed(cfg.Stream.LogSize)
+		watcher.Watch(s.feed.publish)
+	}
+
+	if watcher, ok := storage.(Watcher); ok && cfg.Reminders.Enabled {
+		notifier, err := newNotifier(cfg.Reminders)
+		if err != nil {
+			return nil, err
+		}
+		s.scheduler, err = NewScheduler(notifier, remindersStatePath(cfg.Storage), time.Duration(cfg.Reminders.MaxDelay))
+		if err != nil {
+			return nil, err
+		}
+		s.scheduler.Watch(watcher)
+	}
+
+	return s, nil
+}
+
+// endpoints - маршруты всех методов API. Методы старого API оставлены для совместимости,
+// новые клиенты используют ресурсы /v2, клиенты календарей синхронизируются через /caldav.
+func (s *eventServer) endpoints() *router {
+	mux := newRouter()
+
+	mux.HandleFunc(http.MethodPost, "/create_event", s.CreateEventHandler)
+	mux.HandleFunc(http.MethodPost, "/update_event", s.UpdateEventHandler)
+	mux.HandleFunc(http.MethodPost, "/delete_event", s.DeleteEventHandler)
+	mux.HandleFunc(http.MethodPost, "/restore_event", s.RestoreEventHandler)
+	mux.HandleFunc(http.MethodGet, "/events_for_day", s.GetEventForDayHandler)
+	mux.HandleFunc(http.MethodGet, "/events_for_week", s.GetEventForWeekHandler)
+	mux.HandleFunc(http.MethodGet, "/events_for_month", s.GetEventForMonthHandler)
+	mux.HandleFunc(http.MethodPost, "/batch", s.BatchHandler)
+	mux.HandleFunc(http.MethodGet, "/search", s.SearchHandler)
+	mux.HandleFunc(http.MethodGet, "/freebusy", s.FreeBusyHandler)
+	mux.HandleFunc(http.MethodGet, "/events/stream", s.StreamHandler)
+	mux.HandleFunc(http.MethodGet, "/events/{id}/history", s.EventHistoryHandler)
+	mux.HandleFunc(http.MethodGet, "/export.ics", s.ExportHandler)
+	mux.HandleFunc(http.MethodPost, "/import", s.ImportHandler)
+	mux.HandleFunc(http.MethodGet, "/healthz", s.HealthHandler)
+	mux.HandleFunc(http.MethodGet, "/readyz", s.ReadyHandler)
+	mux.HandleFunc(http.MethodGet, "/metrics", s.MetricsHandler)
+	mux.HandleFunc(http.MethodGet, "/openapi.json", s.OpenAPIHandler)
+
+	mux.HandleFunc(http.MethodGet, "/v2/users/{user_id}/events", s.ListEventsHandler)
+	mux.HandleFunc(http.MethodPost, "/v2/users/{user_id}/events", s.PostEventHandler)
+	mux.HandleFunc(http.MethodGet, "/v2/users/{user_id}/events/{id}", s.GetEventHandler)
+	mux.HandleFunc(http.MethodPut, "/v2/users/{user_id}/events/{id}", s.PutEventHandler)
+	mux.HandleFunc(http.MethodPatch, "/v2/users/{user_id}/events/{id}", s.PatchEventHandler)
+	mux.HandleFunc(http.MethodDelete, "/v2/users/{user_id}/events/{id}", s.DeleteEventV2Handler)
+	mux.HandleFunc(http.MethodGet, "/v2/users/{user_id}/invitations", s.ListInvitationsHandler)
+	mux.HandleFunc(http.MethodPut, "/v2/users/{user_id}/invitations/{id}", s.RespondInvitationHandler)
+
+	mux.HandleFunc(http.MethodOptions, "/caldav/users/{user_id}", s.DAVOptionsHandler)
+	mux.HandleFunc(methodPropfind, "/caldav/users/{user_id}", s.DAVHomePropfindHandler)
+	mux.HandleFunc(http.MethodOptions, "/caldav/users/{user_id}/calendar", s.DAVOptionsHandler)
+	mux.HandleFunc(methodPropfind, "/caldav/users/{user_id}/calendar", s.DAVCalendarPropfindHandler)
+	mux.HandleFunc(methodReport, "/caldav/users/{user_id}/calendar", s.DAVReportHandler)
+	mux.HandleFunc(http.MethodGet, "/caldav/users/{user_id}/calendar/{name}", s.DAVGetHandler)
+	mux.HandleFunc(http.MethodPut, "/caldav/users/{user_id}/calendar/{name}", s.DAVPutHandler)
+	mux.HandleFunc(http.MethodDelete, "/caldav/users/{user_id}/calendar/{name}", s.DAVDeleteHandler)
+
+	return mux
 }
 
+// routes - обработчик со всеми методами API и middleware
+func (s *eventServer) routes() http.Handler {
+	mux := s.endpoints()
+	handler := BodyLimitMiddleware(s.maxBodyBytes, mux)
+	handler = s.auth.Middleware(handler)
+	// ограничение до аутентификации, чтобы подбор токенов и ключей тоже ограничивался
+	handler = s.limiter.Middleware(handler)
+	handler = MetricsMiddleware(mux, s.cors.Middleware(handler))
+	return LoggingMiddleware(s.logFormat, handler)
+}
+
+// Run - запускает сервер и останавливает его по SIGINT или SIGTERM
 func (s *eventServer) Run() error {
-	mux := http.NewServeMux()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	return s.RunContext(ctx)
+}
 
-	mux.HandleFunc("/create_event", s.CreateEventHandler)
-	mux.HandleFunc("/update_event", s.UpdateEventHandler)
-	mux.HandleFunc("/delete_event", s.DeleteEventHandler)
-	mux.HandleFunc("/events_for_day", s.GetEventForDayHandler)
-	mux.HandleFunc("/events_for_week", s.GetEventForWeekHandler)
-	mux.HandleFunc("/events_for_month", s.GetEventForMonthHandler)
+// RunContext - обслуживает запросы до отмены ctx, затем плавно останавливается:
+// перестает принимать соединения, ждет завершения текущих запросов не дольше shutdownTimeout
+// и сбрасывает хранилище на диск. С TLS сертификат перечитывается по SIGHUP.
+// Если сервер не смог начать принимать соединения, хранилище тоже закрывается, а возвращается ошибка запуска.
+func (s *eventServer) RunContext(ctx context.Context) error {
+	stopScheduler := s.runScheduler()
+	defer stopScheduler()
+
+	errs := make(chan error, 1)
+	go func() {
+		if s.certs == nil {
+			errs <- s.server.ListenAndServe()
+			return
+		}
+		// сертификат берется из TLSConfig.GetCertificate
+		errs <- s.server.ListenAndServeTLS("", "")
+	}()
+	if s.certs != nil {
+		go s.certs.reloadOnSignal(ctx)
+	}
+
+	select {
+	case err := <-errs:
+		stopScheduler()
+		if closeErr := closeStorage(s.storage); closeErr != nil {
+			log.Printf("close storage: %v", closeErr)
+		}
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("shutting down, waiting up to %s for active requests", s.shutdownTimeout)
+	atomic.StoreInt32(&s.stopping, 1)
+	close(s.quit)
+
+	shutdownCtx := context.Background()
+	if s.shutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		shutdownCtx, cancel = context.WithTimeout(shutdownCtx, s.shutdownTimeout)
+		defer cancel()
+	}
 
-	s.server.Handler = LoggingMiddleware(mux)
-	return s.server.ListenAndServe()
+	err := s.server.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Printf("shutdown: %v", err)
+	}
+	stopScheduler()
+
+	if closeErr := closeStorage(s.storage); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// runScheduler - запускает планировщик напоминаний, возвращенная функция останавливает его и ждет завершения.
+// Ее можно вызывать несколько раз.
+func (s *eventServer) runScheduler() (stop func()) {
+	if s.scheduler == nil {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := s.scheduler.Run(ctx); err != nil {
+			log.Printf("reminders: %v", err)
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
 }
 
-// вспомогательная функция для парсинга delete запроса
-func parseId(body io.ReadCloser) (int, error) {
+// вспомогательная функция для парсинга delete запроса, version - ожидаемая версия события (0 - без проверки).
+// Тело принимается в JSON, www-url-form-encoded или multipart/form-data.
+func parseId(r *http.Request) (id, version int, err error) {
 	data := &struct {
-		Id int `json:"id"`
+		Id      int `json:"id"`
+		Version int `json:"version"`
 	}{}
-	if err := json.NewDecoder(body).Decode(data); err != nil {
-		return 0, err
+	form, err := decodeBody(r, data)
+	if err != nil {
+		return 0, 0, err
 	}
 
-	return data.Id, nil
-}
+	v := &validator{}
+	if form != nil {
+		v.check(form.Get("id") != "", "id", "id is required")
+		data.Id = formInt(form, "id", v)
+		data.Version = formInt(form, "version", v)
+	}
 
-// вспомогательная функция для парсинга create/update запроса
-func parseEvent(body io.ReadCloser) (event *Event, err error) {
-	event = &Event{}
-	if err = json.NewDecoder(body).Decode(event); err != nil {
-		return nil, err
+	v.check(data.Id >= 0, "id", "wrong id")
+	v.check(data.Version >= 0, "version", "wrong version")
+	if err = v.err(); err != nil {
+		return 0, 0, err
 	}
 
-	if event.Id < 0 {
-		err = errors.New("wrong id")
+	return data.Id, data.Version, nil
+}
+
+// вспомогательная функция для парсинга create/update запроса.
+// Тело принимается в JSON, www-url-form-encoded или multipart/form-data, ошибки возвращаются по всем полям сразу.
+// Событие без пояса tz получает пояс loc.
+func parseEvent(r *http.Request, loc *time.Location) (event *Event, err error) {
+	event = &Event{TimeZone: loc.String()}
+	form, err := decodeBody(r, event)
+	if err != nil {
 		return nil, err
 	}
 
-	if event.UserId < 0 {
-		err = errors.New("wrong user_id")
-		return nil, err
+	v := &validator{}
+	if form != nil {
+		event = eventFromForm(form, loc, v)
 	}
 
-	if event.Name == "" {
-		err = errors.New("name is required")
+	validateEvent(event, v)
+	if err = v.err(); err != nil {
 		return nil, err
 	}
 
 	return event, nil
 }
 
-// вспомогательная функция для парсинга параметров get запросов
-func parseParams(r *http.Request) (userId int, date time.Time, err error) {
+// вспомогательная функция для парсинга параметров get запросов.
+// date - начало окна в часовом поясе tz (по умолчанию loc)
+func parseParams(r *http.Request, loc *time.Location) (userId int, date time.Time, err error) {
 	err = r.ParseForm()
 	if err != nil {
-		return 0, time.Time{}, err
+		return 0, time.Time{}, invalidInput("", err)
 	}
 
-	if len(r.Form) < 2 || len(r.Form) > 3 {
-		err = errors.New("wrong params")
+	v := &validator{}
+	v.check(r.Form.Get("user_id") != "", "user_id", "user_id is required")
+	v.check(r.Form.Get("date") != "", "date", "date is required")
+	if err = v.err(); err != nil {
 		return 0, time.Time{}, err
 	}
 
-	userId, err = strconv.Atoi(r.Form["user_id"][0])
-	if err != nil {
-		return 0, time.Time{}, err
+	userId, err = strconv.Atoi(r.Form.Get("user_id"))
+	v.check(err == nil && userId >= 0, "user_id", "wrong user_id")
+
+	if tz := r.Form.Get("tz"); tz != "" {
+		if tzLoc, err := time.LoadLocation(tz); err == nil {
+			loc = tzLoc
+		} else {
+			v.add("tz", err.Error())
+		}
 	}
 
-	loc, _ := time.LoadLocation("Europe/Moscow")
-	date, err = time.ParseInLocation("2006-01-02", r.Form["date"][0], loc)
-	if err != nil {
+	date, err = time.ParseInLocation("2006-01-02", r.Form.Get("date"), loc)
+	v.check(err == nil, "date", "wrong date")
+
+	if err = v.err(); err != nil {
 		return 0, time.Time{}, err
 	}
 
 	return userId, date, nil
 }
 
-// resultResponse и errorResponse функции для формирования ответа
+// вспомогательная функция для парсинга user_id из query string
+func parseUserId(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("user_id")
+	if value == "" {
+		return 0, invalid("user_id", "user_id is required")
+	}
+
+	userId, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, invalidInput("user_id", err)
+	}
+	if userId < 0 {
+		return 0, invalid("user_id", "wrong user_id")
+	}
+
+	return userId, nil
+}
+
+// resultResponse и jsonResponse функции для формирования успешного ответа, ошибки формирует errorResponse
 func resultResponse(w http.ResponseWriter, event ...*Event) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	data := make(map[string][]*Event)
-	data["result"] = event
-	_ = json.NewEncoder(w).Encode(data)
+	jsonResponse(w, event)
 }
 
-func errorResponse(w http.ResponseWriter, err string, status int) {
+// jsonResponse - ответ {"result": ...} с произвольным результатом
+func jsonResponse(w http.ResponseWriter, result interface{}) {
+	data := make(map[string]interface{})
+	data["result"] = result
+	writeJSON(w, http.StatusOK, data)
+}
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
-	data := make(map[string]string)
-	data["error"] = err
 	_ = json.NewEncoder(w).Encode(data)
 }
 
-func (s *eventServer) CreateEventHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		errorResponse(w, "wrong method", http.StatusBadRequest)
-		return
+// authorizeEvent - проверяет доступ к существующему событию. Если клиент не передал ожидаемую версию,
+// подставляется версия, с которой проводилась проверка: так событие не сменит владельца между проверкой и изменением.
+func (s *eventServer) authorizeEvent(r *http.Request, id, version int) (int, error) {
+	if _, ok := principalFrom(r.Context()); !ok {
+		return version, nil
 	}
 
-	event, err := parseEvent(r.Body)
+	current, err := s.storage.Get(id)
 	if err != nil {
-		errorResponse(w, err.Error(), http.StatusBadRequest)
-		return
+		return version, err
+	}
+	if err = authorize(r, current.UserId); err != nil {
+		return version, err
 	}
 
-	err = s.storage.Create(event)
+	if version == 0 {
+		version = current.Version
+	}
+	return version, nil
+}
+
+// parseRejectOverlaps - флаг reject_overlaps из query string или формы. Читается после разбора тела запроса.
+func parseRejectOverlaps(r *http.Request) (bool, error) {
+	value := r.FormValue("reject_overlaps")
+	if value == "" {
+		return false, nil
+	}
+	reject, err := strconv.ParseBool(value)
 	if err != nil {
-		errorResponse(w, err.Error(), http.StatusBadRequest)
-		return
+		return false, invalid("reject_overlaps", "wrong reject_overlaps")
 	}
+	return reject, nil
+}
 
-	resultResponse(w, event)
+// saveEvent - создает (op = opCreate) или заменяет событие. С флагом reject_overlaps из запроса событие
+// сохраняется, только если не пересекается с другими событиями владельца, иначе возвращается *OverlapError.
+func (s *eventServer) saveEvent(r *http.Request, op string, event *Event) error {
+	reject, err := parseRejectOverlaps(r)
+	if err != nil {
+		return err
+	}
+
+	// проверка и сохранение под одной блокировкой хранилища, чтобы между ними не появилось другое событие
+	_, err = s.mutate(r, Operation{Op: op, Event: event, RejectOverlaps: reject})
+	return err
 }
 
-func (s *eventServer) UpdateEventHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		errorResponse(w, "wrong method", http.StatusBadRequest)
+// mutate - выполняет одну операцию от имени пользователя запроса. Возвращает событие операции
+// и ее ошибку без *BatchError.
+func (s *eventServer) mutate(r *http.Request, op Operation) (*Event, error) {
+	ops := []Operation{op}
+	withActor(r, ops)
+	err := s.storage.Apply(ops)
+	var batchErr *BatchError
+	if errors.As(err, &batchErr) {
+		return nil, batchErr.Err
+	}
+	return ops[0].Event, err
+}
+
+// withActor - записывает автором операций пользователя из токена. Без авторизации автором считается владелец.
+func withActor(r *http.Request, ops []Operation) {
+	p, ok := principalFrom(r.Context())
+	if !ok {
 		return
 	}
+	for i := range ops {
+		ops[i].Actor = &p.UserId
+	}
+}
 
-	event, err := parseEvent(r.Body)
+// createEvent - создает событие от имени пользователя запроса
+func (s *eventServer) createEvent(r *http.Request, event *Event) error {
+	event.UserId = actingUser(r, event.UserId, event.hasUserId)
+	if err := authorize(r, event.UserId); err != nil {
+		return err
+	}
+	return s.saveEvent(r, opCreate, event)
+}
+
+// updateEvent - заменяет событие, проверяя доступ и к текущему, и к новому владельцу
+func (s *eventServer) updateEvent(r *http.Request, event *Event) (err error) {
+	event.UserId = actingUser(r, event.UserId, event.hasUserId)
+	event.Version, err = s.authorizeEvent(r, event.Id, event.Version)
+	if err == nil {
+		err = authorize(r, event.UserId)
+	}
 	if err != nil {
-		errorResponse(w, err.Error(), http.StatusBadRequest)
+		return err
+	}
+	return s.saveEvent(r, opUpdate, event)
+}
+
+// deleteEvent - удаляет событие, version - ожидаемая версия (0 - без проверки)
+func (s *eventServer) deleteEvent(r *http.Request, id, version int) (err error) {
+	if version, err = s.authorizeEvent(r, id, version); err != nil {
+		return err
+	}
+	_, err = s.mutate(r, Operation{Op: opDelete, Id: id, Version: version})
+	return err
+}
+
+// eventsInRange - события пользователя, пересекающие [from, to)
+func (s *eventServer) eventsInRange(r *http.Request, userId int, from, to time.Time) ([]*Event, error) {
+	if err := authorize(r, userId); err != nil {
+		return nil, err
+	}
+	return s.storage.GetRange(userId, from, to), nil
+}
+
+func (s *eventServer) CreateEventHandler(w http.ResponseWriter, r *http.Request) {
+	event, err := parseEvent(r, s.location)
+	if err == nil {
+		err = s.createEvent(r, event)
+	}
+	if err != nil {
+		errorResponse(w, err)
 		return
 	}
 
-	err = s.storage.Update(event)
+	resultResponse(w, event)
+}
+
+func (s *eventServer) UpdateEventHandler(w http.ResponseWriter, r *http.Request) {
+	event, err := parseEvent(r, s.location)
+	if err == nil {
+		err = s.updateEvent(r, event)
+	}
 	if err != nil {
-		errorResponse(w, err.Error(), http.StatusBadRequest)
+		errorResponse(w, err)
 		return
 	}
 
@@ -324,93 +791,166 @@ func (s *eventServer) UpdateEventHandler(w http.ResponseWriter, r *http.Request)
 }
 
 func (s *eventServer) DeleteEventHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		errorResponse(w, "wrong method", http.StatusBadRequest)
+	id, version, err := parseId(r)
+	if err == nil {
+		err = s.deleteEvent(r, id, version)
+	}
+	if err != nil {
+		errorResponse(w, err)
 		return
 	}
 
-	id, err := parseId(r.Body)
+	resultResponse(w, &Event{Id: id})
+}
+
+// eventsForPeriod - события пользователя за период, начинающийся с даты из запроса.
+// Если переданы limit или cursor, события отдаются страницами.
+func (s *eventServer) eventsForPeriod(w http.ResponseWriter, r *http.Request, years, months, days int) {
+	userId, date, err := parseParams(r, s.location)
 	if err != nil {
-		errorResponse(w, err.Error(), http.StatusBadRequest)
+		errorResponse(w, err)
+		return
+	}
+
+	v := &validator{}
+	page := parsePage(r.Form, 0, v)
+	if err = v.err(); err != nil {
+		errorResponse(w, err)
 		return
 	}
 
-	err = s.storage.Delete(id)
+	events, err := s.eventsInRange(r, userId, date, date.AddDate(years, months, days))
 	if err != nil {
-		errorResponse(w, err.Error(), http.StatusBadRequest)
+		errorResponse(w, err)
 		return
 	}
 
-	resultResponse(w, &Event{Id: id})
+	pageResponse(w, events, page)
 }
 
 func (s *eventServer) GetEventForDayHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		errorResponse(w, "wrong method", http.StatusBadRequest)
+	s.eventsForPeriod(w, r, 0, 0, 1)
+}
+
+func (s *eventServer) GetEventForWeekHandler(w http.ResponseWriter, r *http.Request) {
+	s.eventsForPeriod(w, r, 0, 0, 7)
+}
+
+func (s *eventServer) GetEventForMonthHandler(w http.ResponseWriter, r *http.Request) {
+	s.eventsForPeriod(w, r, 0, 1, 0)
+}
+
+// SearchHandler - поиск событий пользователя по словам названия, необязательно в интервале from, to
+func (s *eventServer) SearchHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := parseUserId(r)
+	if err == nil {
+		err = authorize(r, userId)
+	}
+	if err != nil {
+		errorResponse(w, err)
 		return
 	}
 
-	userId, date, err := parseParams(r)
+	from, to, err := parseRange(r, s.location)
 	if err != nil {
-		errorResponse(w, err.Error(), http.StatusBadRequest)
+		errorResponse(w, err)
 		return
 	}
 
-	events := s.storage.GetForDay(userId, date)
+	query := r.URL.Query()
+	v := &validator{}
+	v.check(len(tokenize(query.Get("q"))) > 0, "q", "q must contain at least one word")
+	page := parsePage(query, defaultPageLimit, v)
+	if err = v.err(); err != nil {
+		errorResponse(w, err)
+		return
+	}
 
-	resultResponse(w, events...)
+	pageResponse(w, s.storage.Search(userId, query.Get("q"), from, to), page)
 }
 
-func (s *eventServer) GetEventForWeekHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		errorResponse(w, "wrong method", http.StatusBadRequest)
-		return
+func (s *eventServer) ExportHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := parseUserId(r)
+	if err == nil {
+		err = authorize(r, userId)
 	}
-
-	userId, date, err := parseParams(r)
 	if err != nil {
-		errorResponse(w, err.Error(), http.StatusBadRequest)
+		errorResponse(w, err)
 		return
 	}
 
-	events := s.storage.GetForWeek(userId, date)
+	events := s.storage.GetAll(userId)
 
-	resultResponse(w, events...)
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="calendar.ics"`)
+	w.WriteHeader(http.StatusOK)
+	if err = encodeICS(w, events, time.Now()); err != nil {
+		log.Printf("export ics: %v", err)
+	}
 }
 
-func (s *eventServer) GetEventForMonthHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		errorResponse(w, "wrong method", http.StatusBadRequest)
+// ImportHandler - создает события из .ics, для каждого VEVENT возвращает созданное событие или ошибку
+func (s *eventServer) ImportHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := parseUserId(r)
+	if err == nil {
+		err = authorize(r, userId)
+	}
+	if err != nil {
+		errorResponse(w, err)
 		return
 	}
 
-	userId, date, err := parseParams(r)
+	imported, err := decodeICS(r.Body, userId, s.location)
 	if err != nil {
-		errorResponse(w, err.Error(), http.StatusBadRequest)
+		errorResponse(w, invalidInput("", err))
 		return
 	}
 
-	events := s.storage.GetForMonth(userId, date)
+	for i := range imported {
+		if imported[i].Event == nil {
+			continue
+		}
+		if _, err = s.mutate(r, Operation{Op: opCreate, Event: imported[i].Event}); err != nil {
+			imported[i].Event = nil
+			imported[i].Error = err.Error()
+		}
+	}
 
-	resultResponse(w, events...)
+	jsonResponse(w, imported)
 }
 
-func LoggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		start := time.Now()
-		next.ServeHTTP(w, req)
-		log.Printf("%s %s %s", req.Method, req.RequestURI, time.Since(start))
-	})
-}
+var (
+	configPath = flag.String("config", "", "путь к файлу конфигурации (yaml или json)")
+	issueToken = flag.String("issue-token", "", "выпустить токен для user_id[:role] и завершиться")
+	tokenTTL   = flag.Duration("token-ttl", 24*time.Hour, "срок действия выпускаемого токена")
+)
 
 func main() {
-	if len(os.Args) < 2 {
-		log.Println("enter port")
+	flag.Parse()
+
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *issueToken != "" {
+		if err = printToken(cfg.Auth, *issueToken, *tokenTTL); err != nil {
+			log.Fatal(err)
+		}
 		return
 	}
 
-	s := NewServer(os.Args[1])
-	if err := s.Run(); err != nil {
+	// для совместимости порт можно по-прежнему передать первым аргументом
+	if port := flag.Arg(0); port != "" {
+		cfg.Addr = net.JoinHostPort("localhost", port)
+	}
+
+	s, err := NewServer(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err = s.Run(); err != nil {
 		log.Fatal(err)
 	}
 }
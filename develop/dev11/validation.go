@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// форматы тела запроса
+const (
+	bodyJSON      = "json"
+	bodyForm      = "form"
+	bodyMultipart = "multipart"
+)
+
+// multipartMemory - сколько данных multipart формы держать в памяти, остальное уходит во временные файлы
+const multipartMemory = 1 << 20
+
+// validator - собирает ошибки валидации по полям, чтобы вернуть их клиенту все сразу
+type validator struct {
+	fields map[string]string
+}
+
+// add - запоминает ошибку поля, для каждого поля сохраняется первая ошибка
+func (v *validator) add(field, message string) {
+	if v.fields == nil {
+		v.fields = map[string]string{}
+	}
+	if _, exist := v.fields[field]; !exist {
+		v.fields[field] = message
+	}
+}
+
+// check - добавляет ошибку, если условие не выполнено
+func (v *validator) check(ok bool, field, message string) {
+	if !ok {
+		v.add(field, message)
+	}
+}
+
+// addError - добавляет ошибку разбора, ошибка валидации сохраняет свое поле
+func (v *validator) addError(field string, err error) {
+	var validation *ValidationError
+	if errors.As(err, &validation) {
+		if len(validation.Fields) > 0 {
+			for f, message := range validation.Fields {
+				v.add(f, message)
+			}
+			return
+		}
+		if validation.Field != "" {
+			field = validation.Field
+		}
+	}
+	v.add(field, err.Error())
+}
+
+// err - итоговая ошибка или nil. Если ошибка одна, ее текст возвращается как есть.
+func (v *validator) err() error {
+	if len(v.fields) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(v.fields))
+	for name := range v.fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if len(names) == 1 {
+		return &ValidationError{Field: names[0], Message: v.fields[names[0]], Fields: v.fields}
+	}
+
+	messages := make([]string, 0, len(names))
+	for _, name := range names {
+		messages = append(messages, name+": "+v.fields[name])
+	}
+	return &ValidationError{Message: strings.Join(messages, "; "), Fields: v.fields}
+}
+
+// bodyFormat - определяет формат тела по Content-Type. Для совместимости со старыми клиентами,
+// которые шлют JSON без заголовка или с заголовком формы (так делает curl -d), тело, начинающееся с '{',
+// считается JSON.
+func bodyFormat(r *http.Request) (string, error) {
+	contentType := r.Header.Get("Content-Type")
+	mediaType := ""
+	if contentType != "" {
+		var err error
+		mediaType, _, err = mime.ParseMediaType(contentType)
+		if err != nil {
+			return "", invalid("Content-Type", err.Error())
+		}
+	}
+
+	switch mediaType {
+	case "application/json":
+		return bodyJSON, nil
+	case "multipart/form-data":
+		return bodyMultipart, nil
+	case "", "application/x-www-form-urlencoded":
+		reader := bufio.NewReader(r.Body)
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{reader, r.Body}
+
+		first, err := firstNonSpace(reader)
+		if err != nil {
+			return "", invalidInput("", err)
+		}
+		if first == '{' {
+			return bodyJSON, nil
+		}
+		return bodyForm, nil
+	default:
+		return "", invalid("Content-Type", "unsupported content type "+mediaType)
+	}
+}
+
+// firstNonSpace - первый непробельный байт тела без его чтения, 0 для пустого тела
+func firstNonSpace(reader *bufio.Reader) (byte, error) {
+	for n := 1; ; n++ {
+		b, err := reader.Peek(n)
+		if len(b) < n {
+			if err == io.EOF || err == bufio.ErrBufferFull {
+				return 0, nil
+			}
+			return 0, err
+		}
+		switch c := b[n-1]; c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		default:
+			return c, nil
+		}
+	}
+}
+
+// decodeBody - разбирает тело запроса: JSON декодируется в dst, форма возвращается как url.Values
+func decodeBody(r *http.Request, dst interface{}) (form url.Values, err error) {
+	format, err := bodyFormat(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case bodyJSON:
+		if err = json.NewDecoder(r.Body).Decode(dst); err != nil {
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &typeErr) && typeErr.Field != "" {
+				return nil, invalid(typeErr.Field, "wrong "+typeErr.Field)
+			}
+			return nil, invalidInput("", err)
+		}
+		return nil, nil
+	case bodyMultipart:
+		if err = r.ParseMultipartForm(multipartMemory); err != nil {
+			return nil, invalidInput("", err)
+		}
+		return r.PostForm, nil
+	default:
+		if err = r.ParseForm(); err != nil {
+			return nil, invalidInput("", err)
+		}
+		return r.PostForm, nil
+	}
+}
+
+// formInt - необязательное целое поле формы
+func formInt(form url.Values, field string, v *validator) int {
+	value := form.Get(field)
+	if value == "" {
+		return 0
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		v.add(field, "wrong "+field)
+	}
+	return n
+}
+
+// eventFromForm - собирает событие из полей формы, ошибки складываются в v. Без поля tz событие получает пояс loc
+func eventFromForm(form url.Values, loc *time.Location, v *validator) *Event {
+	event := &Event{
+		Id:       formInt(form, "id", v),
+		UserId:   formInt(form, "user_id", v),
+		Version:  formInt(form, "version", v),
+		Name:     form.Get("name"),
+		TimeZone: loc.String(),
+
+		hasUserId: form.Get("user_id") != "",
+	}
+
+	if tz := form.Get("tz"); tz != "" {
+		event.TimeZone = tz
+		if tzLoc, err := time.LoadLocation(tz); err == nil {
+			loc = tzLoc
+		} else {
+			v.add("tz", err.Error())
+		}
+	}
+
+	start := form.Get("start")
+	if start == "" {
+		start = form.Get("date")
+	}
+	if start != "" {
+		t, allDay, err := parseEventTime(start, loc)
+		if err != nil {
+			v.add("start", "wrong start")
+		}
+		event.Start = jsonTime(t)
+		event.AllDay = allDay
+	}
+
+	if end := form.Get("end"); end != "" {
+		t, _, err := parseEventTime(end, loc)
+		if err != nil {
+			v.add("end", "wrong end")
+		}
+		event.End = jsonTime(t)
+	}
+
+	if rrule := form.Get("rrule"); rrule != "" {
+		rule, err := ParseRecurrence(rrule)
+		if err != nil {
+			v.add("rrule", err.Error())
+		}
+		event.RRule = rule
+	}
+
+	// исключенные даты можно передать несколькими полями или через запятую
+	for _, values := range form["exdates"] {
+		for _, value := range strings.Split(values, ",") {
+			ex, err := parseExDate(strings.TrimSpace(value), loc)
+			if err != nil {
+				v.add("exdates", "wrong exdates")
+				continue
+			}
+			event.ExDates = append(event.ExDates, ex)
+		}
+	}
+
+	event.Attendees = attendeesFromForm(form["attendees"], v)
+
+	// напоминания, как и исключенные даты, можно передать несколькими полями или через запятую
+	for _, values := range form["reminders"] {
+		for _, value := range strings.Split(values, ",") {
+			d := Duration(0)
+			if err := d.set(strings.TrimSpace(value)); err != nil {
+				v.add("reminders", "wrong reminders")
+				continue
+			}
+			event.Reminders = append(event.Reminders, d)
+		}
+	}
+
+	return event
+}
+
+// validateEvent - общие проверки события независимо от формата запроса
+func validateEvent(event *Event, v *validator) {
+	v.check(event.Id >= 0, "id", "wrong id")
+	v.check(event.Version >= 0, "version", "wrong version")
+	v.check(event.UserId >= 0, "user_id", "wrong user_id")
+	v.check(event.Name != "", "name", "name is required")
+
+	v.check(len(event.Reminders) <= maxReminders, "reminders", fmt.Sprintf("at most %d reminders allowed", maxReminders))
+	for _, d := range event.Reminders {
+		v.check(d >= 0 && time.Duration(d) <= maxReminderBefore, "reminders",
+			fmt.Sprintf("reminder must be between 0 and %s before start", maxReminderBefore))
+	}
+
+	validateAttendees(event, v)
+
+	if err := event.normalize(); err != nil {
+		v.addError("start", err)
+	}
+}